@@ -40,12 +40,14 @@ do
     CGO_ENABLED=0 GOOS=$i GOARCH=$j go build -ldflags "-X pTunnel/utils/version.version=$VERSION" -o ./release/build/$i-$j/pTunnelServer cmd/server/pTunnelServer.go
     CGO_ENABLED=0 GOOS=$i GOARCH=$j go build -ldflags "-X pTunnel/utils/version.version=$VERSION" -o ./release/build/$i-$j/pTunnelProxy cmd/proxy/pTunnelProxy.go
     CGO_ENABLED=0 GOOS=$i GOARCH=$j go build -ldflags "-X pTunnel/utils/version.version=$VERSION" -o ./release/build/$i-$j/pTunnelGenRSAKey cmd/genRSAKey/pTunnelGenRSAKey.go
+    CGO_ENABLED=0 GOOS=$i GOARCH=$j go build -ldflags "-X pTunnel/utils/version.version=$VERSION" -o ./release/build/$i-$j/pTunnelGenCert cmd/genCert/pTunnelGenCert.go
     # check whether the os is windows, if yes, add .exe suffix
     if [ $i = "windows" ]; then
       mv ./release/build/$i-$j/pTunnelClient ./release/build/$i-$j/pTunnelClient.exe
       mv ./release/build/$i-$j/pTunnelServer ./release/build/$i-$j/pTunnelServer.exe
       mv ./release/build/$i-$j/pTunnelProxy ./release/build/$i-$j/pTunnelProxy.exe
       mv ./release/build/$i-$j/pTunnelGenRSAKey ./release/build/$i-$j/pTunnelGenRSAKey.exe
+      mv ./release/build/$i-$j/pTunnelGenCert ./release/build/$i-$j/pTunnelGenCert.exe
     fi
     # compress the binary with zip and save it in ./release/packages
     cd ./release/build/$i-$j
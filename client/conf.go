@@ -1,50 +1,74 @@
 package client
 
 import (
+	"crypto"
+	"errors"
+	"pTunnel/conn"
+	tunnel2 "pTunnel/tunnel"
 	"pTunnel/utils/common"
 	"pTunnel/utils/p2p"
-	"strconv"
-
-	"golang.org/x/crypto/ssh"
+	"pTunnel/utils/security"
+	"time"
 )
 
 var (
-	PublicKeyFile     string
-	NBitsFile         string
-	ServerAddrV4      string
-	ServerAddrV6      string
-	ServerPort        int
-	ServerType        string
-	LogFile           string
-	LogWay            string
-	LogLevel          string
-	LogMaxDays        int
-	NatType           int
-	MappingType       int
-	FilteringType     int
-	SSHPrivateKeyFile string
-	SshSigner         ssh.Signer
+	PublicKeyFile            string
+	ServerAddrV4             string
+	ServerAddrV6             string
+	ServerPort               int
+	ServerType               string
+	LogFile                  string
+	LogWay                   string
+	LogLevel                 string
+	LogMaxDays               int
+	NatType                  int
+	MappingType              int
+	FilteringType            int
+	SSHPrivateKeyFile        string
+	SSHPrivateKeyPassphrase  string // only for encrypted ssh private key
+	SSHPassword              string // for password and keyboard-interactive auth
+	SSHAgent                 bool   // use the ssh agent at SSH_AUTH_SOCK
+	SSHKnownHostsFile        string
+	SSHInsecureIgnoreHostKey bool   // accept any host key if neither known_hosts nor the fingerprints from the server are available
+	WSPath                   string // only for ws/wss socket
+	WSHost                   string // only for ws/wss socket
+	TLSServerName            string // only for tls/wss/quic socket
+	TLSALPN                  string // only for tls/wss socket
+	TLSCAFile                string // only for tls/wss/quic socket
+	TLSPinnedCert            string // only for tls/wss/quic socket
+	TLSCertFile              string // only for tls/wss/quic socket, the client certificate for mutual tls
+	TLSKeyFile               string // only for tls/wss/quic socket, the private key of TLSCertFile
+	KCPProfile               string // the kcp profile of the control connection
+	User                     string // only if the server has a UsersFile
+	Token                    string // only if the server has a UsersFile
+	RekeyBytes               int64  // a direction of a tunnel or control connection is rekeyed after so many bytes, 0 means never
+	RekeyInterval            int    // seconds, a direction of a tunnel or control connection is rekeyed after so long, 0 means never
+	MetricsAddr              string // the address of the prometheus metrics, e.g. 127.0.0.1:9101, empty means disabled
 )
 
 var (
-	PublicKey []byte
-	NBits     int
+	PublicKey crypto.PublicKey
+	KCPConfig *conn.KCPConfig
+	SSHAuth   *conn.SSHAuth
 )
 
 // InitConf initializes the configurations
 func InitConf() error {
-	publicKey, err := common.LoadFile(PublicKeyFile)
-	if err != nil {
-		return err
-	}
-	PublicKey = publicKey
-	nBits, err := common.LoadFile(NBitsFile)
-	if err != nil {
-		return err
-	}
-	NBits, err = strconv.Atoi(string(nBits))
-	if err != nil {
-		return err
+	var err error
+	PublicKey = nil
+	if PublicKeyFile != "" {
+		publicKey, err := common.LoadFile(PublicKeyFile)
+		if err != nil {
+			return err
+		}
+		PublicKey, err = security.ParsePublicKey(publicKey)
+		if err != nil {
+			return err
+		}
+	} else if !conn.IsTLSType(ServerType) || TLSCertFile == "" || (TLSCAFile == "" && TLSPinnedCert == "") {
+		// without the public key the server is only authenticated by its
+		// certificate, so the certificate must be verified
+		return errors.New("PublicKeyFile can only be omitted with mutual tls, which needs a tls, wss or quic ServerType, TLSCertFile and TLSCAFile or TLSPinnedCert")
 	}
 	if NatType != -1 {
 		MappingType = NatType / 3
@@ -55,16 +79,37 @@ func InitConf() error {
 			return err
 		}
 	}
-	SshSigner = nil
+	KCPConfig, err = conn.ParseKCPConfig(KCPProfile)
+	if err != nil {
+		return err
+	}
+	conn.WSPath = WSPath
+	conn.WSHost = WSHost
+	conn.ClientTLSConfig, err = conn.NewClientTLSConfig(TLSServerName, TLSALPN, TLSCAFile, TLSPinnedCert, TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	SSHAuth = &conn.SSHAuth{
+		UseAgent:       SSHAgent,
+		Password:       SSHPassword,
+		KnownHostsFile: SSHKnownHostsFile,
+		InsecureIgnore: SSHInsecureIgnoreHostKey,
+	}
 	if SSHPrivateKeyFile != "" {
 		privateKey, err := common.LoadFile(SSHPrivateKeyFile)
 		if err != nil {
 			return err
 		}
-		SshSigner, err = ssh.ParsePrivateKey(privateKey)
+		signer, err := conn.NewSSHSigner(privateKey, SSHPrivateKeyPassphrase)
 		if err != nil {
 			return err
 		}
+		SSHAuth.Signers = append(SSHAuth.Signers, signer)
+	}
+	if RekeyBytes < 0 || RekeyInterval < 0 {
+		return errors.New("RekeyBytes and RekeyInterval must not be negative")
 	}
+	tunnel2.RekeyBytes = RekeyBytes
+	tunnel2.RekeyInterval = time.Duration(RekeyInterval) * time.Second
 	return nil
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
@@ -8,132 +9,144 @@ import (
 	tunnel2 "pTunnel/tunnel"
 	"pTunnel/utils/consts"
 	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
 	"pTunnel/utils/p2p"
 	"pTunnel/utils/security"
 	"pTunnel/utils/serialize"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Service struct {
-	Name             string // set mannually
-	InternalAddr     string // set mannually
-	InternalPort     int    // set mannually
-	InternalType     string // set mannually
-	ExternalPort     int    // set mannually
-	ExternalType     string // set mannually
-	TunnelPort       int    // set automatically/mannually
-	TunnelType       string // set mannually
-	TunnelEncrypt    bool   // set mannually
-	HeartbeatTimeout int    // set automatically
-	SshPort          int    // only for ssh tunnel, set automatically
-	SshUser          string // only for ssh tunnel, set automatically
-	P2PAddrV4        string // only for p2p tunnel, optional
-	P2PAddrV6        string // only for p2p tunnel, optional
-	P2PPort          int    // only for p2p tunnel, optional
-
-	SecretKey []byte // set automatically
-
-	ControlSocket  conn.Socket // set automatically
-	ControlMsgChan chan int    // set automatically
-	TunnelMsgChan  chan int    // set automatically
+	Name            string          // set mannually
+	InternalAddr    string          // set mannually
+	InternalPort    int             // set mannually
+	InternalType    string          // set mannually
+	ExternalPort    int             // set mannually
+	ExternalType    string          // set mannually
+	TunnelPort      int             // set automatically/mannually
+	TunnelType      string          // set mannually
+	TunnelEncrypt   bool            // set mannually
+	TunnelMux       bool            // set mannually
+	PoolSize        int             // set mannually
+	PoolIdleTimeout int             // set mannually
+	CustomDomains   string          // only for http external type, set mannually
+	KCPProfile      string          // set mannually, empty means the default profile of the server
+	KCPCrypt        string          // only for kcp and p2p tunnel, set mannually
+	KCPConfig       *conn.KCPConfig // set automatically
+	TunnelKCPConfig *conn.KCPConfig // KCPConfig with KCPCrypt, set automatically
+	SshPort         int             // only for ssh tunnel, set automatically
+	SshUser         string          // only for ssh tunnel, set automatically
+	SSHAuth         *conn.SSHAuth   // only for ssh tunnel, set automatically
+	P2PAddrV4       string          // only for p2p tunnel, optional
+	P2PAddrV6       string          // only for p2p tunnel, optional
+	P2PPort         int             // only for p2p tunnel, optional
+
+	SecretKey []byte // derived from the key of the session, set automatically
+
+	Session       *Session                     // set automatically
+	ReplyChan     chan *map[string]interface{} // set automatically
+	TunnelMsgChan chan int                     // set automatically
+	Done          chan struct{}                // closed once the service is stopped, set automatically
+	stopOnce      sync.Once
+
+	requestedTunnelPort int    // TunnelPort in the config, TunnelPort is replaced by the port given by the server
+	requestedKCPCrypt   string // KCPCrypt in the config, KCPCrypt is replaced by the crypt chosen by the server
+
+	MuxSession *conn.MuxSession // only for mux tunnel, set automatically
+	muxLock    sync.Mutex
+	stopped    atomic.Bool
 }
 
-func (service *Service) run(wait *sync.WaitGroup) {
-	defer wait.Done()
+func (service *Service) run() {
 	log.Info("Service [%s] is running", service.Name)
+	defer service.closeMuxSession()
+	defer service.stopped.Store(true)
 
-	// Create control socket
-	if service.createControlSocket() != nil {
+	// Wait for the reply of the server
+	log.Info("Service [%s] is extracting metadata", service.Name)
+	var reply *map[string]interface{}
+	select {
+	case reply = <-service.ReplyChan:
+	case <-service.Done:
 		return
 	}
-
-	// Generate SecretKey
-	service.SecretKey = security.AesGenKey(32)
-
-	// Extract metadata
-	log.Info("Service [%s] is extracting metadata", service.Name)
-	if service.extractMetadata() != nil {
+	if service.extractMetadata(*reply) != nil {
+		service.Session.remove(service)
 		return
 	}
 	log.Info("Service [%s] metadata extracted successfully", service.Name)
 
-	service.ControlMsgChan = make(chan int, 100)
 	service.TunnelMsgChan = make(chan int, 100)
 
-	// Start a new goroutine to create heartbeat message
-	go service.heartBeatCreator()
-
-	// Start a new goroutine to send control message
-	go service.controlMsgSender()
-
 	// Start a new goroutine to create new tunnel
 	go service.tunnelCreator()
 
-	// Listen to the control message from the server
-	service.controlMsgReader()
+	// Park PoolSize tunnels on the server in advance
+	for i := 0; i < service.PoolSize; i++ {
+		go service.fillPool()
+	}
+
+	<-service.Done
 }
 
-func (service *Service) createControlSocket() (err error) {
-	// Connect to server
-	service.ControlSocket, err = conn.NewSocket(
-		ServerType,
-		consts.Auto, consts.Auto, 0,
-		ServerAddrV4, ServerAddrV6, ServerPort,
-		consts.UnConf, 0, nil,
-	)
-	if err != nil {
-		log.Error("Service [%s] connect to server failed. Error: %v", service.Name, err)
-	}
-	return
+// stop stops the tunnels of the service, it is not told to the server
+func (service *Service) stop() {
+	service.stopOnce.Do(func() {
+		service.stopped.Store(true)
+		close(service.Done)
+	})
 }
 
-func (service *Service) extractMetadata() (err error) {
+// metadata is the Register/Update message of the service
+func (service *Service) metadata() map[string]interface{} {
 	dict := make(map[string]interface{})
-	dict["SecretKey"] = string(service.SecretKey)
+	dict["Service"] = service.Name
 	dict["ExternalPort"] = strconv.Itoa(service.ExternalPort)
 	dict["ExternalType"] = service.ExternalType
-	dict["TunnelPort"] = strconv.Itoa(service.TunnelPort)
+	dict["TunnelPort"] = strconv.Itoa(service.requestedTunnelPort)
 	dict["TunnelType"] = service.TunnelType
 	dict["TunnelEncrypt"] = service.TunnelEncrypt
-	bytes, err := serialize.Serialize(&dict)
-	if err != nil {
-		log.Error("Service [%s] serialize metadata failed. Error: %v", service.Name, err)
-		return
-	}
-	bytes, err = security.RSAEncryptBase64(bytes, PublicKey, NBits)
-	if err != nil {
-		log.Error("Service [%s] encrypt metadata failed. Error: %v", service.Name, err)
-		return
-	}
+	dict["TunnelMux"] = service.TunnelMux
+	dict["PoolSize"] = strconv.Itoa(service.PoolSize)
+	dict["PoolIdleTimeout"] = strconv.Itoa(service.PoolIdleTimeout)
+	dict["CustomDomains"] = service.CustomDomains
+	dict["KCPProfile"] = service.KCPProfile
+	dict["KCPCrypt"] = service.requestedKCPCrypt
+	return dict
+}
 
-	// Send metadata to the server
-	if err = service.ControlSocket.WriteLine(bytes); err != nil {
-		log.Error("Service [%s] send metadata failed. Error: %v", service.Name, err)
-		return
-	}
+// sameConfig reports whether other is configured like the service
+func (service *Service) sameConfig(other *Service) bool {
+	return service.InternalAddr == other.InternalAddr &&
+		service.InternalPort == other.InternalPort &&
+		service.InternalType == other.InternalType &&
+		service.ExternalPort == other.ExternalPort &&
+		service.ExternalType == other.ExternalType &&
+		service.requestedTunnelPort == other.requestedTunnelPort &&
+		service.TunnelType == other.TunnelType &&
+		service.TunnelEncrypt == other.TunnelEncrypt &&
+		service.TunnelMux == other.TunnelMux &&
+		service.PoolSize == other.PoolSize &&
+		service.PoolIdleTimeout == other.PoolIdleTimeout &&
+		service.CustomDomains == other.CustomDomains &&
+		service.KCPProfile == other.KCPProfile &&
+		service.requestedKCPCrypt == other.requestedKCPCrypt &&
+		service.P2PAddrV4 == other.P2PAddrV4 &&
+		service.P2PAddrV6 == other.P2PAddrV6
+}
 
-	// Receive metadata from the server
-	bytes, err = service.ControlSocket.ReadLine()
-	if err != nil {
-		log.Error("Service [%s] receive metadata failed. Error: %v", service.Name, err)
+func (service *Service) extractMetadata(dict map[string]interface{}) (err error) {
+	if err = checkStatus(dict); err != nil {
+		log.Error("Service [%s] is rejected by the server. Error: %v", service.Name, err)
 		return
 	}
-	bytes, err = security.AESDecryptBase64(bytes, service.SecretKey)
+	service.SecretKey, err = security.DeriveKey(service.Session.SecretKey, "pTunnel service key "+service.Name, 32)
 	if err != nil {
-		log.Error("Service [%s] decrypt metadata failed. Error: %v", service.Name, err)
-		return
-	}
-	dict = make(map[string]interface{})
-	if err = serialize.Deserialize(bytes, &dict); err != nil {
-		log.Error("Service [%s] deserialize metadata failed. Error: %v", service.Name, err)
-		return
-	}
-	var status int
-	if status, err = strconv.Atoi(dict["Status"].(string)); err != nil || status != 200 {
-		log.Error("Service [%s] metadata status is not 200. Error: %v", service.Name, err)
+		log.Error("Service [%s] derive secret key failed. Error: %v", service.Name, err)
 		return
 	}
 	service.TunnelPort, err = strconv.Atoi(dict["TunnelPort"].(string))
@@ -141,11 +154,6 @@ func (service *Service) extractMetadata() (err error) {
 		log.Error("Service [%s] extract tunnel port failed. Error: %v", service.Name, err)
 		return
 	}
-	service.HeartbeatTimeout, err = strconv.Atoi(dict["HeartbeatTimeout"].(string))
-	if err != nil {
-		log.Error("Service [%s] extract heartbeat timeout failed. Error: %v", service.Name, err)
-		return
-	}
 	if strings.HasPrefix(strings.ToLower(service.TunnelType), "ssh") {
 		service.SshPort, err = strconv.Atoi(dict["SshPort"].(string))
 		if err != nil || service.SshPort == 0 {
@@ -153,93 +161,195 @@ func (service *Service) extractMetadata() (err error) {
 			return
 		}
 		service.SshUser = dict["SshUser"].(string)
-	}
-
-	log.Info("Service [%s] metadata extracted successfully", service.Name)
-	return
-}
-
-func (service *Service) heartBeatCreator() {
-	log.Info("Service [%s] heartbeat sender is running", service.Name)
-	for {
-		time.Sleep(time.Duration(service.HeartbeatTimeout/2) * time.Second)
-		service.ControlMsgChan <- consts.Heartbeat
-	}
-}
-
-func (service *Service) controlMsgSender() {
-	log.Info("Service [%s] control message sender is running", service.Name)
-	for {
-		msg, ok := <-service.ControlMsgChan
-		if !ok {
-			log.Error("Service [%s] control message channel closed", service.Name)
-			break
+		// the metadata is signed by the server key, so the fingerprints can be trusted
+		var hostKeys []string
+		if fingerprints, _ := dict["SshHostKeys"].(string); fingerprints != "" {
+			hostKeys = strings.Split(fingerprints, ",")
 		}
-		buf := fmt.Sprintf("%d", msg)
-		bytes, err := security.AESEncryptBase64([]byte(buf), service.SecretKey)
+		service.SSHAuth = SSHAuth.WithHostKeys(hostKeys)
+	}
+	// the server decides the kcp profile so that both ends match
+	service.KCPConfig = KCPConfig
+	if kcpProfile, ok := dict["KCPProfile"].(string); ok {
+		service.KCPConfig, err = conn.ParseKCPConfig(kcpProfile)
 		if err != nil {
-			log.Error("Service [%s] encrypt control message failed. Error: %v", service.Name, err)
-			break
+			log.Error("Service [%s] extract kcp profile failed. Error: %v", service.Name, err)
+			return
 		}
-		err = service.ControlSocket.WriteLine(bytes)
+	}
+	if kcpCrypt, ok := dict["KCPCrypt"].(string); ok {
+		service.KCPCrypt = kcpCrypt
+	}
+	// p2p tunnels register on the server without crypt, the punched
+	// session is encrypted with the key of the p2p metadata instead
+	service.TunnelKCPConfig = service.KCPConfig
+	if !strings.HasPrefix(strings.ToLower(service.TunnelType), "p2p") {
+		service.TunnelKCPConfig, err = service.KCPConfig.WithCrypt(service.KCPCrypt, service.SecretKey)
 		if err != nil {
-			log.Error("Service [%s] send control message failed. Error: %v", service.Name, err)
-			break
+			log.Error("Service [%s] create kcp crypt failed. Error: %v", service.Name, err)
+			return
 		}
 	}
+	return
 }
 
 func (service *Service) tunnelCreator() {
 	log.Info("Service [%s] tunnel manager is running", service.Name)
 	for {
-		_ = <-service.TunnelMsgChan
-		socketType := service.TunnelType
-		if service.TunnelType == "p2p6" {
-			socketType = "kcp6"
-		} else if service.TunnelType == "p2p4" {
-			socketType = "kcp4"
+		select {
+		case <-service.TunnelMsgChan:
+		case <-service.Done:
+			return
 		}
-		tunnel, err := conn.NewSocket(
-			socketType,
-			consts.Auto, consts.Auto, 0,
-			ServerAddrV4, ServerAddrV6,
-			service.TunnelPort, service.SshUser, service.SshPort, SshSigner,
-		)
+		tunnel, err := service.openTunnel()
 		if err != nil {
 			log.Error("Service [%s] create a new tunnel failed. Error: %v", service.Name, err)
 			continue
 		}
 		if !strings.HasPrefix(strings.ToLower(service.TunnelType), "p2p") {
-			client, err := conn.NewSocket(
-				service.InternalType,
-				consts.Auto, consts.Auto, 0,
-				service.InternalAddr, service.InternalAddr,
-				service.InternalPort, consts.UnConf, 0, nil,
-			)
-			if err != nil {
-				tunnel.Close()
-				log.Error("Service [%s] create a new client failed. Error: %v", service.Name, err)
-				continue
-			}
-			go service.tunnel(client, tunnel, &service.SecretKey)
+			go service.relay(tunnel, false)
 		} else {
 			go service.p2pTunnel(tunnel)
 		}
 	}
 }
 
+// fillPool parks a new authenticated tunnel in the WorkerChan of the server
+func (service *Service) fillPool() {
+	if service.stopped.Load() {
+		return
+	}
+	tunnel, err := service.openTunnel()
+	if err != nil {
+		log.Error("Service [%s] create a pooled tunnel failed. Error: %v", service.Name, err)
+		time.AfterFunc(time.Second, service.fillPool)
+		return
+	}
+	go service.relay(tunnel, true)
+}
+
+// relay waits until the server pairs the tunnel with a request,
+// then connects to the internal service and forwards data
+func (service *Service) relay(tunnel conn.Socket, pooled bool) {
+	defer tunnel.Close()
+	connID, tunnelKey, err := tunnel2.ClientTunnelSafetyCheck(tunnel, service.SecretKey)
+	if err != nil {
+		if pooled && !service.stopped.Load() {
+			// the server expired this tunnel or it was broken, replace it
+			log.Debug("Service [%s] pooled tunnel is expired", service.Name)
+			time.AfterFunc(time.Second, service.fillPool)
+			return
+		}
+		log.Error("Service [%s] tunnel safety check failed. Error: %v", service.Name, err)
+		metrics.SafetyCheckFailures.With(User, service.Name).Inc()
+		return
+	}
+	metrics.TunnelsCreated.With(User, service.Name).Inc()
+	log.Debug("Service [%s] tunnel %s is established", service.Name, connID)
+	if pooled {
+		go service.fillPool()
+	}
+	client, err := conn.NewSocket(
+		service.InternalType,
+		consts.Auto, consts.Auto, 0,
+		service.InternalAddr, service.InternalAddr,
+		service.InternalPort, consts.UnConf, 0, nil, KCPConfig,
+	)
+	if err != nil {
+		log.Error("Service [%s] create a new client failed. Error: %v", service.Name, err)
+		return
+	}
+	defer client.Close()
+	service.forward(client, tunnel, tunnelKey)
+}
+
+// dialTunnel creates a new connection to the tunnel port of the server
+func (service *Service) dialTunnel() (conn.Socket, error) {
+	socketType := service.TunnelType
+	if service.TunnelType == "p2p6" {
+		socketType = "kcp6"
+	} else if service.TunnelType == "p2p4" {
+		socketType = "kcp4"
+	}
+	return conn.NewSocket(
+		socketType,
+		consts.Auto, consts.Auto, 0,
+		ServerAddrV4, ServerAddrV6,
+		service.TunnelPort, service.SshUser, service.SshPort, service.SSHAuth, service.TunnelKCPConfig,
+	)
+}
+
+// openTunnel returns a new tunnel, which is either a fresh connection or
+// a new stream on the shared mux session if TunnelMux is enabled
+func (service *Service) openTunnel() (conn.Socket, error) {
+	if !service.TunnelMux {
+		return service.dialTunnel()
+	}
+	service.muxLock.Lock()
+	defer service.muxLock.Unlock()
+	for retry := 0; retry < 2; retry++ {
+		if service.MuxSession == nil || service.MuxSession.IsClosed() {
+			socket, err := service.dialTunnel()
+			if err != nil {
+				return nil, err
+			}
+			session, err := conn.NewMuxClientSession(socket)
+			if err != nil {
+				_ = socket.Close()
+				return nil, err
+			}
+			log.Info("Service [%s] mux session to %s is established", service.Name, socket.RemoteAddr())
+			service.MuxSession = session
+		}
+		stream, err := service.MuxSession.Open()
+		if err == nil {
+			return stream, nil
+		}
+		log.Warn("Service [%s] open a mux stream failed. Error: %v", service.Name, err)
+		_ = service.MuxSession.Close()
+		service.MuxSession = nil
+	}
+	return nil, errors.New("open mux stream failed")
+}
+
+// closeMuxSession closes the shared mux session if there is one
+func (service *Service) closeMuxSession() {
+	service.muxLock.Lock()
+	defer service.muxLock.Unlock()
+	if service.MuxSession != nil {
+		_ = service.MuxSession.Close()
+		service.MuxSession = nil
+	}
+}
+
 func (service *Service) tunnel(client conn.Socket, tunnel conn.Socket, secretKey *[]byte) {
 	defer tunnel.Close()
 	defer client.Close()
-	if !tunnel2.ClientTunnelSafetyCheck(tunnel, *secretKey) {
-		log.Error("Tunnel safety check failed")
+	connID, tunnelKey, err := tunnel2.ClientTunnelSafetyCheck(tunnel, *secretKey)
+	if err != nil {
+		log.Error("Service [%s] tunnel safety check failed. Error: %v", service.Name, err)
+		metrics.SafetyCheckFailures.With(User, service.Name).Inc()
 		return
 	}
+	metrics.TunnelsCreated.With(User, service.Name).Inc()
+	log.Debug("Service [%s] tunnel %s is established", service.Name, connID)
+	service.forward(client, tunnel, tunnelKey)
+}
+
+func (service *Service) forward(client conn.Socket, tunnel conn.Socket, tunnelKey []byte) {
+	client = tunnel2.NewCountedSocket(client, tunnel2.ServiceStats(User, service.Name))
 	if !service.TunnelEncrypt {
 		tunnel2.UnsafeTunnel(client, tunnel)
-		return
 	} else {
-		tunnel2.SafeTunnel(client, tunnel, *secretKey)
+		tunnel2.SafeTunnel(client, tunnel, tunnelKey, tunnel2.ClientSide)
+	}
+}
+
+// createTunnel queues a CreateTunnel message of the server for the tunnel creator
+func (service *Service) createTunnel() {
+	select {
+	case service.TunnelMsgChan <- consts.CreateTunnel:
+	case <-service.Done:
 	}
 }
 
@@ -247,11 +357,24 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 	var RAddr *net.UDPAddr
 	var LAddr *net.UDPAddr
 	var FSMType string
+	var PairID string // the pairing of the server, the result of the hole punching is reported to it
 	var SecretKey []byte
+	var P2PKCPConfig *conn.KCPConfig
 	var p2pAddr string
 
 	extractMetadata := func() (err error) {
-		secretKey := security.AesGenKey(32)
+		// the p2p registration does not run on tls, so the server can only
+		// be authenticated by its public key
+		if PublicKey == nil {
+			err = errors.New("p2p tunnels need PublicKeyFile")
+			log.Error("Service [%s] handshake failed. Error: %v", service.Name, err)
+			return
+		}
+		secretKey, err := security.ClientHandshake(tunnel, PublicKey)
+		if err != nil {
+			log.Error("Service [%s] handshake failed. Error: %v", service.Name, err)
+			return
+		}
 		dict := make(map[string]interface{})
 		if service.P2PAddrV4 != "" {
 			p2pAddr = service.P2PAddrV4
@@ -290,13 +413,21 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 		}
 		dict["Type"] = "Client"
 		dict["NATType"] = strconv.Itoa(MappingType*3 + FilteringType)
-		dict["SecretKey"] = string(secretKey)
+		dict["Timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+		dict["Nonce"] = security.GenNonce()
+		// the server only pairs the workers which prove they know the key of the service
+		mac, err := tunnel2.P2PRegistrationMAC(service.SecretKey, secretKey, dict)
+		if err != nil {
+			log.Error("Service [%s] create metadata MAC failed. Error: %v", service.Name, err)
+			return
+		}
+		dict["MAC"] = base64.StdEncoding.EncodeToString(mac)
 		bytes, err := serialize.Serialize(&dict)
 		if err != nil {
 			log.Error("Service [%s] serialize metadata failed. Error: %v", service.Name, err)
 			return
 		}
-		bytes, err = security.RSAEncryptBase64(bytes, PublicKey, NBits)
+		bytes, err = security.AEADEncryptBase64(bytes, secretKey)
 		if err != nil {
 			log.Error("Service [%s] encrypt metadata failed. Error: %v", service.Name, err)
 			return
@@ -312,7 +443,7 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 			return
 		}
 
-		bytes, err = security.AESDecryptBase64(bytes, secretKey)
+		bytes, err = security.AEADDecryptBase64(bytes, secretKey)
 		if err != nil {
 			log.Error("Service [%s] decrypt metadata failed. Error: %v", service.Name, err)
 			return
@@ -324,6 +455,10 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 			log.Error("Service [%s] deserialize metadata failed. Error: %v", service.Name, err)
 			return
 		}
+		if err = checkStatus(dict); err != nil {
+			log.Error("Service [%s] is rejected by the server. Error: %v", service.Name, err)
+			return
+		}
 
 		RAddr, err = net.ResolveUDPAddr(dict["RNetwork"].(string), fmt.Sprintf("%s:%s", dict["RAddr"].(string), dict["RPort"].(string)))
 		if err != nil {
@@ -344,7 +479,22 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 			return
 		}
 		FSMType = dict["FSMType"].(string)
+		PairID, _ = dict["PairID"].(string)
 		SecretKey = []byte(dict["SecretKey"].(string))
+		P2PKCPConfig = service.KCPConfig
+		if kcpProfile, ok := dict["KCPProfile"].(string); ok {
+			P2PKCPConfig, err = conn.ParseKCPConfig(kcpProfile)
+			if err != nil {
+				log.Error("Service [%s] extract kcp profile failed. Error: %v", service.Name, err)
+				return
+			}
+		}
+		kcpCrypt, _ := dict["KCPCrypt"].(string)
+		P2PKCPConfig, err = P2PKCPConfig.WithCrypt(kcpCrypt, SecretKey)
+		if err != nil {
+			log.Error("Service [%s] create kcp crypt failed. Error: %v", service.Name, err)
+			return
+		}
 		return
 	}
 
@@ -362,13 +512,22 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 			err = errors.New("unsupported FSM type")
 			return
 		}
-		fsm := fsmFn(LAddr, RAddr)
+		fsm := fsmFn(LAddr, RAddr, P2PKCPConfig)
 		if fsm == nil {
 			log.Error("Service [%s] create FSM failed", service.Name)
 			err = errors.New("create FSM failed")
 			return
 		}
-		if fsm.Run(1) != 0 {
+		ok := fsm.Run(1) == 0
+		metrics.P2PFSMRuns.With(FSMType, metrics.P2PResult(ok)).Inc()
+		if PairID != "" {
+			service.Session.send(map[string]interface{}{
+				"Service": service.Name,
+				"PairID":  PairID,
+				"Result":  metrics.P2PResult(ok),
+			}, consts.P2PResult)
+		}
+		if !ok {
 			log.Error("Service [%s] run FSM failed", service.Name)
 			err = errors.New("run FSM failed")
 			return
@@ -394,7 +553,7 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 		service.InternalType,
 		consts.Auto, consts.Auto, 0,
 		service.InternalAddr, service.InternalAddr,
-		service.InternalPort, consts.UnConf, 0, nil,
+		service.InternalPort, consts.UnConf, 0, nil, KCPConfig,
 	)
 	if err != nil {
 		log.Error("Service [%s] create a new client failed. Error: %v", service.Name, err)
@@ -403,46 +562,31 @@ func (service *Service) p2pTunnel(tunnel conn.Socket) {
 	service.tunnel(client, tunnel, &SecretKey)
 }
 
-func (service *Service) controlMsgReader() {
-	timer := time.AfterFunc(time.Duration(service.HeartbeatTimeout)*time.Second, func() {
-		log.Error("HeartBeatTimeout ExternalPort: %d, TunnelPort: %d", service.ExternalPort, service.TunnelPort)
-		err := service.ControlSocket.Close()
-		if err != nil {
-			log.Error("Service [%s] close control socket failed. Error: %v", service.Name, err)
-			return
-		}
-	})
-	defer timer.Stop()
-	log.Info("Service [%s] control message reader is running", service.Name)
-	for {
-		buf, err := service.ControlSocket.ReadLine()
-		if err != nil {
-			log.Error("Service [%s] receive control message failed. Error: %v", service.Name, err)
-			break
-		}
-		buf, err = security.AESDecryptBase64(buf, service.SecretKey)
-		if err != nil {
-			log.Error("Service [%s] decrypt control message failed. Error: %v", service.Name, err)
-			break
-		}
-		msg, err := strconv.Atoi(string(buf))
-		if err != nil {
-			log.Error("Service [%s] parse control message failed. Error: %v", service.Name, err)
-			break
-		}
-		switch msg {
-		case consts.Heartbeat:
-			timer.Reset(time.Duration(service.HeartbeatTimeout) * time.Second)
-		case consts.CreateTunnel:
-			service.TunnelMsgChan <- consts.CreateTunnel
-			timer.Reset(time.Duration(service.HeartbeatTimeout) * time.Second)
-		default:
-			log.Warn("Service [%s] receive unknown control message: %d", service.Name, msg)
-		}
-	}
+// services are the services in the config, they are guarded by servicesLock
+// once the client is running. pendingServices collects the services of a
+// config being reloaded, they only replace services once all are loaded.
+var (
+	services        = make(map[string]*Service)
+	pendingServices map[string]*Service
+	servicesLock    sync.Mutex
+	activeSession   *Session
+)
+
+// ResetServices starts a reload, the services registered from now on are
+// kept aside until Reload, the running services are not touched
+func ResetServices() {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	pendingServices = make(map[string]*Service)
 }
 
-var services = make(map[string]*Service)
+// CancelReload drops the services registered since ResetServices, it is
+// called when the new config cannot be loaded
+func CancelReload() {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	pendingServices = nil
+}
 
 func RegisterService(
 	name string,
@@ -454,33 +598,75 @@ func RegisterService(
 	tunnelPort int,
 	tunnelType string,
 	tunnelEncrypt bool,
+	tunnelMux bool,
+	poolSize int,
+	poolIdleTimeout int,
+	customDomains string,
+	kcpProfile string,
+	kcpCrypt string,
 	p2pAddrV4 string,
 	p2pAddrV6 string,
 ) {
-	if _, ok := services[name]; ok {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	target := services
+	if pendingServices != nil {
+		target = pendingServices
+	}
+	if _, ok := target[name]; ok {
 		panic("service already exists")
 	}
-	services[name] = &Service{
-		Name:          name,
-		InternalAddr:  internalAddr,
-		InternalPort:  internalPort,
-		InternalType:  internalType,
-		ExternalPort:  externalPort,
-		ExternalType:  externalType,
-		TunnelPort:    tunnelPort,
-		TunnelType:    tunnelType,
-		TunnelEncrypt: tunnelEncrypt,
-		P2PAddrV4:     p2pAddrV4,
-		P2PAddrV6:     p2pAddrV6,
+	target[name] = &Service{
+		Name:            name,
+		InternalAddr:    internalAddr,
+		InternalPort:    internalPort,
+		InternalType:    internalType,
+		ExternalPort:    externalPort,
+		ExternalType:    externalType,
+		TunnelPort:      tunnelPort,
+		TunnelType:      tunnelType,
+		TunnelEncrypt:   tunnelEncrypt,
+		TunnelMux:       tunnelMux,
+		PoolSize:        poolSize,
+		PoolIdleTimeout: poolIdleTimeout,
+		CustomDomains:   customDomains,
+		KCPProfile:      kcpProfile,
+		KCPCrypt:        kcpCrypt,
+		P2PAddrV4:       p2pAddrV4,
+		P2PAddrV6:       p2pAddrV6,
+
+		requestedTunnelPort: tunnelPort,
+		requestedKCPCrypt:   kcpCrypt,
+	}
+}
+
+// Reload replaces the services with the ones registered since ResetServices
+// and applies them to the running session
+func Reload() {
+	servicesLock.Lock()
+	defer servicesLock.Unlock()
+	if pendingServices == nil {
+		return
+	}
+	services, pendingServices = pendingServices, nil
+	if activeSession != nil {
+		activeSession.reload()
 	}
 }
 
 func Run() {
 	log.InitLog(LogFile, LogWay, LogLevel, LogMaxDays)
-	var wait sync.WaitGroup
-	wait.Add(len(services))
-	for _, service := range services {
-		go service.run(&wait)
+	if MetricsAddr != "" {
+		go metrics.Serve(MetricsAddr)
+	}
+	session := newSession()
+	if session.createControlSocket() != nil {
+		return
+	}
+	defer session.ControlSocket.Close()
+	if session.authenticate() != nil {
+		return
 	}
-	wait.Wait()
+	log.Info("Session to %s is established", session.ControlSocket.RemoteAddr())
+	session.run()
 }
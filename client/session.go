@@ -0,0 +1,325 @@
+package client
+
+import (
+	"fmt"
+	"pTunnel/conn"
+	tunnel2 "pTunnel/tunnel"
+	"pTunnel/utils/consts"
+	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
+	"pTunnel/utils/security"
+	"pTunnel/utils/serialize"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session is the only control connection of the client, every service is
+// registered, updated and unregistered over it
+type Session struct {
+	ControlSocket    conn.Socket
+	SecretKey        []byte // the key of the handshake, the keys of the control channel and the services are derived from it
+	Channel          *tunnel2.ControlChannel
+	HeartbeatTimeout int
+
+	ControlMsgChan chan *map[string]interface{}
+	Done           chan struct{}
+
+	lock     sync.Mutex
+	services map[string]*Service
+}
+
+func newSession() *Session {
+	return &Session{
+		ControlMsgChan: make(chan *map[string]interface{}, 100),
+		Done:           make(chan struct{}),
+		services:       make(map[string]*Service),
+	}
+}
+
+func (session *Session) createControlSocket() (err error) {
+	// Connect to server
+	session.ControlSocket, err = conn.NewSocket(
+		ServerType,
+		consts.Auto, consts.Auto, 0,
+		ServerAddrV4, ServerAddrV6, ServerPort,
+		consts.UnConf, 0, nil, KCPConfig,
+	)
+	if err != nil {
+		log.Error("Connect to server failed. Error: %v", err)
+	}
+	return
+}
+
+func (session *Session) authenticate() (err error) {
+	// Agree on SecretKey with the server
+	session.SecretKey, err = security.ClientHandshake(session.ControlSocket, PublicKey)
+	if err != nil {
+		log.Error("Handshake failed. Error: %v", err)
+		return
+	}
+	dict := make(map[string]interface{})
+	dict["User"] = User
+	dict["Token"] = Token
+	dict["Timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+	dict["Nonce"] = security.GenNonce()
+	bytes, err := serialize.Serialize(&dict)
+	if err != nil {
+		log.Error("Serialize metadata failed. Error: %v", err)
+		return
+	}
+	bytes, err = security.AEADEncryptBase64(bytes, session.SecretKey)
+	if err != nil {
+		log.Error("Encrypt metadata failed. Error: %v", err)
+		return
+	}
+	if err = session.ControlSocket.WriteLine(bytes); err != nil {
+		log.Error("Send metadata failed. Error: %v", err)
+		return
+	}
+
+	bytes, err = session.ControlSocket.ReadLine()
+	if err != nil {
+		log.Error("Receive metadata failed. Error: %v", err)
+		return
+	}
+	bytes, err = security.AEADDecryptBase64(bytes, session.SecretKey)
+	if err != nil {
+		log.Error("Decrypt metadata failed. Error: %v", err)
+		return
+	}
+	dict = make(map[string]interface{})
+	if err = serialize.Deserialize(bytes, &dict); err != nil {
+		log.Error("Deserialize metadata failed. Error: %v", err)
+		return
+	}
+	if err = checkStatus(dict); err != nil {
+		log.Error("Rejected by the server. Error: %v", err)
+		return
+	}
+	heartbeatTimeout, _ := dict["HeartbeatTimeout"].(string)
+	session.HeartbeatTimeout, err = strconv.Atoi(heartbeatTimeout)
+	if err != nil {
+		log.Error("Extract heartbeat timeout failed. Error: %v", err)
+		return
+	}
+	// the control messages are sealed by their own keys from now on
+	session.Channel, err = tunnel2.NewControlChannel(session.ControlSocket, session.SecretKey, tunnel2.ClientSide)
+	if err != nil {
+		log.Error("Create control channel failed. Error: %v", err)
+	}
+	return
+}
+
+// run serves the session until the connection to the server is lost,
+// which stops every service
+func (session *Session) run() {
+	// Start a new goroutine to create heartbeat message
+	go session.heartBeatCreator()
+
+	// Start a new goroutine to send control message
+	go session.controlMsgSender()
+
+	// Register the services in the config
+	servicesLock.Lock()
+	activeSession = session
+	for _, service := range services {
+		session.register(service, consts.Register)
+	}
+	servicesLock.Unlock()
+
+	// Listen to the control message from the server
+	session.controlMsgReader()
+	close(session.Done)
+	servicesLock.Lock()
+	activeSession = nil
+	servicesLock.Unlock()
+	session.lock.Lock()
+	for name, service := range session.services {
+		service.stop()
+		delete(session.services, name)
+	}
+	session.lock.Unlock()
+}
+
+// register asks the server for service with a Register or an Update message,
+// the service starts once the server replies
+func (session *Session) register(service *Service, msg int) {
+	session.lock.Lock()
+	if old, ok := session.services[service.Name]; ok {
+		old.stop()
+	}
+	session.services[service.Name] = service
+	session.lock.Unlock()
+	service.Session = session
+	service.ReplyChan = make(chan *map[string]interface{}, 1)
+	service.Done = make(chan struct{})
+	go service.run()
+	session.send(service.metadata(), msg)
+}
+
+// unregister stops the service named name and tells the server
+func (session *Session) unregister(name string) {
+	session.lock.Lock()
+	service, ok := session.services[name]
+	delete(session.services, name)
+	session.lock.Unlock()
+	if !ok {
+		return
+	}
+	service.stop()
+	session.send(map[string]interface{}{"Service": name}, consts.Unregister)
+}
+
+// remove forgets a service rejected by the server
+func (session *Session) remove(service *Service) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.services[service.Name] == service {
+		delete(session.services, service.Name)
+	}
+}
+
+func (session *Session) lookup(name string) *Service {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.services[name]
+}
+
+// reload applies the services in the config to the session: new services are
+// registered, changed ones updated and removed ones unregistered
+func (session *Session) reload() {
+	session.lock.Lock()
+	var removed []string
+	for name := range session.services {
+		if _, ok := services[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	session.lock.Unlock()
+	for _, name := range removed {
+		log.Info("Service [%s] is removed from the config", name)
+		session.unregister(name)
+	}
+	for name, service := range services {
+		old := session.lookup(name)
+		switch {
+		case old == nil:
+			log.Info("Service [%s] is added to the config", name)
+			session.register(service, consts.Register)
+		case !old.sameConfig(service):
+			log.Info("Service [%s] is changed in the config", name)
+			session.register(service, consts.Update)
+		}
+	}
+}
+
+// send queues a control message for the server unless the session is over
+func (session *Session) send(dict map[string]interface{}, msg int) {
+	dict["Type"] = strconv.Itoa(msg)
+	select {
+	case session.ControlMsgChan <- &dict:
+	case <-session.Done:
+	}
+}
+
+func (session *Session) heartBeatCreator() {
+	log.Info("Heartbeat sender is running")
+	ticker := time.NewTicker(time.Duration(session.HeartbeatTimeout) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.Done:
+			return
+		case <-ticker.C:
+		}
+		session.send(make(map[string]interface{}), consts.Heartbeat)
+	}
+}
+
+func (session *Session) controlMsgSender() {
+	log.Info("Control message sender is running")
+	for {
+		var dict *map[string]interface{}
+		select {
+		case dict = <-session.ControlMsgChan:
+		case <-session.Done:
+			return
+		}
+		if err := session.Channel.WriteMsg(*dict); err != nil {
+			log.Error("Send control message failed. Error: %v", err)
+			_ = session.ControlSocket.Close()
+			return
+		}
+	}
+}
+
+func (session *Session) controlMsgReader() {
+	timer := time.AfterFunc(time.Duration(session.HeartbeatTimeout)*time.Second, func() {
+		log.Error("HeartBeatTimeout of the control connection")
+		metrics.HeartbeatTimeouts.Inc()
+		err := session.ControlSocket.Close()
+		if err != nil {
+			log.Error("Close control socket failed. Error: %v", err)
+			return
+		}
+	})
+	defer timer.Stop()
+	log.Info("Control message reader is running")
+	for {
+		dict, err := session.Channel.ReadMsg()
+		if err != nil {
+			log.Error("Receive control message failed. Error: %v", err)
+			return
+		}
+		msgType, _ := dict["Type"].(string)
+		msg, err := strconv.Atoi(msgType)
+		if err != nil {
+			log.Error("Parse control message failed. Error: %v", err)
+			return
+		}
+		name, _ := dict["Service"].(string)
+		switch msg {
+		case consts.Heartbeat:
+			timer.Reset(time.Duration(session.HeartbeatTimeout) * time.Second)
+		case consts.CreateTunnel:
+			if service := session.lookup(name); service != nil {
+				service.createTunnel()
+			}
+			timer.Reset(time.Duration(session.HeartbeatTimeout) * time.Second)
+		case consts.Reply:
+			if service := session.lookup(name); service != nil {
+				select {
+				case service.ReplyChan <- &dict:
+				default:
+					log.Warn("Service [%s] receive an unexpected reply", name)
+				}
+			}
+		case consts.Unregister:
+			// the service has stopped on the server
+			session.lock.Lock()
+			service, ok := session.services[name]
+			delete(session.services, name)
+			session.lock.Unlock()
+			if ok {
+				log.Error("Service [%s] is stopped by the server. Error: %v", name, checkStatus(dict))
+				service.stop()
+			}
+		default:
+			log.Warn("Receive unknown control message: %d", msg)
+		}
+	}
+}
+
+// checkStatus returns the error sent by the server if the status is not 200
+func checkStatus(dict map[string]interface{}) error {
+	status, _ := dict["Status"].(string)
+	if status == "200" {
+		return nil
+	}
+	reason, ok := dict["Error"].(string)
+	if !ok {
+		reason = "unknown error"
+	}
+	return fmt.Errorf("status %s: %s", status, reason)
+}
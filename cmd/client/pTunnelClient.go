@@ -3,10 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"pTunnel/client"
 	"pTunnel/utils/common"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/vaughan0/go-ini"
 )
@@ -20,16 +23,34 @@ Options:
 	-v --version                           Show version.
 	--config-file=<config-file>            Specify the config file path. [default: ./conf/client.ini]
 	--public-key-file=<public-key-file>    Specify the public key file.
-	--nBits-file=<nBits-file>              Specify the NBits file.
 	--server-addr-v4=<server-addr-v4>      Specify the server ipv4 address.
 	--server-addr-v6=<server-addr-v6>      Specify the server ipv6 address.
 	--server-port=<server-port>            Specify the server port.
-	--server-type=<server-type>            Specify the server type. [options: tcp, tcp4, tcp6, kcp, kcp4, kcp6]
+	--server-type=<server-type>            Specify the server type. [options: tcp, tcp4, tcp6, kcp, kcp4, kcp6, ws4, ws6, wss4, wss6, tls4, tls6, quic4, quic6]
 	--log-file=<log-level>                 Specify the path to the log file.
 	--log-level=<log-level>                Specify the log level. [options: debug, info, warning, error] [default: info]
 	--log-max-days=<log-max-days>          Specify the log max days.
 	--nat-type=<nat-type>                  Specify the NAT type. [options: 0, 1, 2, 3, 4, 5, 6, 7, 8]
 	--ssh-private-key-file=<ssh-private-key-file> Specify the ssh private key file.
+	--ssh-private-key-passphrase=<ssh-private-key-passphrase> Specify the passphrase of the ssh private key.
+	--ssh-password=<ssh-password>                 Specify the ssh password for password/keyboard-interactive auth.
+	--ssh-agent=<ssh-agent>                       Use the ssh agent at SSH_AUTH_SOCK.
+	--ssh-known-hosts-file=<ssh-known-hosts-file> Specify the known_hosts file of the ssh servers.
+	--ssh-insecure-ignore-host-key=<ssh-insecure-ignore-host-key> Accept any ssh host key if it cannot be verified.
+	--ws-path=<ws-path>                    Specify the path of the websocket endpoint.
+	--ws-host=<ws-host>                    Specify the Host header of the websocket request.
+	--tls-server-name=<tls-server-name>    Specify the tls server name(SNI).
+	--tls-alpn=<tls-alpn>                  Specify the tls alpn protocols, separated by comma.
+	--tls-ca-file=<tls-ca-file>            Specify the tls ca certificate file.
+	--tls-pinned-cert=<tls-pinned-cert>    Specify the sha256 fingerprint of the server certificate.
+	--tls-cert-file=<tls-cert-file>        Specify the tls client certificate file.
+	--tls-key-file=<tls-key-file>          Specify the tls client private key file.
+	--kcp-profile=<kcp-profile>            Specify the kcp profile. [options: normal, fast, fast2, fast3, custom]
+	--user=<user>                          Specify the user name registered on the server.
+	--token=<token>                        Specify the token of the user.
+	--rekey-bytes=<rekey-bytes>            Specify the bytes after which a direction of a tunnel or control connection is rekeyed, 0 means never.
+	--rekey-interval=<rekey-interval>      Specify the seconds after which a direction of a tunnel or control connection is rekeyed, 0 means never.
+	--metrics-addr=<metrics-addr>          Specify the address of the prometheus metrics, e.g. 127.0.0.1:9101.
 `
 
 func LoadConf(confFile string, args map[string]interface{}) error {
@@ -44,22 +65,11 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 		if ok {
 			args["--public-key-file"] = tmpStr
 		} else {
-			return fmt.Errorf("PublicKeyFile is not specified")
+			args["--public-key-file"] = ""
 		}
 	}
 	client.PublicKeyFile = args["--public-key-file"].(string)
 
-	// NBitsFile
-	if args["--nBits-file"] == nil {
-		tmpStr, ok := conf.Get("common", "NBitsFile")
-		if ok {
-			args["--nBits-file"] = tmpStr
-		} else {
-			return fmt.Errorf("NBitsFile is not specified")
-		}
-	}
-	client.NBitsFile = args["--nBits-file"].(string)
-
 	// ServerAddrV4
 	if args["--server-addr-v4"] == nil {
 		tmpStr, ok := conf.Get("common", "ServerAddrV4")
@@ -176,6 +186,232 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 	}
 	client.SSHPrivateKeyFile = args["--ssh-private-key-file"].(string)
 
+	// SSHPrivateKeyPassphrase
+	if args["--ssh-private-key-passphrase"] == nil {
+		tmpStr, ok := conf.Get("common", "SSHPrivateKeyPassphrase")
+		if ok {
+			args["--ssh-private-key-passphrase"] = tmpStr
+		} else {
+			args["--ssh-private-key-passphrase"] = ""
+		}
+	}
+	client.SSHPrivateKeyPassphrase = args["--ssh-private-key-passphrase"].(string)
+
+	// SSHPassword
+	if args["--ssh-password"] == nil {
+		tmpStr, ok := conf.Get("common", "SSHPassword")
+		if ok {
+			args["--ssh-password"] = tmpStr
+		} else {
+			args["--ssh-password"] = ""
+		}
+	}
+	client.SSHPassword = args["--ssh-password"].(string)
+
+	// SSHAgent
+	if args["--ssh-agent"] == nil {
+		tmpStr, ok := conf.Get("common", "SSHAgent")
+		if ok {
+			args["--ssh-agent"] = tmpStr
+		} else {
+			args["--ssh-agent"] = "true"
+		}
+	}
+	client.SSHAgent, err = strconv.ParseBool(args["--ssh-agent"].(string))
+	if err != nil {
+		return err
+	}
+
+	// SSHKnownHostsFile
+	if args["--ssh-known-hosts-file"] == nil {
+		tmpStr, ok := conf.Get("common", "SSHKnownHostsFile")
+		if ok {
+			args["--ssh-known-hosts-file"] = tmpStr
+		} else {
+			args["--ssh-known-hosts-file"] = ""
+		}
+	}
+	client.SSHKnownHostsFile = args["--ssh-known-hosts-file"].(string)
+
+	// SSHInsecureIgnoreHostKey
+	if args["--ssh-insecure-ignore-host-key"] == nil {
+		tmpStr, ok := conf.Get("common", "SSHInsecureIgnoreHostKey")
+		if ok {
+			args["--ssh-insecure-ignore-host-key"] = tmpStr
+		} else {
+			args["--ssh-insecure-ignore-host-key"] = "false"
+		}
+	}
+	client.SSHInsecureIgnoreHostKey, err = strconv.ParseBool(args["--ssh-insecure-ignore-host-key"].(string))
+	if err != nil {
+		return err
+	}
+
+	// WSPath
+	if args["--ws-path"] == nil {
+		tmpStr, ok := conf.Get("common", "WSPath")
+		if ok {
+			args["--ws-path"] = tmpStr
+		} else {
+			args["--ws-path"] = "/"
+		}
+	}
+	client.WSPath = args["--ws-path"].(string)
+
+	// WSHost
+	if args["--ws-host"] == nil {
+		tmpStr, ok := conf.Get("common", "WSHost")
+		if ok {
+			args["--ws-host"] = tmpStr
+		} else {
+			args["--ws-host"] = ""
+		}
+	}
+	client.WSHost = args["--ws-host"].(string)
+
+	// TLSServerName
+	if args["--tls-server-name"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSServerName")
+		if ok {
+			args["--tls-server-name"] = tmpStr
+		} else {
+			args["--tls-server-name"] = ""
+		}
+	}
+	client.TLSServerName = args["--tls-server-name"].(string)
+
+	// TLSALPN
+	if args["--tls-alpn"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSALPN")
+		if ok {
+			args["--tls-alpn"] = tmpStr
+		} else {
+			args["--tls-alpn"] = ""
+		}
+	}
+	client.TLSALPN = args["--tls-alpn"].(string)
+
+	// TLSCAFile
+	if args["--tls-ca-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSCAFile")
+		if ok {
+			args["--tls-ca-file"] = tmpStr
+		} else {
+			args["--tls-ca-file"] = ""
+		}
+	}
+	client.TLSCAFile = args["--tls-ca-file"].(string)
+
+	// TLSPinnedCert
+	if args["--tls-pinned-cert"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSPinnedCert")
+		if ok {
+			args["--tls-pinned-cert"] = tmpStr
+		} else {
+			args["--tls-pinned-cert"] = ""
+		}
+	}
+	client.TLSPinnedCert = args["--tls-pinned-cert"].(string)
+
+	// TLSCertFile
+	if args["--tls-cert-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSCertFile")
+		if ok {
+			args["--tls-cert-file"] = tmpStr
+		} else {
+			args["--tls-cert-file"] = ""
+		}
+	}
+	client.TLSCertFile = args["--tls-cert-file"].(string)
+
+	// TLSKeyFile
+	if args["--tls-key-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSKeyFile")
+		if ok {
+			args["--tls-key-file"] = tmpStr
+		} else {
+			args["--tls-key-file"] = ""
+		}
+	}
+	client.TLSKeyFile = args["--tls-key-file"].(string)
+
+	// KCPProfile
+	if args["--kcp-profile"] == nil {
+		tmpStr, ok := conf.Get("common", "KCPProfile")
+		if ok {
+			args["--kcp-profile"] = tmpStr
+		} else {
+			args["--kcp-profile"] = "normal"
+		}
+	}
+	client.KCPProfile = args["--kcp-profile"].(string)
+
+	// User
+	if args["--user"] == nil {
+		tmpStr, ok := conf.Get("common", "User")
+		if ok {
+			args["--user"] = tmpStr
+		} else {
+			args["--user"] = ""
+		}
+	}
+	client.User = args["--user"].(string)
+
+	// Token
+	if args["--token"] == nil {
+		tmpStr, ok := conf.Get("common", "Token")
+		if ok {
+			args["--token"] = tmpStr
+		} else {
+			args["--token"] = ""
+		}
+	}
+	client.Token = args["--token"].(string)
+
+	// RekeyBytes
+	if args["--rekey-bytes"] == nil {
+		tmpStr, ok := conf.Get("common", "RekeyBytes")
+		if ok {
+			args["--rekey-bytes"] = tmpStr
+		} else {
+			args["--rekey-bytes"] = "1073741824"
+		}
+	}
+	client.RekeyBytes, err = strconv.ParseInt(args["--rekey-bytes"].(string), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// RekeyInterval
+	if args["--rekey-interval"] == nil {
+		tmpStr, ok := conf.Get("common", "RekeyInterval")
+		if ok {
+			args["--rekey-interval"] = tmpStr
+		} else {
+			args["--rekey-interval"] = "3600"
+		}
+	}
+	client.RekeyInterval, err = strconv.Atoi(args["--rekey-interval"].(string))
+	if err != nil {
+		return err
+	}
+
+	// MetricsAddr
+	if args["--metrics-addr"] == nil {
+		tmpStr, ok := conf.Get("common", "MetricsAddr")
+		if ok {
+			args["--metrics-addr"] = tmpStr
+		} else {
+			args["--metrics-addr"] = ""
+		}
+	}
+	client.MetricsAddr = args["--metrics-addr"].(string)
+
+	return loadServices(conf)
+}
+
+// loadServices registers every section except common as a service
+func loadServices(conf ini.File) error {
 	for k, v := range conf {
 		if k != "common" {
 			name := k
@@ -197,16 +433,49 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 			if err != nil {
 				return err
 			}
+			tunnelMux := false
+			poolSize := 0
+			poolIdleTimeout := 60
 			externalPort := tunnelPort
 			externalType := tunnelType
+			customDomains := ""
+			kcpProfile := v["KCPProfile"]
+			kcpCrypt := v["KCPCrypt"]
 			p2pAddrV4 := ""
 			p2pAddrV6 := ""
 			if !strings.HasPrefix(strings.ToLower(tunnelType), "p2p") {
-				externalPort, err = strconv.Atoi(v["ExternalPort"])
-				if err != nil {
-					return err
-				}
 				externalType = v["ExternalType"]
+				if strings.ToLower(externalType) == "http" {
+					// http services share the VhostHTTPPort of the server
+					externalPort = 0
+					customDomains = v["CustomDomains"]
+					if customDomains == "" {
+						return errors.New("CustomDomains is not specified for service " + name)
+					}
+				} else {
+					externalPort, err = strconv.Atoi(v["ExternalPort"])
+					if err != nil {
+						return err
+					}
+				}
+				if _, ok := v["TunnelMux"]; ok {
+					tunnelMux, err = strconv.ParseBool(v["TunnelMux"])
+					if err != nil {
+						return err
+					}
+				}
+				if _, ok := v["PoolSize"]; ok {
+					poolSize, err = strconv.Atoi(v["PoolSize"])
+					if err != nil {
+						return err
+					}
+				}
+				if _, ok := v["PoolIdleTimeout"]; ok {
+					poolIdleTimeout, err = strconv.Atoi(v["PoolIdleTimeout"])
+					if err != nil {
+						return err
+					}
+				}
 			} else {
 				if _, ok := v["P2PAddrV4"]; ok {
 					p2pAddrV4 = v["P2PAddrV4"]
@@ -219,7 +488,8 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 				name,
 				internalAddr, internalPort, internalType,
 				externalPort, externalType,
-				tunnelPort, tunnelType, tunnelEncrypt,
+				tunnelPort, tunnelType, tunnelEncrypt, tunnelMux,
+				poolSize, poolIdleTimeout, customDomains, kcpProfile, kcpCrypt,
 				p2pAddrV4, p2pAddrV6,
 			)
 		}
@@ -248,6 +518,29 @@ func main() {
 		return
 	}
 
+	// Reload the services on SIGHUP, the common section is not reloaded
+	go reloadOnSignal(args["--config-file"].(string))
+
 	// Start the client
 	client.Run()
 }
+
+func reloadOnSignal(confFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		conf, err := ini.LoadFile(confFile)
+		if err != nil {
+			fmt.Printf("Error during reloading configurations: %v\n", err)
+			continue
+		}
+		// the running services are only replaced once the whole config is loaded
+		client.ResetServices()
+		if err = loadServices(conf); err != nil {
+			client.CancelReload()
+			fmt.Printf("Error during reloading configurations, the services are kept: %v\n", err)
+			continue
+		}
+		client.Reload()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"pTunnel/utils/security"
+	"pTunnel/utils/version"
+	"time"
+
+	"github.com/docopt/docopt-go"
+)
+
+var usage = `pTunnelGenCert is a tool to run the private CA of the server for mutual tls.
+Usage:
+	pTunnelGenCert ca [options]
+	pTunnelGenCert server <host>... [options]
+	pTunnelGenCert client <name> [options]
+
+Commands:
+	ca                             Create the CA, CA.pem and CAKey.pem in the directory.
+	server                         Issue the server certificate for the hosts, server.pem and server.key.
+	client                         Issue the client certificate with the name as its identity, <name>.pem and <name>.key.
+
+Options:
+	-h --help                      Show help information in screen.
+	--version                      Show version.
+	-d --dir=<dir>                 Specify the directory of the CA [default: ./cert].
+	-n --ca-name=<ca-name>         Specify the name of the CA [default: pTunnel CA].
+	--days=<days>                  Specify the days the certificate is valid [default: 365].
+	-p --passphrase=<passphrase>   Encrypt or decrypt the CA private key with the passphrase, PTUNNEL_CA_PASSPHRASE is used if not specified.
+`
+
+func main() {
+	opts, err := docopt.ParseArgs(usage, os.Args[1:], version.GetVersion())
+	if err != nil {
+		fmt.Printf("Error during parsing arguments: %s\n", err.Error())
+		return
+	}
+
+	caDir, err := opts.String("--dir")
+	if err != nil {
+		fmt.Printf("Error during parsing dir: %s\n", err.Error())
+		return
+	}
+
+	days, err := opts.Int("--days")
+	if err != nil {
+		fmt.Printf("Error during parsing days: %s\n", err.Error())
+		return
+	}
+
+	passphrase := os.Getenv("PTUNNEL_CA_PASSPHRASE")
+	if opts["--passphrase"] != nil {
+		passphrase, _ = opts.String("--passphrase")
+	}
+
+	var cert *x509.Certificate
+	switch {
+	case opts["ca"] == true:
+		caName, _ := opts.String("--ca-name")
+		cert, err = security.GenCA(caName, days, passphrase, caDir)
+	case opts["server"] == true:
+		hosts := opts["<host>"].([]string)
+		cert, err = security.IssueCert(caDir, passphrase, "server", hosts, days)
+	case opts["client"] == true:
+		name, _ := opts.String("<name>")
+		cert, err = security.IssueCert(caDir, passphrase, name, nil, days)
+	}
+	if err != nil {
+		fmt.Printf("Error during generating certificate: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("Subject: %s\n", cert.Subject.CommonName)
+	fmt.Printf("Expires: %s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("SHA256 Fingerprint: %s\n", security.CertFingerprint(cert))
+}
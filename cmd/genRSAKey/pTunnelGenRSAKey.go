@@ -10,15 +10,17 @@ import (
 	"github.com/docopt/docopt-go"
 )
 
-var usage = `pTunnelGenRSAKey is a tool to generate RSA key pair.
+var usage = `pTunnelGenRSAKey is a tool to generate the key pair of the server.
 Usage:
 	pTunnelGenRSAKey [options]
 
 Options:
-	-h --help              Show help information in screen.
-	--version              Show version.
-	-l --length=<length>   Specify the length of RSA key pair [default: 2048].
-	-d --dir=<dir>         Specify the directory to save the key pair [default: ./cert].
+	-h --help                      Show help information in screen.
+	--version                      Show version.
+	-t --type=<type>               Specify the type of the key pair [options: rsa, ed25519, ecdsa] [default: rsa].
+	-l --length=<length>           Specify the length of RSA key pair [default: 2048].
+	-d --dir=<dir>                 Specify the directory to save the key pair [default: ./cert].
+	-p --passphrase=<passphrase>   Encrypt the private key with the passphrase, PTUNNEL_KEY_PASSPHRASE is used if not specified.
 `
 
 func main() {
@@ -28,6 +30,12 @@ func main() {
 		return
 	}
 
+	keyType, err := opts.String("--type")
+	if err != nil {
+		fmt.Printf("Error during parsing type: %s\n", err.Error())
+		return
+	}
+
 	length, err := opts.Int("--length")
 	if err != nil {
 		fmt.Printf("Error during parsing length: %s\n", err.Error())
@@ -40,15 +48,21 @@ func main() {
 		return
 	}
 
+	passphrase := os.Getenv("PTUNNEL_KEY_PASSPHRASE")
+	if opts["--passphrase"] != nil {
+		passphrase, _ = opts.String("--passphrase")
+	}
+
 	err = common.Mkdir(saveDir, true)
 	if err != nil {
 		fmt.Printf("Error during creating directory: %s\n", err.Error())
 		return
 	}
 
-	err = security.RSAGenKey(length, saveDir)
+	keyID, err := security.GenKey(keyType, length, passphrase, saveDir)
 	if err != nil {
-		fmt.Printf("Error during generating RSA key pair: %s\n", err.Error())
+		fmt.Printf("Error during generating key pair: %s\n", err.Error())
 		return
 	}
+	fmt.Printf("Key ID: %s\n", keyID)
 }
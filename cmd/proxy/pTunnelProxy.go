@@ -19,7 +19,6 @@ Options:
 	-v --version                           Show version.
 	--config-file=<config-file>            Specify the config file path. [default: ./conf/proxy.ini]
 	--public-key-file=<public-key-file>    Specify the public key file.
-	--nBits-file=<nBits-file>              Specify the NBits file.
 	--server-addr-v4=<server-addr-v4>      Specify the server ipv4 address.
 	--server-addr-v6=<server-addr-v6>      Specify the server ipv6 address.
 	--server-port=<server-port>            Specify the server port.
@@ -30,6 +29,8 @@ Options:
 	--log-level=<log-level>                Specify the log level. [options: debug, info, warning, error] [default: info]
 	--log-max-days=<log-max-days>          Specify the log max days.
 	--nat-type=<nat-type>                  Specify the NAT type. [options: 0, 1, 2, 3, 4, 5, 6, 7, 8]
+	--kcp-profile=<kcp-profile>            Specify the kcp profile. [options: normal, fast, fast2, fast3, custom]
+	--metrics-addr=<metrics-addr>          Specify the address of the prometheus metrics, e.g. 127.0.0.1:9102.
 `
 
 func LoadConf(confFile string, args map[string]interface{}) error {
@@ -49,17 +50,6 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 	}
 	proxy.PublicKeyFile = args["--public-key-file"].(string)
 
-	// NBitsFile
-	if args["--nBits-file"] == nil {
-		tmpStr, ok := conf.Get("common", "NBitsFile")
-		if ok {
-			args["--nBits-file"] = tmpStr
-		} else {
-			return fmt.Errorf("NBitsFile is not specified")
-		}
-	}
-	proxy.NBitsFile = args["--nBits-file"].(string)
-
 	// ServerAddrV4
 	if args["--server-addr-v4"] == nil {
 		tmpStr, ok := conf.Get("common", "ServerAddrV4")
@@ -165,6 +155,28 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 		return err
 	}
 
+	// KCPProfile
+	if args["--kcp-profile"] == nil {
+		tmpStr, ok := conf.Get("common", "KCPProfile")
+		if ok {
+			args["--kcp-profile"] = tmpStr
+		} else {
+			args["--kcp-profile"] = "normal"
+		}
+	}
+	proxy.KCPProfile = args["--kcp-profile"].(string)
+
+	// MetricsAddr
+	if args["--metrics-addr"] == nil {
+		tmpStr, ok := conf.Get("common", "MetricsAddr")
+		if ok {
+			args["--metrics-addr"] = tmpStr
+		} else {
+			args["--metrics-addr"] = ""
+		}
+	}
+	proxy.MetricsAddr = args["--metrics-addr"].(string)
+
 	for k, v := range conf {
 		if k != "common" {
 			name := k
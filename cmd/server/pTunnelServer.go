@@ -18,9 +18,10 @@ Options:
 	-h --help                                Show help information in screen.
 	-v --version                             Show version.
 	--config-file=<config-file>              Specify the config file path. [default: ./conf/server.ini]
-	--private-key-file=<private-key-file>    Specify the private key file.
-	--nBits-file=<nBits-file>                Specify the NBits file.
-	--server-type=<server-type>              Specify the server type. [options: tcp, tcp4, tcp6]
+	--private-key-file=<private-key-file>    Specify the private key files, separated by comma.
+	--deprecated-key-ids=<deprecated-key-ids> Specify the key IDs to be retired, separated by comma.
+	--private-key-passphrase=<private-key-passphrase> Specify the passphrase of the encrypted private keys.
+	--server-type=<server-type>              Specify the server type. [options: tcp, tcp4, tcp6, kcp, kcp4, kcp6, ws4, ws6, wss4, wss6, tls4, tls6, quic4, quic6]
 	--server-port=<server-port>              Specify the server port.
 	--log-file=<log-level>                   Specify the path to the log file.
 	--log-level=<log-level>                  Specify the log level. [options: debug, info, warning, error]
@@ -28,6 +29,28 @@ Options:
 	--heartbeat-timeout=<heartbeat-timeout>  Specify the heartbeat timeout. 
 	--ssh-port=<ssh-port>                    Specify the ssh port.
 	--ssh-user=<ssh-user>                    Specify the ssh user.
+	--ssh-host-key-files=<ssh-host-key-files> Specify the public host key files of the ssh server, separated by comma.
+	--ws-path=<ws-path>                      Specify the path of the websocket endpoint.
+	--tls-cert-file=<tls-cert-file>          Specify the tls certificate file.
+	--tls-key-file=<tls-key-file>            Specify the tls private key file.
+	--tls-alpn=<tls-alpn>                    Specify the tls alpn protocols, separated by comma.
+	--tls-client-ca-file=<tls-client-ca-file> Specify the ca certificate file of the client certificates, enables mutual tls.
+	--vhost-http-port=<vhost-http-port>      Specify the port shared by the http services.
+	--kcp-profile=<kcp-profile>              Specify the kcp profile. [options: normal, fast, fast2, fast3, custom]
+	--replay-window=<replay-window>          Specify the seconds a metadata timestamp is accepted around the server time.
+	--users-file=<users-file>                Specify the file of the client credentials and grants.
+	--allow-ports=<allow-ports>              Specify the ports the services may use, e.g. 6000-7000, 8080.
+	--reserved-ports=<reserved-ports>        Specify the ports never given to a service.
+	--max-ports-per-client=<max-ports-per-client> Specify the ports a client may use at the same time, 0 means no limit.
+	--port-lease-timeout=<port-lease-timeout> Specify the seconds a stopped service keeps its random ports, 0 means no lease.
+	--rekey-bytes=<rekey-bytes>              Specify the bytes after which a direction of a tunnel or control connection is rekeyed, 0 means never.
+	--rekey-interval=<rekey-interval>        Specify the seconds after which a direction of a tunnel or control connection is rekeyed, 0 means never.
+	--admin-addr=<admin-addr>                Specify the address of the admin http api.
+	--admin-port=<admin-port>                Specify the port of the admin http api, 0 means disabled.
+	--admin-token=<admin-token>              Specify the bearer token of the admin http api.
+	--dashboard-password=<dashboard-password> Specify the login password of the dashboard served with the admin http api.
+	--dashboard-read-only=<dashboard-read-only> Specify whether the dashboard is read-only, default is true.
+	--metrics-addr=<metrics-addr>            Specify the address of the prometheus metrics, e.g. 127.0.0.1:9100.
 `
 
 func LoadConf(confFile string, args map[string]interface{}) error {
@@ -47,16 +70,27 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 	}
 	server.PrivateKeyFile = args["--private-key-file"].(string)
 
-	// NBitsFile
-	if args["--nBits-file"] == nil {
-		tmpStr, ok := conf.Get("common", "NBitsFile")
+	// DeprecatedKeyIDs
+	if args["--deprecated-key-ids"] == nil {
+		tmpStr, ok := conf.Get("common", "DeprecatedKeyIDs")
 		if ok {
-			args["--nBits-file"] = tmpStr
+			args["--deprecated-key-ids"] = tmpStr
 		} else {
-			return errors.New("NBitsFile is not specified")
+			args["--deprecated-key-ids"] = ""
 		}
 	}
-	server.NBitsFile = args["--nBits-file"].(string)
+	server.DeprecatedKeyIDs = args["--deprecated-key-ids"].(string)
+
+	// PrivateKeyPassphrase
+	if args["--private-key-passphrase"] == nil {
+		tmpStr, ok := conf.Get("common", "PrivateKeyPassphrase")
+		if ok {
+			args["--private-key-passphrase"] = tmpStr
+		} else {
+			args["--private-key-passphrase"] = ""
+		}
+	}
+	server.PrivateKeyPassphrase = args["--private-key-passphrase"].(string)
 
 	// ServerType
 	if args["--server-type"] == nil {
@@ -163,6 +197,272 @@ func LoadConf(confFile string, args map[string]interface{}) error {
 	}
 	server.SshUser = args["--ssh-user"].(string)
 
+	// SshHostKeyFiles
+	if args["--ssh-host-key-files"] == nil {
+		tmpStr, ok := conf.Get("common", "SshHostKeyFiles")
+		if ok {
+			args["--ssh-host-key-files"] = tmpStr
+		} else {
+			args["--ssh-host-key-files"] = ""
+		}
+	}
+	server.SshHostKeyFiles = args["--ssh-host-key-files"].(string)
+
+	// WSPath
+	if args["--ws-path"] == nil {
+		tmpStr, ok := conf.Get("common", "WSPath")
+		if ok {
+			args["--ws-path"] = tmpStr
+		} else {
+			args["--ws-path"] = "/"
+		}
+	}
+	server.WSPath = args["--ws-path"].(string)
+
+	// TLSCertFile
+	if args["--tls-cert-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSCertFile")
+		if ok {
+			args["--tls-cert-file"] = tmpStr
+		} else {
+			args["--tls-cert-file"] = ""
+		}
+	}
+	server.TLSCertFile = args["--tls-cert-file"].(string)
+
+	// TLSKeyFile
+	if args["--tls-key-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSKeyFile")
+		if ok {
+			args["--tls-key-file"] = tmpStr
+		} else {
+			args["--tls-key-file"] = ""
+		}
+	}
+	server.TLSKeyFile = args["--tls-key-file"].(string)
+
+	// TLSALPN
+	if args["--tls-alpn"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSALPN")
+		if ok {
+			args["--tls-alpn"] = tmpStr
+		} else {
+			args["--tls-alpn"] = "h2,http/1.1"
+		}
+	}
+	server.TLSALPN = args["--tls-alpn"].(string)
+
+	// TLSClientCAFile
+	if args["--tls-client-ca-file"] == nil {
+		tmpStr, ok := conf.Get("common", "TLSClientCAFile")
+		if ok {
+			args["--tls-client-ca-file"] = tmpStr
+		} else {
+			args["--tls-client-ca-file"] = ""
+		}
+	}
+	server.TLSClientCAFile = args["--tls-client-ca-file"].(string)
+
+	// VhostHTTPPort
+	if args["--vhost-http-port"] == nil {
+		tmpStr, ok := conf.Get("common", "VhostHTTPPort")
+		if ok {
+			args["--vhost-http-port"] = tmpStr
+		} else {
+			args["--vhost-http-port"] = "0"
+		}
+	}
+	server.VhostHTTPPort, err = strconv.Atoi(args["--vhost-http-port"].(string))
+	if err != nil {
+		return err
+	}
+
+	// KCPProfile
+	if args["--kcp-profile"] == nil {
+		tmpStr, ok := conf.Get("common", "KCPProfile")
+		if ok {
+			args["--kcp-profile"] = tmpStr
+		} else {
+			args["--kcp-profile"] = "normal"
+		}
+	}
+	server.KCPProfile = args["--kcp-profile"].(string)
+
+	// ReplayWindow
+	if args["--replay-window"] == nil {
+		tmpStr, ok := conf.Get("common", "ReplayWindow")
+		if ok {
+			args["--replay-window"] = tmpStr
+		} else {
+			args["--replay-window"] = "300"
+		}
+	}
+	server.ReplayWindow, err = strconv.Atoi(args["--replay-window"].(string))
+	if err != nil {
+		return err
+	}
+
+	// UsersFile
+	if args["--users-file"] == nil {
+		tmpStr, ok := conf.Get("common", "UsersFile")
+		if ok {
+			args["--users-file"] = tmpStr
+		} else {
+			args["--users-file"] = ""
+		}
+	}
+	server.UsersFile = args["--users-file"].(string)
+
+	// AllowPorts
+	if args["--allow-ports"] == nil {
+		tmpStr, ok := conf.Get("common", "AllowPorts")
+		if ok {
+			args["--allow-ports"] = tmpStr
+		} else {
+			args["--allow-ports"] = ""
+		}
+	}
+	server.AllowPorts = args["--allow-ports"].(string)
+
+	// ReservedPorts
+	if args["--reserved-ports"] == nil {
+		tmpStr, ok := conf.Get("common", "ReservedPorts")
+		if ok {
+			args["--reserved-ports"] = tmpStr
+		} else {
+			args["--reserved-ports"] = ""
+		}
+	}
+	server.ReservedPorts = args["--reserved-ports"].(string)
+
+	// MaxPortsPerClient
+	if args["--max-ports-per-client"] == nil {
+		tmpStr, ok := conf.Get("common", "MaxPortsPerClient")
+		if ok {
+			args["--max-ports-per-client"] = tmpStr
+		} else {
+			args["--max-ports-per-client"] = "0"
+		}
+	}
+	server.MaxPortsPerClient, err = strconv.Atoi(args["--max-ports-per-client"].(string))
+	if err != nil {
+		return err
+	}
+
+	// PortLeaseTimeout
+	if args["--port-lease-timeout"] == nil {
+		tmpStr, ok := conf.Get("common", "PortLeaseTimeout")
+		if ok {
+			args["--port-lease-timeout"] = tmpStr
+		} else {
+			args["--port-lease-timeout"] = "3600"
+		}
+	}
+	server.PortLeaseTimeout, err = strconv.Atoi(args["--port-lease-timeout"].(string))
+	if err != nil {
+		return err
+	}
+
+	// RekeyBytes
+	if args["--rekey-bytes"] == nil {
+		tmpStr, ok := conf.Get("common", "RekeyBytes")
+		if ok {
+			args["--rekey-bytes"] = tmpStr
+		} else {
+			args["--rekey-bytes"] = "1073741824"
+		}
+	}
+	server.RekeyBytes, err = strconv.ParseInt(args["--rekey-bytes"].(string), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// RekeyInterval
+	if args["--rekey-interval"] == nil {
+		tmpStr, ok := conf.Get("common", "RekeyInterval")
+		if ok {
+			args["--rekey-interval"] = tmpStr
+		} else {
+			args["--rekey-interval"] = "3600"
+		}
+	}
+	server.RekeyInterval, err = strconv.Atoi(args["--rekey-interval"].(string))
+	if err != nil {
+		return err
+	}
+
+	// AdminAddr
+	if args["--admin-addr"] == nil {
+		tmpStr, ok := conf.Get("common", "AdminAddr")
+		if ok {
+			args["--admin-addr"] = tmpStr
+		} else {
+			args["--admin-addr"] = "127.0.0.1"
+		}
+	}
+	server.AdminAddr = args["--admin-addr"].(string)
+
+	// AdminPort
+	if args["--admin-port"] == nil {
+		tmpStr, ok := conf.Get("common", "AdminPort")
+		if ok {
+			args["--admin-port"] = tmpStr
+		} else {
+			args["--admin-port"] = "0"
+		}
+	}
+	server.AdminPort, err = strconv.Atoi(args["--admin-port"].(string))
+	if err != nil {
+		return err
+	}
+
+	// AdminToken
+	if args["--admin-token"] == nil {
+		tmpStr, ok := conf.Get("common", "AdminToken")
+		if ok {
+			args["--admin-token"] = tmpStr
+		} else {
+			args["--admin-token"] = ""
+		}
+	}
+	server.AdminToken = args["--admin-token"].(string)
+
+	// DashboardPassword
+	if args["--dashboard-password"] == nil {
+		tmpStr, ok := conf.Get("common", "DashboardPassword")
+		if ok {
+			args["--dashboard-password"] = tmpStr
+		} else {
+			args["--dashboard-password"] = ""
+		}
+	}
+	server.DashboardPassword = args["--dashboard-password"].(string)
+
+	// DashboardReadOnly
+	if args["--dashboard-read-only"] == nil {
+		tmpStr, ok := conf.Get("common", "DashboardReadOnly")
+		if ok {
+			args["--dashboard-read-only"] = tmpStr
+		} else {
+			args["--dashboard-read-only"] = "true"
+		}
+	}
+	server.DashboardReadOnly, err = strconv.ParseBool(args["--dashboard-read-only"].(string))
+	if err != nil {
+		return err
+	}
+
+	// MetricsAddr
+	if args["--metrics-addr"] == nil {
+		tmpStr, ok := conf.Get("common", "MetricsAddr")
+		if ok {
+			args["--metrics-addr"] = tmpStr
+		} else {
+			args["--metrics-addr"] = ""
+		}
+	}
+	server.MetricsAddr = args["--metrics-addr"].(string)
+
 	return err
 }
 
@@ -0,0 +1,172 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"pTunnel/utils/security"
+	"strconv"
+	"strings"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// KCPConfig holds the tuning of a kcp session. Both ends of a session must
+// agree on DataShards and ParityShards, the other values only change how
+// each end sends.
+type KCPConfig struct {
+	Profile      string
+	NoDelay      int
+	Interval     int
+	Resend       int
+	NoCongestion int
+	SndWnd       int
+	RcvWnd       int
+	MTU          int
+	DataShards   int
+	ParityShards int
+	StreamMode   bool
+	Crypt        string // the block cipher of the packets, set by WithCrypt
+	block        kcp.BlockCrypt
+}
+
+var kcpProfiles = map[string]KCPConfig{
+	"normal": {NoDelay: 0, Interval: 40, Resend: 2, NoCongestion: 1},
+	"fast":   {NoDelay: 0, Interval: 30, Resend: 2, NoCongestion: 1},
+	"fast2":  {NoDelay: 1, Interval: 20, Resend: 2, NoCongestion: 1},
+	"fast3":  {NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1},
+}
+
+// DefaultKCPConfig is used when no config is given
+var DefaultKCPConfig, _ = ParseKCPConfig("normal")
+
+// ParseKCPConfig parses a profile name optionally followed by overrides,
+// e.g. "fast2" or "custom, nodelay=1, interval=20, sndwnd=1024, mtu=1200".
+// custom starts from the normal profile. The keys are nodelay, interval,
+// resend, nc, sndwnd, rcvwnd, mtu, datashard, parityshard and streammode.
+func ParseKCPConfig(str string) (*KCPConfig, error) {
+	fields := strings.Split(str, ",")
+	name := strings.ToLower(strings.TrimSpace(fields[0]))
+	if name == "" {
+		name = "normal"
+	}
+	base := name
+	if base == "custom" {
+		base = "normal"
+	}
+	profile, ok := kcpProfiles[base]
+	if !ok {
+		return nil, errors.New("unsupported kcp profile: " + name)
+	}
+	config := profile
+	config.Profile = name
+	config.SndWnd = 128
+	config.RcvWnd = 512
+	config.MTU = 1350
+	config.DataShards = 10
+	config.ParityShards = 3
+	config.StreamMode = true
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, errors.New("invalid kcp option: " + field)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "nodelay":
+			config.NoDelay, err = strconv.Atoi(value)
+		case "interval":
+			config.Interval, err = strconv.Atoi(value)
+		case "resend":
+			config.Resend, err = strconv.Atoi(value)
+		case "nc":
+			config.NoCongestion, err = strconv.Atoi(value)
+		case "sndwnd":
+			config.SndWnd, err = strconv.Atoi(value)
+		case "rcvwnd":
+			config.RcvWnd, err = strconv.Atoi(value)
+		case "mtu":
+			config.MTU, err = strconv.Atoi(value)
+		case "datashard":
+			config.DataShards, err = strconv.Atoi(value)
+		case "parityshard":
+			config.ParityShards, err = strconv.Atoi(value)
+		case "streammode":
+			config.StreamMode, err = strconv.ParseBool(value)
+		default:
+			err = errors.New("unsupported kcp option: " + key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// String returns the config in the form accepted by ParseKCPConfig
+func (config *KCPConfig) String() string {
+	return fmt.Sprintf(
+		"%s,nodelay=%d,interval=%d,resend=%d,nc=%d,sndwnd=%d,rcvwnd=%d,mtu=%d,datashard=%d,parityshard=%d,streammode=%t",
+		config.Profile, config.NoDelay, config.Interval, config.Resend, config.NoCongestion,
+		config.SndWnd, config.RcvWnd, config.MTU, config.DataShards, config.ParityShards, config.StreamMode,
+	)
+}
+
+// WithCrypt returns a copy of config that encrypts the packets with crypt,
+// which is one of aes, salsa20, xtea and none. The key is derived from
+// secret, so both ends must use the same secret.
+func (config *KCPConfig) WithCrypt(crypt string, secret []byte) (*KCPConfig, error) {
+	c := *config
+	c.Crypt = strings.ToLower(crypt)
+	c.block = nil
+	var err error
+	switch c.Crypt {
+	case "", "none":
+		c.Crypt = "none"
+	case "aes":
+		var key []byte
+		if key, err = security.DeriveKey(secret, "pTunnel kcp aes", 32); err == nil {
+			c.block, err = kcp.NewAESBlockCrypt(key)
+		}
+	case "salsa20":
+		var key []byte
+		if key, err = security.DeriveKey(secret, "pTunnel kcp salsa20", 32); err == nil {
+			c.block, err = kcp.NewSalsa20BlockCrypt(key)
+		}
+	case "xtea":
+		var key []byte
+		if key, err = security.DeriveKey(secret, "pTunnel kcp xtea", 16); err == nil {
+			c.block, err = kcp.NewXTEABlockCrypt(key)
+		}
+	default:
+		err = errors.New("unsupported kcp crypt: " + crypt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Encrypted reports whether the packets are encrypted
+func (config *KCPConfig) Encrypted() bool {
+	return config.block != nil
+}
+
+func (config *KCPConfig) apply(session *kcp.UDPSession) {
+	session.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+	session.SetWindowSize(config.SndWnd, config.RcvWnd)
+	session.SetMtu(config.MTU)
+	session.SetStreamMode(config.StreamMode)
+	session.SetWriteDelay(false)
+}
+
+// IsKCPType reports whether the socket type runs on kcp, p2p tunnels are kcp
+// sessions once the hole is punched
+func IsKCPType(sType string) bool {
+	switch strings.ToLower(sType) {
+	case "kcp", "kcp4", "kcp6", "p2p", "p2p4", "p2p6":
+		return true
+	}
+	return false
+}
@@ -26,7 +26,7 @@ func (socket *KCPSocket) Write(p []byte) (n int, err error) {
 }
 
 func (socket *KCPSocket) Read(p []byte) (n int, err error) {
-	return socket.Socket.Read(p)
+	return socket.reader.Read(p)
 }
 
 func (socket *KCPSocket) ReadLine() (data []byte, err error) {
@@ -53,6 +53,7 @@ func (socket *KCPSocket) Address() (net.Addr, net.Addr) {
 
 type KCPListener struct {
 	Listener *kcp.Listener
+	config   *KCPConfig
 }
 
 func (listener *KCPListener) AcceptKCP() (*KCPSocket, error) {
@@ -60,6 +61,7 @@ func (listener *KCPListener) AcceptKCP() (*KCPSocket, error) {
 	if err != nil {
 		return nil, err
 	}
+	listener.config.apply(kcpConn)
 	socket := &KCPSocket{}
 	socket.Socket = kcpConn
 	socket.reader = bufio.NewReader(socket.Socket)
@@ -83,7 +85,11 @@ func (listener *KCPListener) Address() net.Addr {
 	return listener.Listener.Addr()
 }
 
-func NewKCPSocket(laddr *net.UDPAddr, raddr *net.UDPAddr, network string) (Socket, error) {
+// NewKCPSocket dials raddr with config, nil means DefaultKCPConfig
+func NewKCPSocket(laddr *net.UDPAddr, raddr *net.UDPAddr, network string, config *KCPConfig) (Socket, error) {
+	if config == nil {
+		config = DefaultKCPConfig
+	}
 	socket := &KCPSocket{}
 	conn, err := net.ListenUDP(network, laddr)
 	if err != nil {
@@ -91,19 +97,24 @@ func NewKCPSocket(laddr *net.UDPAddr, raddr *net.UDPAddr, network string) (Socke
 	}
 	var convid uint32
 	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	kcpConn, err := kcp.NewConn3(convid, raddr, nil, 10, 3, conn)
+	kcpConn, err := kcp.NewConn3(convid, raddr, config.block, config.DataShards, config.ParityShards, conn)
 	if err != nil {
 		return nil, err
 	}
+	config.apply(kcpConn)
 	socket.Socket = kcpConn
 	socket.reader = bufio.NewReader(socket.Socket)
 	socket.closeFlag = false
 	return socket, nil
 }
 
-func NewKCPListener(addr *net.UDPAddr) (Listener, error) {
-	listener := &KCPListener{}
-	kcpListener, err := kcp.ListenWithOptions(addr.String(), nil, 10, 3)
+// NewKCPListener listens on addr with config, nil means DefaultKCPConfig
+func NewKCPListener(addr *net.UDPAddr, config *KCPConfig) (Listener, error) {
+	if config == nil {
+		config = DefaultKCPConfig
+	}
+	listener := &KCPListener{config: config}
+	kcpListener, err := kcp.ListenWithOptions(addr.String(), config.block, config.DataShards, config.ParityShards)
 	if err != nil {
 		return nil, err
 	}
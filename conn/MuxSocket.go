@@ -0,0 +1,130 @@
+package conn
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// MuxSocket is a logical stream carried by a MuxSession
+type MuxSocket struct {
+	Stream    *smux.Stream
+	reader    *bufio.Reader
+	closeFlag bool
+}
+
+func (socket *MuxSocket) Close() error {
+	socket.closeFlag = true
+	return socket.Stream.Close()
+}
+
+func (socket *MuxSocket) Write(p []byte) (n int, err error) {
+	return socket.Stream.Write(p)
+}
+
+func (socket *MuxSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *MuxSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+func (socket *MuxSocket) WriteLine(data []byte) (err error) {
+	_, err = socket.Stream.Write(append(data, '\n'))
+	return
+}
+
+func (socket *MuxSocket) RemoteAddr() net.Addr {
+	return socket.Stream.RemoteAddr()
+}
+
+func (socket *MuxSocket) LocalAddr() net.Addr {
+	return socket.Stream.LocalAddr()
+}
+
+func (socket *MuxSocket) Address() (net.Addr, net.Addr) {
+	return socket.Stream.LocalAddr(), socket.Stream.RemoteAddr()
+}
+
+// MuxSession runs many MuxSockets over one long-lived tunnel connection.
+// It implements Listener so that the server side can accept streams
+// exactly like it accepts ordinary tunnel connections.
+type MuxSession struct {
+	Session *smux.Session
+	Socket  Socket
+}
+
+func newMuxSocket(stream *smux.Stream) *MuxSocket {
+	return &MuxSocket{
+		Stream:    stream,
+		reader:    bufio.NewReader(stream),
+		closeFlag: false,
+	}
+}
+
+func muxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	// version 2 enables the per-stream sliding window
+	config.Version = 2
+	return config
+}
+
+// NewMuxClientSession creates the opening side of a session on top of socket
+func NewMuxClientSession(socket Socket) (*MuxSession, error) {
+	session, err := smux.Client(socket, muxConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &MuxSession{
+		Session: session,
+		Socket:  socket,
+	}, nil
+}
+
+// NewMuxServerSession creates the accepting side of a session on top of socket
+func NewMuxServerSession(socket Socket) (*MuxSession, error) {
+	session, err := smux.Server(socket, muxConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &MuxSession{
+		Session: session,
+		Socket:  socket,
+	}, nil
+}
+
+// Open opens a new stream to the peer
+func (session *MuxSession) Open() (Socket, error) {
+	stream, err := session.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newMuxSocket(stream), nil
+}
+
+func (session *MuxSession) Accept() (Socket, error) {
+	stream, err := session.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return newMuxSocket(stream), nil
+}
+
+func (session *MuxSession) Close() error {
+	return session.Session.Close()
+}
+
+func (session *MuxSession) IsClosed() bool {
+	return session.Session.IsClosed()
+}
+
+func (session *MuxSession) Network() string {
+	return "mux"
+}
+
+func (session *MuxSession) Address() net.Addr {
+	return session.Socket.LocalAddr()
+}
@@ -0,0 +1,286 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicALPN         = "ptunnel"
+	quicDialTimeout  = 10 * time.Second
+	quicCloseTimeout = 10 * time.Second
+)
+
+// QUICSocket is a bidirectional stream on its own QUIC connection
+type QUICSocket struct {
+	Conn      quic.Connection
+	Stream    quic.Stream
+	udpConn   *net.UDPConn // only set on the dialing side, the listener owns it otherwise
+	reader    *bufio.Reader
+	readEOF   atomic.Bool
+	closeFlag bool
+	closeOnce sync.Once
+}
+
+func newQUICSocket(conn quic.Connection, stream quic.Stream, udpConn *net.UDPConn) *QUICSocket {
+	socket := &QUICSocket{
+		Conn:      conn,
+		Stream:    stream,
+		udpConn:   udpConn,
+		closeFlag: false,
+	}
+	socket.reader = bufio.NewReader(quicStreamReader{socket})
+	return socket
+}
+
+// quicStreamReader remembers whether the peer has finished its side of the stream
+type quicStreamReader struct {
+	socket *QUICSocket
+}
+
+func (r quicStreamReader) Read(p []byte) (int, error) {
+	n, err := r.socket.Stream.Read(p)
+	if err == io.EOF {
+		r.socket.readEOF.Store(true)
+	}
+	return n, err
+}
+
+// Close closes the stream and the connection. Closing the connection
+// discards the data not acked yet, so if the peer has not finished its
+// side, the connection is kept until the peer closes it or the timeout.
+func (socket *QUICSocket) Close() error {
+	socket.closeFlag = true
+	var err error
+	socket.closeOnce.Do(func() {
+		err = socket.Stream.Close()
+		closeConn := func() {
+			_ = socket.Conn.CloseWithError(0, "")
+			if socket.udpConn != nil {
+				_ = socket.udpConn.Close()
+			}
+		}
+		if socket.readEOF.Load() {
+			closeConn()
+			return
+		}
+		go func() {
+			select {
+			case <-socket.Conn.Context().Done():
+			case <-time.After(quicCloseTimeout):
+			}
+			closeConn()
+		}()
+	})
+	return err
+}
+
+func (socket *QUICSocket) Write(p []byte) (n int, err error) {
+	return socket.Stream.Write(p)
+}
+
+func (socket *QUICSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *QUICSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+func (socket *QUICSocket) WriteLine(data []byte) (err error) {
+	_, err = socket.Stream.Write(append(data, '\n'))
+	return
+}
+
+func (socket *QUICSocket) RemoteAddr() net.Addr {
+	return socket.Conn.RemoteAddr()
+}
+
+func (socket *QUICSocket) LocalAddr() net.Addr {
+	return socket.Conn.LocalAddr()
+}
+
+func (socket *QUICSocket) Address() (net.Addr, net.Addr) {
+	return socket.Conn.LocalAddr(), socket.Conn.RemoteAddr()
+}
+
+type QUICListener struct {
+	Listener   *quic.Listener
+	udpConn    *net.UDPConn
+	acceptChan chan *QUICSocket
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+// serve accepts connections and hands over the first stream of each one,
+// the stream only shows up after the dialer has written to it, so this
+// runs in its own goroutine per connection to not block the others
+func (listener *QUICListener) serve() {
+	for {
+		conn, err := listener.Listener.Accept(context.Background())
+		if err != nil {
+			_ = listener.Close()
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				_ = conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case listener.acceptChan <- newQUICSocket(conn, stream, nil):
+			case <-listener.closeChan:
+				_ = conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+func (listener *QUICListener) AcceptQUIC() (*QUICSocket, error) {
+	select {
+	case socket := <-listener.acceptChan:
+		return socket, nil
+	case <-listener.closeChan:
+		return nil, errors.New("quic listener closed")
+	}
+}
+
+func (listener *QUICListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.closeChan)
+		err = listener.Listener.Close()
+		_ = listener.udpConn.Close()
+	})
+	return err
+}
+
+func (listener *QUICListener) Accept() (Socket, error) {
+	return listener.AcceptQUIC()
+}
+
+func (listener *QUICListener) Network() string {
+	return "quic"
+}
+
+func (listener *QUICListener) Address() net.Addr {
+	return listener.Listener.Addr()
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicDialTimeout,
+		MaxIdleTimeout:       30 * time.Second,
+		KeepAlivePeriod:      10 * time.Second,
+	}
+}
+
+// NewQUICSocket dials raddr and opens a stream on the new connection.
+// The server certificate is checked with TLSCAFile or TLSPinnedCert of
+// ClientTLSConfig, when neither is configured it is not checked at all
+// because the server may be using a self-signed certificate, the peer
+// is still authenticated by pTunnel itself.
+func NewQUICSocket(laddr *net.UDPAddr, raddr *net.UDPAddr, network string) (Socket, error) {
+	udpConn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	config := clientTLSConfig(raddr.String())
+	if config.RootCAs == nil && config.VerifyPeerCertificate == nil {
+		config.InsecureSkipVerify = true
+	}
+	config.NextProtos = []string{quicALPN}
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	conn, err := quic.Dial(ctx, udpConn, raddr, config, quicConfig())
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		_ = udpConn.Close()
+		return nil, err
+	}
+	return newQUICSocket(conn, stream, udpConn), nil
+}
+
+// NewQUICListener listens on addr with the certificate of ServerTLSConfig,
+// a self-signed certificate is generated when it is not configured
+func NewQUICListener(addr *net.UDPAddr, network string) (Listener, error) {
+	var config *tls.Config
+	if ServerTLSConfig != nil {
+		config = ServerTLSConfig.Clone()
+	} else {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	config.NextProtos = []string{quicALPN}
+	udpConn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	quicListener, err := quic.Listen(udpConn, config, quicConfig())
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+	listener := &QUICListener{
+		Listener:   quicListener,
+		udpConn:    udpConn,
+		acceptChan: make(chan *QUICSocket),
+		closeChan:  make(chan struct{}),
+	}
+	go listener.serve()
+	return listener, nil
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "pTunnel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -2,9 +2,13 @@ package conn
 
 import (
 	"bufio"
+	"errors"
 	"net"
+	"os"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type SSHSocket struct {
@@ -26,7 +30,7 @@ func (socket *SSHSocket) Write(p []byte) (n int, err error) {
 }
 
 func (socket *SSHSocket) Read(p []byte) (n int, err error) {
-	return (*socket.Socket).Read(p)
+	return socket.reader.Read(p)
 }
 func (socket *SSHSocket) ReadLine() ([]byte, error) {
 	return socket.reader.ReadBytes('\n')
@@ -49,20 +53,147 @@ func (socket *SSHSocket) Address() (net.Addr, net.Addr) {
 	return (*socket.Socket).LocalAddr(), (*socket.Socket).RemoteAddr()
 }
 
-func NewSSHSocket(raddr *net.TCPAddr, network string, sshAddr string, sshUser string, sshSigher ssh.Signer) (Socket, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: sshUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(sshSigher),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// SSHAuth holds how the client logs in to the ssh server of a tunnel and
+// how it checks the host key of that server
+type SSHAuth struct {
+	Signers        []ssh.Signer // the keys of SSHPrivateKeyFile
+	UseAgent       bool         // also try the keys of the agent at SSH_AUTH_SOCK
+	Password       string       // for password and keyboard-interactive auth
+	KnownHostsFile string
+	HostKeys       []string // the SHA256 fingerprints of the host keys sent by the server
+	InsecureIgnore bool     // accept any host key if neither of the above is set
+}
+
+// WithHostKeys returns a copy of auth that also checks the host key against fingerprints
+func (auth *SSHAuth) WithHostKeys(fingerprints []string) *SSHAuth {
+	a := SSHAuth{}
+	if auth != nil {
+		a = *auth
+	}
+	a.HostKeys = fingerprints
+	return &a
+}
+
+// clientConfig builds the config of the ssh connection, the returned
+// closer releases the agent connection once the handshake is done
+func (auth *SSHAuth) clientConfig(user string) (*ssh.ClientConfig, func(), error) {
+	if auth == nil {
+		return nil, nil, errors.New("ssh auth is not configured")
+	}
+	closer := func() {}
+	var methods []ssh.AuthMethod
+	signers := auth.Signers
+	if auth.UseAgent && os.Getenv("SSH_AUTH_SOCK") != "" {
+		agentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, nil, err
+		}
+		closer = func() { _ = agentConn.Close() }
+		agentSigners, err := agent.NewClient(agentConn).Signers()
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		signers = append(signers[:len(signers):len(signers)], agentSigners...)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if auth.Password != "" {
+		password := auth.Password
+		methods = append(methods,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				// answer the password prompt, which is the only one not echoed
+				answers := make([]string, len(questions))
+				for i := range questions {
+					if echos[i] {
+						return nil, errors.New("unsupported keyboard-interactive question: " + questions[i])
+					}
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		)
+	}
+	if len(methods) == 0 {
+		closer()
+		return nil, nil, errors.New("no ssh auth method is configured")
+	}
+	hostKeyCallback, err := auth.hostKeyCallback()
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	}, closer, nil
+}
+
+// hostKeyCallback checks the host key against KnownHostsFile and HostKeys,
+// every one of them that is set must accept the key
+func (auth *SSHAuth) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var knownHosts ssh.HostKeyCallback
+	if auth.KnownHostsFile != "" {
+		var err error
+		if knownHosts, err = knownhosts.New(auth.KnownHostsFile); err != nil {
+			return nil, err
+		}
+	}
+	if knownHosts == nil && len(auth.HostKeys) == 0 {
+		if auth.InsecureIgnore {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+		return nil, errors.New("the host key of the ssh server cannot be verified, neither known_hosts nor host key fingerprints are available")
+	}
+	hostKeys := auth.HostKeys
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if knownHosts != nil {
+			if err := knownHosts(hostname, remote, key); err != nil {
+				return err
+			}
+		}
+		if len(hostKeys) > 0 {
+			fingerprint := ssh.FingerprintSHA256(key)
+			for _, hostKey := range hostKeys {
+				if hostKey == fingerprint {
+					return nil
+				}
+			}
+			return errors.New("ssh host key mismatch: " + fingerprint)
+		}
+		return nil
+	}, nil
+}
+
+// NewSSHSigner parses a private key for ssh, passphrase is only used if the key is encrypted
+func NewSSHSigner(privateKey []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, errors.New("the ssh private key is encrypted, but no passphrase is given")
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(passphrase))
+	}
+	return signer, err
+}
+
+func NewSSHSocket(raddr *net.TCPAddr, network string, sshAddr string, sshUser string, sshAuth *SSHAuth) (Socket, error) {
+	sshConfig, closeAgent, err := sshAuth.clientConfig(sshUser)
+	if err != nil {
+		return nil, err
 	}
 	sshClient, err := ssh.Dial(network, sshAddr, sshConfig)
+	closeAgent()
 	if err != nil {
 		return nil, err
 	}
 	conn, err := sshClient.Dial(network, raddr.String())
 	if err != nil {
+		_ = sshClient.Close()
 		return nil, err
 	}
 	return &SSHSocket{
@@ -21,7 +21,7 @@ func (socket *TCPSocket) Write(p []byte) (n int, err error) {
 }
 
 func (socket *TCPSocket) Read(p []byte) (n int, err error) {
-	return socket.Socket.Read(p)
+	return socket.reader.Read(p)
 }
 
 func (socket *TCPSocket) ReadLine() (data []byte, err error) {
@@ -0,0 +1,276 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	ServerTLSConfig *tls.Config // used by tls and wss listeners, nil means tls is not configured
+	ClientTLSConfig *tls.Config // used by tls and wss sockets, nil means the system roots and the server address as SNI
+)
+
+type TLSSocket struct {
+	Socket    *tls.Conn
+	reader    *bufio.Reader
+	closeFlag bool
+}
+
+func (socket *TLSSocket) Close() error {
+	socket.closeFlag = true
+	return socket.Socket.Close()
+}
+
+func (socket *TLSSocket) Write(p []byte) (n int, err error) {
+	return socket.Socket.Write(p)
+}
+
+func (socket *TLSSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *TLSSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+func (socket *TLSSocket) WriteLine(data []byte) (err error) {
+	_, err = socket.Socket.Write(append(data, '\n'))
+	return
+}
+
+func (socket *TLSSocket) RemoteAddr() net.Addr {
+	return socket.Socket.RemoteAddr()
+}
+
+func (socket *TLSSocket) LocalAddr() net.Addr {
+	return socket.Socket.LocalAddr()
+}
+
+func (socket *TLSSocket) Address() (net.Addr, net.Addr) {
+	return socket.Socket.LocalAddr(), socket.Socket.RemoteAddr()
+}
+
+type TLSListener struct {
+	Listener *net.TCPListener
+	config   *tls.Config
+}
+
+// AcceptTLS accepts a tcp connection and wraps it in tls, the handshake
+// runs on the first read or write so a slow peer does not block Accept
+func (listener *TLSListener) AcceptTLS() (*TLSSocket, error) {
+	conn, err := listener.Listener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, listener.config)
+	return &TLSSocket{
+		Socket:    tlsConn,
+		reader:    bufio.NewReader(tlsConn),
+		closeFlag: false,
+	}, nil
+}
+
+func (listener *TLSListener) Close() error {
+	return listener.Listener.Close()
+}
+
+func (listener *TLSListener) Accept() (Socket, error) {
+	return listener.AcceptTLS()
+}
+
+func (listener *TLSListener) Network() string {
+	return "tls"
+}
+
+func (listener *TLSListener) Address() net.Addr {
+	return listener.Listener.Addr()
+}
+
+// clientTLSConfig returns a copy of ClientTLSConfig, the server name
+// falls back to host when it is not configured
+func clientTLSConfig(host string) *tls.Config {
+	var config *tls.Config
+	if ClientTLSConfig != nil {
+		config = ClientTLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		config.ServerName = host
+	}
+	return config
+}
+
+func NewTLSSocket(laddr *net.TCPAddr, raddr *net.TCPAddr, network string) (Socket, error) {
+	conn, err := net.DialTCP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, clientTLSConfig(raddr.String()))
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &TLSSocket{
+		Socket:    tlsConn,
+		reader:    bufio.NewReader(tlsConn),
+		closeFlag: false,
+	}, nil
+}
+
+func NewTLSListener(addr *net.TCPAddr, network string) (Listener, error) {
+	if ServerTLSConfig == nil {
+		return nil, errors.New("tls certificate is not configured")
+	}
+	listener, err := net.ListenTCP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TLSListener{
+		Listener: listener,
+		config:   ServerTLSConfig,
+	}, nil
+}
+
+// NewServerTLSConfig loads the certificate chain and the private key of the
+// server, alpn is the comma separated list of protocols the server accepts.
+// When clientCAFile is not empty, every client must present a certificate
+// issued by one of the CAs in it.
+func NewServerTLSConfig(certFile string, keyFile string, alpn string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   splitALPN(alpn),
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig creates the client side tls config.
+// serverName overrides the SNI, alpn is the comma separated list of protocols
+// to offer, caFile replaces the system roots when it is not empty.
+// pinnedCert is the hex sha256 of the server certificate in DER form, when it
+// is set the certificate chain is not verified and only the pin is checked,
+// so a self-signed certificate can be used.
+// certFile and keyFile are the client certificate for servers requiring one.
+func NewClientTLSConfig(serverName string, alpn string, caFile string, pinnedCert string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		NextProtos: splitALPN(alpn),
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if pinnedCert != "" {
+		pin, err := hex.DecodeString(strings.ReplaceAll(pinnedCert, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.New("invalid pinned certificate fingerprint: " + pinnedCert)
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no server certificate")
+			}
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fingerprint[:], pin) {
+				return errors.New("server certificate does not match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+func splitALPN(alpn string) []string {
+	var protos []string
+	for _, proto := range strings.Split(alpn, ",") {
+		proto = strings.TrimSpace(proto)
+		if proto != "" {
+			protos = append(protos, proto)
+		}
+	}
+	return protos
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	caPem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+// IsTLSType reports whether the socket type runs on tls
+func IsTLSType(sType string) bool {
+	switch strings.ToLower(sType) {
+	case "tls4", "tls6", "wss4", "wss6", "quic4", "quic6":
+		return true
+	}
+	return false
+}
+
+// PeerCertificate returns the verified certificate of the peer of a tls, wss
+// or quic socket, nil if the peer has not presented one or the socket does
+// not run on tls. It completes the tls handshake if it has not run yet.
+func PeerCertificate(socket Socket) (*x509.Certificate, error) {
+	var state tls.ConnectionState
+	switch socket := socket.(type) {
+	case *TLSSocket:
+		if err := socket.Socket.Handshake(); err != nil {
+			return nil, err
+		}
+		state = socket.Socket.ConnectionState()
+	case *WSSocket:
+		request := socket.Socket.Request()
+		if request == nil || request.TLS == nil {
+			return nil, nil
+		}
+		state = *request.TLS
+	case *QUICSocket:
+		state = socket.Conn.ConnectionState().TLS
+	default:
+		return nil, nil
+	}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	return state.VerifiedChains[0][0], nil
+}
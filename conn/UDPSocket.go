@@ -0,0 +1,324 @@
+package conn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPSessionTimeout is how long a udp session lives without any datagram in
+// either direction
+var UDPSessionTimeout = 60 * time.Second
+
+const (
+	maxDatagramSize    = 65535
+	datagramHeaderSize = 2
+	sessionQueueSize   = 256
+	acceptQueueSize    = 64
+)
+
+var errDatagramTooLarge = errors.New("datagram too large")
+
+// UDPSocket carries the datagrams of one peer as a byte stream so that it
+// can be forwarded over a tunnel like any other socket. Every datagram is
+// prefixed with its length (uint16), Read returns datagrams in this form
+// and Write expects it, the boundaries are kept on the other side.
+type UDPSocket struct {
+	Socket     *net.UDPConn
+	raddr      *net.UDPAddr
+	listener   *UDPListener // nil if the socket is dialed
+	recvChan   chan []byte  // only for sockets accepted by a listener
+	reader     *bufio.Reader
+	pending    []byte
+	lastActive atomic.Int64
+	closeFlag  bool
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+func newUDPSocket(udpConn *net.UDPConn, raddr *net.UDPAddr, listener *UDPListener) *UDPSocket {
+	socket := &UDPSocket{
+		Socket:    udpConn,
+		raddr:     raddr,
+		listener:  listener,
+		closeFlag: false,
+		done:      make(chan struct{}),
+	}
+	if listener != nil {
+		socket.recvChan = make(chan []byte, sessionQueueSize)
+	}
+	socket.reader = bufio.NewReaderSize(&datagramReader{socket: socket}, datagramHeaderSize+maxDatagramSize)
+	socket.touch()
+	return socket
+}
+
+func (socket *UDPSocket) touch() {
+	socket.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the socket has been idle
+func (socket *UDPSocket) idleFor() time.Duration {
+	return time.Since(time.Unix(0, socket.lastActive.Load()))
+}
+
+// readDatagram returns the next datagram from the peer, io.EOF is returned
+// once the socket has been idle for UDPSessionTimeout
+func (socket *UDPSocket) readDatagram() ([]byte, error) {
+	if socket.listener == nil {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_ = socket.Socket.SetReadDeadline(time.Now().Add(UDPSessionTimeout - socket.idleFor()))
+			n, err := socket.Socket.Read(buf)
+			if err == nil {
+				socket.touch()
+				return buf[:n], nil
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return nil, err
+			}
+			if socket.idleFor() >= UDPSessionTimeout {
+				return nil, io.EOF
+			}
+		}
+	}
+	for {
+		timer := time.NewTimer(UDPSessionTimeout - socket.idleFor())
+		select {
+		case data := <-socket.recvChan:
+			timer.Stop()
+			socket.touch()
+			return data, nil
+		case <-socket.done:
+			timer.Stop()
+			return nil, io.EOF
+		case <-timer.C:
+			if socket.idleFor() >= UDPSessionTimeout {
+				_ = socket.Close()
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+// datagramReader turns the datagrams of a UDPSocket into length prefixed records
+type datagramReader struct {
+	socket *UDPSocket
+	rest   []byte
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	if len(r.rest) == 0 {
+		data, err := r.socket.readDatagram()
+		if err != nil {
+			return 0, err
+		}
+		record, err := encodeDatagram(data)
+		if err != nil {
+			return 0, err
+		}
+		r.rest = record
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// encodeDatagram prefixes a datagram with its length
+func encodeDatagram(data []byte) ([]byte, error) {
+	if len(data) > maxDatagramSize {
+		return nil, errDatagramTooLarge
+	}
+	record := make([]byte, datagramHeaderSize+len(data))
+	binary.BigEndian.PutUint16(record, uint16(len(data)))
+	copy(record[datagramHeaderSize:], data)
+	return record, nil
+}
+
+func (socket *UDPSocket) Close() error {
+	socket.closeFlag = true
+	var err error
+	socket.closeOnce.Do(func() {
+		close(socket.done)
+		if socket.listener != nil {
+			socket.listener.removeSession(socket)
+		} else {
+			err = socket.Socket.Close()
+		}
+	})
+	return err
+}
+
+// Write collects length prefixed records and sends each complete one as a datagram
+func (socket *UDPSocket) Write(p []byte) (n int, err error) {
+	socket.pending = append(socket.pending, p...)
+	offset := 0
+	for len(socket.pending)-offset >= datagramHeaderSize {
+		length := int(binary.BigEndian.Uint16(socket.pending[offset:]))
+		if len(socket.pending)-offset-datagramHeaderSize < length {
+			break
+		}
+		data := socket.pending[offset+datagramHeaderSize : offset+datagramHeaderSize+length]
+		if socket.listener == nil {
+			_, err = socket.Socket.Write(data)
+		} else {
+			_, err = socket.Socket.WriteToUDP(data, socket.raddr)
+		}
+		if err != nil {
+			return 0, err
+		}
+		socket.touch()
+		offset += datagramHeaderSize + length
+	}
+	socket.pending = append(socket.pending[:0], socket.pending[offset:]...)
+	return len(p), nil
+}
+
+func (socket *UDPSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *UDPSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+func (socket *UDPSocket) WriteLine(data []byte) (err error) {
+	_, err = socket.Write(append(data, '\n'))
+	return
+}
+
+func (socket *UDPSocket) RemoteAddr() net.Addr {
+	return socket.raddr
+}
+
+func (socket *UDPSocket) LocalAddr() net.Addr {
+	return socket.Socket.LocalAddr()
+}
+
+func (socket *UDPSocket) Address() (net.Addr, net.Addr) {
+	return socket.Socket.LocalAddr(), socket.raddr
+}
+
+// UDPListener tracks the peers sending datagrams to it, the first datagram
+// of an unknown peer creates a new UDPSocket for it, and the replies written
+// to that socket are sent back to the peer's address
+type UDPListener struct {
+	Listener   *net.UDPConn
+	sessions   map[string]*UDPSocket
+	lock       sync.Mutex
+	acceptChan chan *UDPSocket
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+func (listener *UDPListener) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, raddr, err := listener.Listener.ReadFromUDP(buf)
+		if err != nil {
+			_ = listener.Close()
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		listener.lock.Lock()
+		socket, ok := listener.sessions[raddr.String()]
+		if !ok {
+			socket = newUDPSocket(listener.Listener, raddr, listener)
+			listener.sessions[raddr.String()] = socket
+		}
+		listener.lock.Unlock()
+
+		if !ok {
+			// never wait for Accept here, the datagrams of the accepted
+			// peers would wait too
+			select {
+			case listener.acceptChan <- socket:
+			default:
+				// too many new peers, forget this one until its next datagram
+				listener.removeSession(socket)
+				continue
+			}
+		}
+		select {
+		case socket.recvChan <- data:
+		default:
+			// the session is not keeping up, drop it like a full socket buffer would
+		}
+	}
+}
+
+func (listener *UDPListener) removeSession(socket *UDPSocket) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	if listener.sessions[socket.raddr.String()] == socket {
+		delete(listener.sessions, socket.raddr.String())
+	}
+}
+
+func (listener *UDPListener) AcceptUDP() (*UDPSocket, error) {
+	select {
+	case socket := <-listener.acceptChan:
+		return socket, nil
+	case <-listener.closeChan:
+		return nil, errors.New("udp listener closed")
+	}
+}
+
+func (listener *UDPListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.closeChan)
+		err = listener.Listener.Close()
+		listener.lock.Lock()
+		sessions := listener.sessions
+		listener.sessions = make(map[string]*UDPSocket)
+		listener.lock.Unlock()
+		for _, socket := range sessions {
+			_ = socket.Close()
+		}
+	})
+	return err
+}
+
+func (listener *UDPListener) Accept() (Socket, error) {
+	return listener.AcceptUDP()
+}
+
+func (listener *UDPListener) Network() string {
+	return "udp"
+}
+
+func (listener *UDPListener) Address() net.Addr {
+	return listener.Listener.LocalAddr()
+}
+
+func NewUDPSocket(laddr *net.UDPAddr, raddr *net.UDPAddr, network string) (Socket, error) {
+	udpConn, err := net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPSocket(udpConn, raddr, nil), nil
+}
+
+func NewUDPListener(addr *net.UDPAddr, network string) (Listener, error) {
+	udpConn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener := &UDPListener{
+		Listener:   udpConn,
+		sessions:   make(map[string]*UDPSocket),
+		acceptChan: make(chan *UDPSocket, acceptQueueSize),
+		closeChan:  make(chan struct{}),
+	}
+	go listener.serve()
+	return listener, nil
+}
@@ -0,0 +1,214 @@
+package conn
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	WSPath = "/" // the path of the websocket endpoint, must be the same on both sides
+	WSHost = ""  // the Host header sent by the client, empty means the server address
+)
+
+type WSSocket struct {
+	Socket    *websocket.Conn
+	reader    *bufio.Reader
+	laddr     net.Addr
+	raddr     net.Addr
+	closeFlag bool
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newWSSocket(ws *websocket.Conn, laddr net.Addr, raddr net.Addr) *WSSocket {
+	ws.PayloadType = websocket.BinaryFrame
+	return &WSSocket{
+		Socket:    ws,
+		reader:    bufio.NewReader(ws),
+		laddr:     laddr,
+		raddr:     raddr,
+		closeFlag: false,
+		done:      make(chan struct{}),
+	}
+}
+
+func (socket *WSSocket) Close() error {
+	socket.closeFlag = true
+	socket.closeOnce.Do(func() {
+		close(socket.done)
+	})
+	return socket.Socket.Close()
+}
+
+func (socket *WSSocket) Write(p []byte) (n int, err error) {
+	return socket.Socket.Write(p)
+}
+
+func (socket *WSSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *WSSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+func (socket *WSSocket) WriteLine(data []byte) (err error) {
+	_, err = socket.Socket.Write(append(data, '\n'))
+	return
+}
+
+func (socket *WSSocket) RemoteAddr() net.Addr {
+	return socket.raddr
+}
+
+func (socket *WSSocket) LocalAddr() net.Addr {
+	return socket.laddr
+}
+
+func (socket *WSSocket) Address() (net.Addr, net.Addr) {
+	return socket.laddr, socket.raddr
+}
+
+// WSListener serves websocket upgrades on exactly WSPath and answers
+// every other path with 404 like an ordinary web server
+type WSListener struct {
+	Listener   net.Listener
+	server     *http.Server
+	acceptChan chan *WSSocket
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	network    string
+}
+
+func (listener *WSListener) handle(ws *websocket.Conn) {
+	request := ws.Request()
+	raddr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+	if err != nil {
+		return
+	}
+	laddr, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	socket := newWSSocket(ws, laddr, raddr)
+	select {
+	case listener.acceptChan <- socket:
+	case <-listener.closeChan:
+		return
+	}
+	// the connection is closed when the handler returns
+	<-socket.done
+}
+
+func (listener *WSListener) AcceptWS() (*WSSocket, error) {
+	select {
+	case socket := <-listener.acceptChan:
+		return socket, nil
+	case <-listener.closeChan:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+func (listener *WSListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closeChan)
+	})
+	return listener.server.Close()
+}
+
+func (listener *WSListener) Accept() (Socket, error) {
+	return listener.AcceptWS()
+}
+
+func (listener *WSListener) Network() string {
+	return listener.network
+}
+
+func (listener *WSListener) Address() net.Addr {
+	return listener.Listener.Addr()
+}
+
+// NewWSSocket dials raddr and upgrades the connection to a websocket,
+// secure wraps the connection in TLS before the upgrade
+func NewWSSocket(laddr *net.TCPAddr, raddr *net.TCPAddr, network string, secure bool) (Socket, error) {
+	host := WSHost
+	if host == "" {
+		host = raddr.String()
+	}
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+	}
+	config, err := websocket.NewConfig(fmt.Sprintf("%s://%s%s", scheme, host, WSPath), fmt.Sprintf("http://%s/", host))
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	conn, err = net.DialTCP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tlsConn := tls.Client(conn, clientTLSConfig(config.Location.Host))
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newWSSocket(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// NewWSListener listens for websocket upgrades, secure serves them over TLS
+// with ServerTLSConfig
+func NewWSListener(addr *net.TCPAddr, network string, secure bool) (Listener, error) {
+	if secure && ServerTLSConfig == nil {
+		return nil, errors.New("tls certificate is not configured")
+	}
+	tcpListener, err := net.ListenTCP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener := &WSListener{
+		Listener:   tcpListener,
+		acceptChan: make(chan *WSSocket),
+		closeChan:  make(chan struct{}),
+		network:    "ws",
+	}
+	var netListener net.Listener = tcpListener
+	if secure {
+		listener.network = "wss"
+		netListener = tls.NewListener(tcpListener, ServerTLSConfig)
+	}
+	wsServer := websocket.Server{
+		Handler: listener.handle,
+		// the origin is not checked, the peer is authenticated by pTunnel itself
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			return nil
+		},
+	}
+	// the path must match exactly, a ServeMux pattern ending with / would
+	// also serve every path below it
+	path := WSPath
+	listener.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		wsServer.ServeHTTP(w, r)
+	})}
+	go func() {
+		_ = listener.server.Serve(netListener)
+	}()
+	return listener, nil
+}
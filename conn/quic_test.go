@@ -0,0 +1,103 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialTestQUIC returns both ends of a new QUIC stream over loopback
+func dialTestQUIC(t *testing.T) (Socket, Socket) {
+	t.Helper()
+	listener, err := NewQUICListener(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	client, err := NewQUICSocket(nil, listener.Address().(*net.UDPAddr), "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	// the stream only reaches the listener with its first data
+	if err = client.WriteLine([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan Socket, 1)
+	go func() {
+		socket, err := listener.Accept()
+		if err == nil {
+			accepted <- socket
+		}
+	}()
+	select {
+	case server := <-accepted:
+		t.Cleanup(func() { _ = server.Close() })
+		return client, server
+	case <-time.After(10 * time.Second):
+		t.Fatal("no quic stream is accepted")
+		return nil, nil
+	}
+}
+
+func TestQUICSocket(t *testing.T) {
+	client, server := dialTestQUIC(t)
+	if line, err := server.ReadLine(); err != nil || string(line) != "hello\n" {
+		t.Fatalf("got %q and %v", line, err)
+	}
+	if err := server.WriteLine([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := client.ReadLine(); err != nil || string(line) != "world\n" {
+		t.Fatalf("got %q and %v", line, err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 10*1024)
+	go func() {
+		_, _ = client.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the data is changed")
+	}
+}
+
+func TestQUICSocketClose(t *testing.T) {
+	tests := []struct {
+		name   string
+		closer bool // whether the client closes, the server does otherwise
+	}{
+		{"client closes", true},
+		{"server closes", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := dialTestQUIC(t)
+			if _, err := server.ReadLine(); err != nil {
+				t.Fatal(err)
+			}
+			closing, reading := server, client
+			if tt.closer {
+				closing, reading = client, server
+			}
+			done := make(chan error, 1)
+			go func() {
+				_, err := reading.Read(make([]byte, 10))
+				done <- err
+			}()
+			_ = closing.Close()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("Read returned data after Close")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Close on one side has not unblocked Read on the other")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUDPListener(t *testing.T) *UDPListener {
+	t.Helper()
+	listener, err := NewUDPListener(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener.(*UDPListener)
+}
+
+func dialTestUDP(t *testing.T, listener *UDPListener) Socket {
+	t.Helper()
+	socket, err := NewUDPSocket(nil, listener.Address().(*net.UDPAddr), "udp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = socket.Close() })
+	return socket
+}
+
+func record(data []byte) []byte {
+	r, err := encodeDatagram(data)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// readRecord reads one length prefixed datagram from socket
+func readRecord(t *testing.T, socket Socket) []byte {
+	t.Helper()
+	done := make(chan []byte)
+	go func() {
+		header := make([]byte, datagramHeaderSize)
+		if _, err := io.ReadFull(socket, header); err != nil {
+			done <- nil
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(socket, data); err != nil {
+			done <- nil
+			return
+		}
+		done <- data
+	}()
+	select {
+	case data := <-done:
+		if data == nil {
+			t.Fatal("read failed")
+		}
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram")
+		return nil
+	}
+}
+
+func TestEncodeDatagram(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		err  error
+	}{
+		{"empty", 0, nil},
+		{"small", 100, nil},
+		{"max", maxDatagramSize, nil},
+		{"too large", maxDatagramSize + 1, errDatagramTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{'x'}, tt.size)
+			r, err := encodeDatagram(data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if int(binary.BigEndian.Uint16(r)) != tt.size || !bytes.Equal(r[datagramHeaderSize:], data) {
+				t.Fatal("wrong record")
+			}
+		})
+	}
+}
+
+func TestUDPSocketFraming(t *testing.T) {
+	listener := newTestUDPListener(t)
+	client := dialTestUDP(t, listener)
+	datagrams := [][]byte{
+		[]byte("first"),
+		{},
+		bytes.Repeat([]byte{'x'}, 1000),
+		[]byte("last"),
+	}
+	var stream []byte
+	for _, d := range datagrams {
+		stream = append(stream, record(d)...)
+	}
+
+	// the records are written in pieces split within the headers and bodies
+	for _, n := range []int{1, 6, 2, 500} {
+		if _, err := client.Write(stream[:n]); err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+	}
+	if _, err := client.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range datagrams {
+		if got := readRecord(t, server); !bytes.Equal(got, want) {
+			t.Fatalf("datagram %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+
+	// and back, each record is a datagram
+	if _, err = server.Write(append(record([]byte("a")), record([]byte("bc"))...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "bc"} {
+		if got := readRecord(t, client); string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// TestUDPListenerAcceptQueue checks that new peers which are not accepted do
+// not hold up the datagrams of an accepted peer
+func TestUDPListenerAcceptQueue(t *testing.T) {
+	listener := newTestUDPListener(t)
+	client := dialTestUDP(t, listener)
+	if _, err := client.Write(record([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRecord(t, server)
+
+	for i := 0; i < acceptQueueSize+16; i++ {
+		if _, err = dialTestUDP(t, listener).Write(record([]byte("new peer"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = client.Write(record([]byte("still here"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRecord(t, server); string(got) != "still here" {
+		t.Fatalf("got %q", got)
+	}
+}
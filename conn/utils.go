@@ -7,11 +7,9 @@ import (
 	"pTunnel/utils/consts"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/ssh"
 )
 
-func NewListener(lType string, ip string, port int) (Listener, error) {
+func NewListener(lType string, ip string, port int, kcpConfig *KCPConfig) (Listener, error) {
 	var listener Listener
 	switch strings.ToLower(lType) {
 	case "tcp4":
@@ -46,7 +44,7 @@ func NewListener(lType string, ip string, port int) (Listener, error) {
 		if err != nil {
 			return nil, err
 		}
-		listener, err = NewKCPListener(addr)
+		listener, err = NewKCPListener(addr, kcpConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -58,7 +56,7 @@ func NewListener(lType string, ip string, port int) (Listener, error) {
 		if err != nil {
 			return nil, err
 		}
-		listener, err = NewKCPListener(addr)
+		listener, err = NewKCPListener(addr, kcpConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -86,13 +84,133 @@ func NewListener(lType string, ip string, port int) (Listener, error) {
 		if err != nil {
 			return nil, err
 		}
+	case "ws4":
+		if ip == consts.Auto {
+			ip = "0.0.0.0"
+		}
+		addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewWSListener(addr, "tcp4", false)
+		if err != nil {
+			return nil, err
+		}
+	case "ws6":
+		if ip == consts.Auto {
+			ip = "[::]"
+		}
+		addr, err := net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewWSListener(addr, "tcp6", false)
+		if err != nil {
+			return nil, err
+		}
+	case "wss4":
+		if ip == consts.Auto {
+			ip = "0.0.0.0"
+		}
+		addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewWSListener(addr, "tcp4", true)
+		if err != nil {
+			return nil, err
+		}
+	case "wss6":
+		if ip == consts.Auto {
+			ip = "[::]"
+		}
+		addr, err := net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewWSListener(addr, "tcp6", true)
+		if err != nil {
+			return nil, err
+		}
+	case "tls4":
+		if ip == consts.Auto {
+			ip = "0.0.0.0"
+		}
+		addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewTLSListener(addr, "tcp4")
+		if err != nil {
+			return nil, err
+		}
+	case "tls6":
+		if ip == consts.Auto {
+			ip = "[::]"
+		}
+		addr, err := net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewTLSListener(addr, "tcp6")
+		if err != nil {
+			return nil, err
+		}
+	case "quic4":
+		if ip == consts.Auto {
+			ip = "0.0.0.0"
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewQUICListener(addr, "udp4")
+		if err != nil {
+			return nil, err
+		}
+	case "quic6":
+		if ip == consts.Auto {
+			ip = "[::]"
+		}
+		addr, err := net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewQUICListener(addr, "udp6")
+		if err != nil {
+			return nil, err
+		}
+	case "udp4":
+		if ip == consts.Auto {
+			ip = "0.0.0.0"
+		}
+		addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewUDPListener(addr, "udp4")
+		if err != nil {
+			return nil, err
+		}
+	case "udp6":
+		if ip == consts.Auto {
+			ip = "[::]"
+		}
+		addr, err := net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", ip, port))
+		if err != nil {
+			return nil, err
+		}
+		listener, err = NewUDPListener(addr, "udp6")
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, errors.New("unsupported listener type: " + lType)
 	}
 	return listener, nil
 }
 
-func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, rip6 string, rport int, sshUser string, sshPort int, sshSigher ssh.Signer) (Socket, error) {
+func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, rip6 string, rport int, sshUser string, sshPort int, sshAuth *SSHAuth, kcpConfig *KCPConfig) (Socket, error) {
 	var socket Socket
 	switch strings.ToLower(sType) {
 	case "tcp4":
@@ -151,7 +269,7 @@ func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, r
 		if err != nil {
 			return nil, err
 		}
-		socket, err = NewKCPSocket(laddr4, raddr4, "udp4")
+		socket, err = NewKCPSocket(laddr4, raddr4, "udp4", kcpConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -171,7 +289,7 @@ func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, r
 		if err != nil {
 			return nil, err
 		}
-		socket, err = NewKCPSocket(laddr6, raddr6, "udp6")
+		socket, err = NewKCPSocket(laddr6, raddr6, "udp6", kcpConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -183,7 +301,7 @@ func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, r
 			return nil, err
 		}
 		sshAddr := fmt.Sprintf("%s:%d", rip4, sshPort)
-		socket, err = NewSSHSocket(raddr4, "tcp4", sshAddr, sshUser, sshSigher)
+		socket, err = NewSSHSocket(raddr4, "tcp4", sshAddr, sshUser, sshAuth)
 		if err != nil {
 			return nil, err
 		}
@@ -195,7 +313,207 @@ func NewSocket(sType string, lip4 string, lip6 string, lport int, rip4 string, r
 			return nil, err
 		}
 		sshAddr := fmt.Sprintf("[%s]:%d", rip6, sshPort)
-		socket, err = NewSSHSocket(raddr6, "tcp6", sshAddr, sshUser, sshSigher)
+		socket, err = NewSSHSocket(raddr6, "tcp6", sshAddr, sshUser, sshAuth)
+		if err != nil {
+			return nil, err
+		}
+	case "ws4":
+		var laddr4 *net.TCPAddr
+		var raddr4 *net.TCPAddr
+		var err error
+		if lip4 == consts.Auto {
+			laddr4 = nil
+		} else {
+			laddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", lip4, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", rip4, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewWSSocket(laddr4, raddr4, "tcp4", false)
+		if err != nil {
+			return nil, err
+		}
+	case "ws6":
+		var laddr6 *net.TCPAddr
+		var raddr6 *net.TCPAddr
+		var err error
+		if lip6 == consts.Auto {
+			laddr6 = nil
+		} else {
+			laddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", lip6, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", rip6, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewWSSocket(laddr6, raddr6, "tcp6", false)
+		if err != nil {
+			return nil, err
+		}
+	case "wss4":
+		var laddr4 *net.TCPAddr
+		var raddr4 *net.TCPAddr
+		var err error
+		if lip4 == consts.Auto {
+			laddr4 = nil
+		} else {
+			laddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", lip4, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", rip4, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewWSSocket(laddr4, raddr4, "tcp4", true)
+		if err != nil {
+			return nil, err
+		}
+	case "wss6":
+		var laddr6 *net.TCPAddr
+		var raddr6 *net.TCPAddr
+		var err error
+		if lip6 == consts.Auto {
+			laddr6 = nil
+		} else {
+			laddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", lip6, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", rip6, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewWSSocket(laddr6, raddr6, "tcp6", true)
+		if err != nil {
+			return nil, err
+		}
+	case "tls4":
+		var laddr4 *net.TCPAddr
+		var raddr4 *net.TCPAddr
+		var err error
+		if lip4 == consts.Auto {
+			laddr4 = nil
+		} else {
+			laddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", lip4, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr4, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", rip4, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewTLSSocket(laddr4, raddr4, "tcp4")
+		if err != nil {
+			return nil, err
+		}
+	case "tls6":
+		var laddr6 *net.TCPAddr
+		var raddr6 *net.TCPAddr
+		var err error
+		if lip6 == consts.Auto {
+			laddr6 = nil
+		} else {
+			laddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", lip6, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr6, err = net.ResolveTCPAddr("tcp6", fmt.Sprintf("%s:%d", rip6, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewTLSSocket(laddr6, raddr6, "tcp6")
+		if err != nil {
+			return nil, err
+		}
+	case "quic4":
+		var laddr4 *net.UDPAddr
+		var raddr4 *net.UDPAddr
+		var err error
+		if lip4 == consts.Auto {
+			laddr4 = nil
+		} else {
+			laddr4, err = net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", lip4, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr4, err = net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", rip4, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewQUICSocket(laddr4, raddr4, "udp4")
+		if err != nil {
+			return nil, err
+		}
+	case "quic6":
+		var laddr6 *net.UDPAddr
+		var raddr6 *net.UDPAddr
+		var err error
+		if lip6 == consts.Auto {
+			laddr6 = nil
+		} else {
+			laddr6, err = net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", lip6, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr6, err = net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", rip6, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewQUICSocket(laddr6, raddr6, "udp6")
+		if err != nil {
+			return nil, err
+		}
+	case "udp4":
+		var laddr4 *net.UDPAddr
+		var raddr4 *net.UDPAddr
+		var err error
+		if lip4 == consts.Auto {
+			laddr4 = nil
+		} else {
+			laddr4, err = net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", lip4, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr4, err = net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", rip4, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewUDPSocket(laddr4, raddr4, "udp4")
+		if err != nil {
+			return nil, err
+		}
+	case "udp6":
+		var laddr6 *net.UDPAddr
+		var raddr6 *net.UDPAddr
+		var err error
+		if lip6 == consts.Auto {
+			laddr6 = nil
+		} else {
+			laddr6, err = net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", lip6, lport))
+			if err != nil {
+				return nil, err
+			}
+		}
+		raddr6, err = net.ResolveUDPAddr("udp6", fmt.Sprintf("%s:%d", rip6, rport))
+		if err != nil {
+			return nil, err
+		}
+		socket, err = NewUDPSocket(laddr6, raddr6, "udp6")
 		if err != nil {
 			return nil, err
 		}
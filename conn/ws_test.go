@@ -0,0 +1,127 @@
+package conn
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWSListenerPath(t *testing.T) {
+	tests := []struct {
+		wsPath string
+		path   string
+		found  bool
+	}{
+		{"/", "/", true},
+		{"/", "/index.html", false},
+		{"/", "/a/b", false},
+		{"/tunnel", "/tunnel", true},
+		{"/tunnel", "/tunnel/", false},
+		{"/tunnel/", "/tunnel/", true},
+		{"/tunnel/", "/tunnel/x", false},
+	}
+	defer func(wsPath string) { WSPath = wsPath }(WSPath)
+	for _, tt := range tests {
+		t.Run(tt.wsPath+" "+tt.path, func(t *testing.T) {
+			WSPath = tt.wsPath
+			listener, err := NewWSListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, "tcp4", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			response, err := http.Get("http://" + listener.Address().String() + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = response.Body.Close()
+			// the websocket endpoint rejects a plain request, but not with 404
+			if found := response.StatusCode != http.StatusNotFound; found != tt.found {
+				t.Fatalf("got %s", response.Status)
+			}
+
+			if !tt.found {
+				return
+			}
+			accepted := make(chan Socket, 1)
+			go func() {
+				socket, err := listener.Accept()
+				if err == nil {
+					accepted <- socket
+				}
+			}()
+			client, err := NewWSSocket(nil, listener.Address().(*net.TCPAddr), "tcp4", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if err = client.WriteLine([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			server := <-accepted
+			defer server.Close()
+			if line, err := server.ReadLine(); err != nil || string(line) != "hello\n" {
+				t.Fatalf("got %q and %v", line, err)
+			}
+		})
+	}
+}
+
+func TestWSSListener(t *testing.T) {
+	defer func(server, client *tls.Config) {
+		ServerTLSConfig, ClientTLSConfig = server, client
+	}(ServerTLSConfig, ClientTLSConfig)
+
+	ServerTLSConfig = nil
+	if _, err := NewListener("wss4", "127.0.0.1", 0, nil); err == nil {
+		t.Fatal("a wss listener is created without a certificate")
+	}
+
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ServerTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	listener, err := NewListener("wss4", "127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listener.Network() != "wss" {
+		t.Fatalf("network %s, want wss", listener.Network())
+	}
+
+	accepted := make(chan Socket, 1)
+	go func() {
+		socket, err := listener.Accept()
+		if err == nil {
+			accepted <- socket
+		}
+	}()
+	client, err := NewWSSocket(nil, listener.Address().(*net.TCPAddr), "tcp4", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.WriteLine([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var server Socket
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no wss connection is accepted")
+	}
+	defer server.Close()
+	if line, err := server.ReadLine(); err != nil || string(line) != "hello\n" {
+		t.Fatalf("got %q and %v", line, err)
+	}
+	if err = server.WriteLine([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := client.ReadLine(); err != nil || string(line) != "world\n" {
+		t.Fatalf("got %q and %v", line, err)
+	}
+}
@@ -1,14 +1,15 @@
 package proxy
 
 import (
+	"crypto"
+	"pTunnel/conn"
 	"pTunnel/utils/common"
 	"pTunnel/utils/p2p"
-	"strconv"
+	"pTunnel/utils/security"
 )
 
 var (
 	PublicKeyFile string
-	NBitsFile     string
 	ServerAddrV4  string
 	ServerAddrV6  string
 	ServerPort    int
@@ -20,11 +21,13 @@ var (
 	NatType       int
 	MappingType   int
 	FilteringType int
+	KCPProfile    string // must match the profile of the p2p service on the server
+	MetricsAddr   string // the address of the prometheus metrics, empty means disabled
 )
 
 var (
-	PublicKey []byte
-	NBits     int
+	PublicKey crypto.PublicKey
+	KCPConfig *conn.KCPConfig
 )
 
 // InitConf initializes the configurations
@@ -33,12 +36,11 @@ func InitConf() error {
 	if err != nil {
 		return err
 	}
-	PublicKey = publicKey
-	nBits, err := common.LoadFile(NBitsFile)
+	PublicKey, err = security.ParsePublicKey(publicKey)
 	if err != nil {
 		return err
 	}
-	NBits, err = strconv.Atoi(string(nBits))
+	KCPConfig, err = conn.ParseKCPConfig(KCPProfile)
 	if err != nil {
 		return err
 	}
@@ -8,11 +8,13 @@ import (
 	tunnel2 "pTunnel/tunnel"
 	"pTunnel/utils/consts"
 	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
 	"pTunnel/utils/p2p"
 	"pTunnel/utils/security"
 	"pTunnel/utils/serialize"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type Service struct {
@@ -31,11 +33,12 @@ type Service struct {
 	TunnelSocket conn.Socket // set automatically
 
 	// Metadata
-	LAddr         *net.UDPAddr // set automatically
-	RAddr         *net.UDPAddr // set automatically
-	FSMType       string       // set automatically
-	SecretKey     []byte       // set automatically
-	TunnelEncrypt bool         // set automatically
+	LAddr         *net.UDPAddr    // set automatically
+	RAddr         *net.UDPAddr    // set automatically
+	FSMType       string          // set automatically
+	SecretKey     []byte          // set automatically
+	TunnelEncrypt bool            // set automatically
+	KCPConfig     *conn.KCPConfig // set automatically
 }
 
 func (service *Service) run() {
@@ -74,7 +77,7 @@ func (service *Service) createTunnelSocket() (err error) {
 		socketType,
 		consts.Auto, consts.Auto, 0,
 		ServerAddrV4, ServerAddrV6,
-		service.TunnelPort, consts.UnConf, 0, nil,
+		service.TunnelPort, consts.UnConf, 0, nil, KCPConfig,
 	)
 	if err != nil {
 		log.Error("Create tunnel socket failed. Error: %v", err)
@@ -85,7 +88,12 @@ func (service *Service) createTunnelSocket() (err error) {
 }
 
 func (service *Service) extractMetadata() (err error) {
-	secretKey := security.AesGenKey(32) // only for encrypt/decrypt metadata
+	// only for encrypt/decrypt metadata
+	secretKey, err := security.ClientHandshake(service.TunnelSocket, PublicKey)
+	if err != nil {
+		log.Error("Handshake failed. Error: %v", err)
+		return
+	}
 	dict := make(map[string]interface{})
 	if service.P2PAddrV4 != "" {
 		service.P2PAddr = service.P2PAddrV4
@@ -124,13 +132,14 @@ func (service *Service) extractMetadata() (err error) {
 	}
 	dict["Type"] = "Proxy"
 	dict["NATType"] = strconv.Itoa(MappingType*3 + FilteringType)
-	dict["SecretKey"] = string(secretKey)
+	dict["Timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+	dict["Nonce"] = security.GenNonce()
 	bytes, err := serialize.Serialize(&dict)
 	if err != nil {
 		log.Error("Serialize metadata failed. Error: %v", err)
 		return
 	}
-	bytes, err = security.RSAEncryptBase64(bytes, PublicKey, NBits)
+	bytes, err = security.AEADEncryptBase64(bytes, secretKey)
 	if err != nil {
 		log.Error("Encrypt metadata failed. Error: %v", err)
 		return
@@ -147,7 +156,7 @@ func (service *Service) extractMetadata() (err error) {
 		return
 	}
 
-	bytes, err = security.AESDecryptBase64(bytes, secretKey)
+	bytes, err = security.AEADDecryptBase64(bytes, secretKey)
 	if err != nil {
 		log.Error("Decrypt metadata failed. Error: %v", err)
 		return
@@ -159,6 +168,12 @@ func (service *Service) extractMetadata() (err error) {
 		log.Error("Deserialize metadata failed. Error: %v", err)
 		return
 	}
+	if status, _ := dict["Status"].(string); status != "200" {
+		reason, _ := dict["Error"].(string)
+		err = fmt.Errorf("status %s: %s", status, reason)
+		log.Error("Rejected by the server. Error: %v", err)
+		return
+	}
 
 	service.RAddr, err = net.ResolveUDPAddr(dict["RNetwork"].(string), fmt.Sprintf("%s:%s", dict["RAddr"].(string), dict["RPort"].(string)))
 	if err != nil {
@@ -180,6 +195,21 @@ func (service *Service) extractMetadata() (err error) {
 	}
 	service.FSMType = dict["FSMType"].(string)
 	service.SecretKey = []byte(dict["SecretKey"].(string)) // tunnel secret key
+	service.KCPConfig = KCPConfig
+	if kcpProfile, ok := dict["KCPProfile"].(string); ok {
+		service.KCPConfig, err = conn.ParseKCPConfig(kcpProfile)
+		if err != nil {
+			log.Error("Extract kcp profile failed. Error: %v", err)
+			return
+		}
+	}
+	kcpCrypt, _ := dict["KCPCrypt"].(string)
+	service.KCPConfig, err = service.KCPConfig.WithCrypt(kcpCrypt, service.SecretKey)
+	if err != nil {
+		log.Error("Create kcp crypt failed. Error: %v", err)
+		return
+	}
+	service.TunnelEncrypt, _ = dict["TunnelEncrypt"].(bool)
 	return
 }
 
@@ -197,13 +227,15 @@ func (service *Service) udpHolePunching() (err error) {
 		err = errors.New("unsupported FSM type")
 		return
 	}
-	fsm := fsmFn(service.LAddr, service.RAddr)
+	fsm := fsmFn(service.LAddr, service.RAddr, service.KCPConfig)
 	if fsm == nil {
 		log.Error("Create FSM failed")
 		err = errors.New("create FSM failed")
 		return
 	}
-	if fsm.Run(1) != 0 {
+	ok := fsm.Run(1) == 0
+	metrics.P2PFSMRuns.With(service.FSMType, metrics.P2PResult(ok)).Inc()
+	if !ok {
 		log.Error("Run FSM failed")
 		err = errors.New("run FSM failed")
 		return
@@ -224,15 +256,22 @@ func (service *Service) tunnel() {
 	}
 	defer closeFn(tunnel)
 	defer closeFn(proxy)
-	if !tunnel2.ClientTunnelSafetyCheck(tunnel, service.SecretKey) {
-		log.Error("Tunnel safety check failed")
+	// the proxy takes the server side of the p2p tunnel, the secret key is
+	// only used by this tunnel so there is nothing to replay
+	connID, tunnelKey, err := tunnel2.ServerTunnelSafetyCheck(tunnel, service.SecretKey, nil)
+	if err != nil {
+		log.Error("Tunnel safety check failed. Error: %v", err)
+		metrics.SafetyCheckFailures.With("", service.Name).Inc()
 		return
 	}
+	metrics.TunnelsCreated.With("", service.Name).Inc()
+	log.Debug("Tunnel %s is established", connID)
+	proxy = tunnel2.NewCountedSocket(proxy, tunnel2.ServiceStats("", service.Name))
 	if !service.TunnelEncrypt {
 		tunnel2.UnsafeTunnel(proxy, tunnel)
 		return
 	} else {
-		tunnel2.SafeTunnel(proxy, tunnel, service.SecretKey)
+		tunnel2.SafeTunnel(proxy, tunnel, tunnelKey, tunnel2.ServerSide)
 	}
 }
 
@@ -263,12 +302,15 @@ func RegisterService(
 
 func Run() {
 	log.InitLog(LogWay, LogFile, LogLevel, LogMaxDays)
+	if MetricsAddr != "" {
+		go metrics.Serve(MetricsAddr)
+	}
 	var wait sync.WaitGroup
 	wait.Add(len(services))
 	for _, service := range services {
 		go func(service *Service) {
 			defer wait.Done()
-			listener, err := conn.NewListener(service.ProxyType, consts.Auto, service.ProxyPort)
+			listener, err := conn.NewListener(service.ProxyType, consts.Auto, service.ProxyPort, KCPConfig)
 			if err != nil {
 				log.Error("Create proxy listener failed. Error: %v", err)
 				return
@@ -279,6 +321,7 @@ func Run() {
 					log.Error("Accept connection failed. Error: %v", err)
 					continue
 				}
+				metrics.ConnectionsAccepted.With("", service.Name).Inc()
 				service.ProxySocket = socket
 				go service.run()
 			}
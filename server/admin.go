@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	tunnel2 "pTunnel/tunnel"
+	"pTunnel/utils/log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin http api, every request needs the header
+// "Authorization: Bearer <AdminToken>" or the cookie of a dashboard login,
+// which may only GET unless the dashboard is writable:
+//
+//	GET    /api/clients            the connected clients and their heartbeats
+//	GET    /api/services           the running services
+//	DELETE /api/services/{id}      stop a service, its client is told so
+//	GET    /api/connections        the forwarded connections, ?service={id} to filter
+//	DELETE /api/connections/{id}   close a connection
+//	GET    /api/p2p                the latest p2p pairings and their results
+
+type clientInfo struct {
+	Client           string // the identity of the client
+	ClientAddr       string
+	StartTime        time.Time
+	Uptime           int64 // seconds
+	LastHeartbeat    time.Time
+	HeartbeatAge     int64  // seconds since the last heartbeat
+	HeartbeatTimeout int    // seconds
+	Heartbeat        string // ok, or late once a heartbeat has been missed
+	Services         int
+}
+
+type serviceInfo struct {
+	ID            uint64
+	Name          string
+	Client        string // the identity of the client
+	ClientAddr    string
+	ExternalType  string
+	ExternalPort  int
+	TunnelType    string
+	TunnelPort    int
+	TunnelEncrypt bool
+	TunnelMux     bool
+	PoolSize      int
+	StartTime     time.Time
+	Uptime        int64 // seconds
+	Connections   int
+	BytesIn       int64 // from the external users, since the first start of the service of the client
+	BytesOut      int64 // to the external users
+}
+
+type connectionInfo struct {
+	ID          uint64
+	ConnID      string
+	ServiceID   uint64
+	Service     string
+	Client      string
+	RequestAddr string // the address of the external user
+	TunnelAddr  string // the address of the tunnel on the client side
+	StartTime   time.Time
+	Uptime      int64 // seconds
+	BytesIn     int64 // from the external user
+	BytesOut    int64 // to the external user
+}
+
+func newClientInfo(session *Session) clientInfo {
+	age := time.Since(session.LastHeartbeat())
+	heartbeat := "ok"
+	// the client sends a heartbeat every half of HeartbeatTimeout
+	if age > time.Duration(HeartbeatTimeout)*time.Second*3/4 {
+		heartbeat = "late"
+	}
+	return clientInfo{
+		Client:           session.Identity,
+		ClientAddr:       session.ControlSocket.RemoteAddr().String(),
+		StartTime:        session.StartTime,
+		Uptime:           int64(time.Since(session.StartTime).Seconds()),
+		LastHeartbeat:    session.LastHeartbeat(),
+		HeartbeatAge:     int64(age.Seconds()),
+		HeartbeatTimeout: HeartbeatTimeout,
+		Heartbeat:        heartbeat,
+		Services:         len(session.runningServices()),
+	}
+}
+
+func newServiceInfo(service *Service) serviceInfo {
+	stats := tunnel2.ServiceStats(service.Identity, service.Name)
+	return serviceInfo{
+		ID:            service.ID,
+		Name:          service.Name,
+		Client:        service.Identity,
+		ClientAddr:    service.Session.ControlSocket.RemoteAddr().String(),
+		ExternalType:  service.ExternalType,
+		ExternalPort:  service.ExternalPort,
+		TunnelType:    service.TunnelType,
+		TunnelPort:    service.TunnelPort,
+		TunnelEncrypt: service.TunnelEncrypt,
+		TunnelMux:     service.TunnelMux,
+		PoolSize:      service.PoolSize,
+		StartTime:     service.StartTime,
+		Uptime:        int64(time.Since(service.StartTime).Seconds()),
+		Connections:   len(service.activeConnections()),
+		BytesIn:       stats.In.Value(),
+		BytesOut:      stats.Out.Value(),
+	}
+}
+
+func newConnectionInfo(service *Service, connection *Connection) connectionInfo {
+	return connectionInfo{
+		ID:          connection.ID,
+		ConnID:      connection.ConnID,
+		ServiceID:   service.ID,
+		Service:     service.Name,
+		Client:      service.Identity,
+		RequestAddr: connection.Request.RemoteAddr().String(),
+		TunnelAddr:  connection.Tunnel.RemoteAddr().String(),
+		StartTime:   connection.StartTime,
+		Uptime:      int64(time.Since(connection.StartTime).Seconds()),
+		BytesIn:     connection.Stats.In.Value(),
+		BytesOut:    connection.Stats.Out.Value(),
+	}
+}
+
+// allServices returns the running services of every session ordered by id
+func allServices() []*Service {
+	var services []*Service
+	for _, session := range activeSessions() {
+		services = append(services, session.runningServices()...)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
+
+func newAdminHandler(token string, password string, readOnly bool) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/clients", listClients)
+	api.HandleFunc("GET /api/services", listServices)
+	api.HandleFunc("DELETE /api/services/{id}", stopService)
+	api.HandleFunc("GET /api/connections", listConnections)
+	api.HandleFunc("DELETE /api/connections/{id}", closeConnection)
+	api.HandleFunc("GET /api/p2p", listPairings)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		switch {
+		case token != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1:
+		case password != "" && validDashboardLogin(r):
+			if readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writeJSON(w, http.StatusForbidden, map[string]string{"Error": "the dashboard is read-only"})
+				return
+			}
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pTunnel"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"Error": "unauthorized"})
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	if password != "" {
+		handleDashboard(mux, password, readOnly)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-store")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func listClients(w http.ResponseWriter, _ *http.Request) {
+	list := make([]clientInfo, 0)
+	for _, session := range activeSessions() {
+		list = append(list, newClientInfo(session))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartTime.Before(list[j].StartTime) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func listServices(w http.ResponseWriter, _ *http.Request) {
+	list := make([]serviceInfo, 0)
+	for _, service := range allServices() {
+		list = append(list, newServiceInfo(service))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func stopService(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "invalid service id"})
+		return
+	}
+	for _, service := range allServices() {
+		if service.ID == id {
+			log.Info("Service %s of %s is stopped by the admin api", service.Name, service.Identity)
+			service.stop()
+			writeJSON(w, http.StatusOK, newServiceInfo(service))
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"Error": "service not found"})
+}
+
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	var serviceID uint64
+	if str := r.URL.Query().Get("service"); str != "" {
+		var err error
+		if serviceID, err = strconv.ParseUint(str, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "invalid service id"})
+			return
+		}
+	}
+	list := make([]connectionInfo, 0)
+	for _, service := range allServices() {
+		if serviceID != 0 && service.ID != serviceID {
+			continue
+		}
+		for _, connection := range service.activeConnections() {
+			list = append(list, newConnectionInfo(service, connection))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func closeConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "invalid connection id"})
+		return
+	}
+	for _, service := range allServices() {
+		for _, connection := range service.activeConnections() {
+			if connection.ID == id {
+				log.Info("Connection %d of service %s is closed by the admin api", id, service.Name)
+				_ = connection.Request.Close()
+				_ = connection.Tunnel.Close()
+				writeJSON(w, http.StatusOK, newConnectionInfo(service, connection))
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"Error": "connection not found"})
+}
+
+func listPairings(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, recentPairings())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Failed to write the admin api response. Error: %v", err)
+	}
+}
+
+// serveAdmin serves the admin http api and the dashboard on addr:port
+func serveAdmin(addr string, port int, token string, password string, readOnly bool) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		log.Error("Failed to create admin api listener: %v", err)
+		return
+	}
+	log.Info("Admin api started at %s", listener.Addr().String())
+	server := &http.Server{
+		Handler:           newAdminHandler(token, password, readOnly),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err = server.Serve(listener); err != nil {
+		log.Error("Admin api stopped. Error: %v", err)
+	}
+}
@@ -1,42 +1,167 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"pTunnel/conn"
+	tunnel2 "pTunnel/tunnel"
 	"pTunnel/utils/common"
-	"strconv"
+	"pTunnel/utils/security"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var (
-	PrivateKeyFile   string
-	NBitsFile        string
-	ServerType       string // tcp, tcp4, tcp6, kcp, kcp4, kcp6
-	ServerPort       int
-	LogFile          string
-	LogWay           string
-	LogLevel         string
-	LogMaxDays       int
-	HeartbeatTimeout int
-	SshPort          int    // only for ssh tunnel
-	SshUser          string // only for ssh tunnel
+	PrivateKeyFile       string // several files separated by comma, one for each active key
+	DeprecatedKeyIDs     string // the key IDs still accepted but to be retired, separated by comma
+	PrivateKeyPassphrase string // only for encrypted private keys, PTUNNEL_KEY_PASSPHRASE is used if empty
+	ServerType           string // tcp, tcp4, tcp6, kcp, kcp4, kcp6, ws4, ws6, wss4, wss6, tls4, tls6, quic4, quic6
+	ServerPort           int
+	LogFile              string
+	LogWay               string
+	LogLevel             string
+	LogMaxDays           int
+	HeartbeatTimeout     int
+	SshPort              int    // only for ssh tunnel
+	SshUser              string // only for ssh tunnel
+	SshHostKeyFiles      string // only for ssh tunnel, e.g. /etc/ssh/ssh_host_ed25519_key.pub, separated by comma
+	WSPath               string // only for ws/wss listener
+	TLSCertFile          string // only for tls/wss/quic listener
+	TLSKeyFile           string // only for tls/wss/quic listener
+	TLSALPN              string // only for tls/wss listener
+	TLSClientCAFile      string // only for tls/wss/quic listener, the clients must present a certificate issued by this CA
+	VhostHTTPPort        int    // the port shared by the services with the http external type, 0 means disabled
+	KCPProfile           string // the default kcp profile of the server and its services
+	ReplayWindow         int    // seconds, the metadata of a client is rejected if its timestamp is further away
+	UsersFile            string // the credentials and grants of the clients, empty means every client is allowed everything
+	AllowPorts           string // the ports the services may use and the random ports are chosen from, e.g. 6000-7000, 8080, empty means every port
+	ReservedPorts        string // the ports never given to a service
+	MaxPortsPerClient    int    // the external and tunnel ports a client may use at the same time, 0 means no limit
+	PortLeaseTimeout     int    // seconds, a stopped service gets its random ports back if it comes back within this time, 0 means no lease
+	RekeyBytes           int64  // a direction of a tunnel or control connection is rekeyed after so many bytes, 0 means never
+	RekeyInterval        int    // seconds, a direction of a tunnel or control connection is rekeyed after so long, 0 means never
+	AdminAddr            string // the address of the admin http api
+	AdminPort            int    // the port of the admin http api, 0 means disabled
+	AdminToken           string // the bearer token of the admin http api
+	DashboardPassword    string // the login password of the dashboard next to the admin http api, empty means disabled
+	DashboardReadOnly    bool   // the dashboard may not stop services or close connections
+	MetricsAddr          string // the address of the prometheus metrics, e.g. 127.0.0.1:9100, empty means disabled
 )
 
 var (
-	PrivateKey []byte
-	NBits      int
+	PrivateKeys []*security.ServerKey
+	KCPConfig   *conn.KCPConfig
+	ReplayCache *security.ReplayCache
+	SshHostKeys []string // the SHA256 fingerprints of SshHostKeyFiles
+	Ports       *PortTable
 )
 
 func InitConf() error {
-	privateKey, err := common.LoadFile(PrivateKeyFile)
-	if err != nil {
-		return err
+	PrivateKeys = nil
+	passphrase := PrivateKeyPassphrase
+	if passphrase == "" {
+		passphrase = os.Getenv("PTUNNEL_KEY_PASSPHRASE")
 	}
-	PrivateKey = privateKey
-	nBits, err := common.LoadFile(NBitsFile)
-	if err != nil {
-		return err
+	deprecated := make(map[string]bool)
+	for _, id := range strings.Split(DeprecatedKeyIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			deprecated[id] = true
+		}
 	}
-	NBits, err = strconv.Atoi(string(nBits))
+	for _, file := range strings.Split(PrivateKeyFile, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		privateKey, err := common.LoadFile(file)
+		if err != nil {
+			return err
+		}
+		signer, err := security.ParsePrivateKey(privateKey, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", file, err)
+		}
+		key, err := security.NewServerKey(signer)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", file, err)
+		}
+		key.Deprecated = deprecated[key.ID]
+		PrivateKeys = append(PrivateKeys, key)
+	}
+	if len(PrivateKeys) == 0 {
+		return errors.New("PrivateKeyFile is empty")
+	}
+	SshHostKeys = nil
+	for _, file := range strings.Split(SshHostKeyFiles, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		hostKey, err := common.LoadFile(file)
+		if err != nil {
+			return err
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(hostKey)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", file, err)
+		}
+		SshHostKeys = append(SshHostKeys, ssh.FingerprintSHA256(pub))
+	}
+	var err error
+	KCPConfig, err = conn.ParseKCPConfig(KCPProfile)
 	if err != nil {
 		return err
 	}
+	if ReplayWindow <= 0 {
+		return errors.New("ReplayWindow must be positive")
+	}
+	ReplayCache = security.NewReplayCache(time.Duration(ReplayWindow) * time.Second)
+
+	var allowed, reserved portRanges
+	if strings.TrimSpace(AllowPorts) != "" {
+		if allowed, err = parsePortRanges(AllowPorts); err != nil {
+			return fmt.Errorf("invalid AllowPorts: %v", err)
+		}
+	}
+	if reserved, err = parsePortRanges(ReservedPorts); err != nil {
+		return fmt.Errorf("invalid ReservedPorts: %v", err)
+	}
+	if MaxPortsPerClient < 0 || PortLeaseTimeout < 0 {
+		return errors.New("MaxPortsPerClient and PortLeaseTimeout must not be negative")
+	}
+	Ports = NewPortTable(allowed, reserved, MaxPortsPerClient, time.Duration(PortLeaseTimeout)*time.Second)
+
+	if RekeyBytes < 0 || RekeyInterval < 0 {
+		return errors.New("RekeyBytes and RekeyInterval must not be negative")
+	}
+	if AdminPort != 0 && AdminToken == "" && DashboardPassword == "" {
+		return errors.New("AdminPort needs AdminToken or DashboardPassword")
+	}
+	tunnel2.RekeyBytes = RekeyBytes
+	tunnel2.RekeyInterval = time.Duration(RekeyInterval) * time.Second
+	Users = nil
+	if UsersFile != "" {
+		Users, err = LoadUsers(UsersFile)
+		if err != nil {
+			return err
+		}
+	}
+	conn.WSPath = WSPath
+	conn.ServerTLSConfig = nil
+	if TLSClientCAFile != "" {
+		if !conn.IsTLSType(ServerType) {
+			return errors.New("TLSClientCAFile needs a tls, wss or quic ServerType")
+		}
+		if TLSCertFile == "" {
+			return errors.New("TLSClientCAFile needs TLSCertFile and TLSKeyFile")
+		}
+	}
+	if TLSCertFile != "" || TLSKeyFile != "" {
+		conn.ServerTLSConfig, err = conn.NewServerTLSConfig(TLSCertFile, TLSKeyFile, TLSALPN, TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"pTunnel/utils/log"
+	"sync"
+	"time"
+)
+
+// The dashboard is a page embedded in the binary which shows the admin api,
+// it works offline. It is served next to the api once DashboardPassword is
+// set:
+//
+//	GET    /dashboard/             the page
+//	GET    /dashboard/session      whether the browser is logged in
+//	POST   /dashboard/login        log in with the form value password
+//	POST   /dashboard/logout       log out
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	dashboardCookie       = "pTunnelDashboard"
+	dashboardLoginTimeout = 12 * time.Hour
+)
+
+var (
+	dashboardLoginsLock sync.Mutex
+	dashboardLogins     = make(map[string]time.Time) // the cookie of a login and when it expires
+	// loginLock lets one wrong password be tried at a time
+	loginLock sync.Mutex
+)
+
+func handleDashboard(mux *http.ServeMux, password string, readOnly bool) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/dashboard/", http.FileServerFS(files))
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+	mux.Handle("GET /dashboard/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		fileServer.ServeHTTP(w, r)
+	}))
+	mux.HandleFunc("GET /dashboard/session", func(w http.ResponseWriter, r *http.Request) {
+		if !validDashboardLogin(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"Error": "unauthorized"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ReadOnly": readOnly})
+	})
+	mux.HandleFunc("POST /dashboard/login", func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue("password")), []byte(password)) != 1 {
+			log.Warn("Failed dashboard login from %s", r.RemoteAddr)
+			loginLock.Lock()
+			time.Sleep(time.Second)
+			loginLock.Unlock()
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"Error": "wrong password"})
+			return
+		}
+		cookie, err := newDashboardLogin()
+		if err != nil {
+			log.Error("Failed to create dashboard login. Error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"Error": "internal error"})
+			return
+		}
+		log.Info("Dashboard login from %s", r.RemoteAddr)
+		http.SetCookie(w, &http.Cookie{
+			Name:     dashboardCookie,
+			Value:    cookie,
+			Path:     "/",
+			MaxAge:   int(dashboardLoginTimeout.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		writeJSON(w, http.StatusOK, map[string]bool{"ReadOnly": readOnly})
+	})
+	mux.HandleFunc("POST /dashboard/logout", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(dashboardCookie); err == nil {
+			dashboardLoginsLock.Lock()
+			delete(dashboardLogins, cookie.Value)
+			dashboardLoginsLock.Unlock()
+		}
+		http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/", MaxAge: -1})
+		writeJSON(w, http.StatusOK, map[string]string{})
+	})
+}
+
+func newDashboardLogin() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cookie := hex.EncodeToString(b)
+	dashboardLoginsLock.Lock()
+	defer dashboardLoginsLock.Unlock()
+	now := time.Now()
+	for c, expire := range dashboardLogins {
+		if now.After(expire) {
+			delete(dashboardLogins, c)
+		}
+	}
+	dashboardLogins[cookie] = now.Add(dashboardLoginTimeout)
+	return cookie, nil
+}
+
+// validDashboardLogin returns whether the request carries the cookie of a login
+func validDashboardLogin(r *http.Request) bool {
+	cookie, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return false
+	}
+	dashboardLoginsLock.Lock()
+	defer dashboardLoginsLock.Unlock()
+	expire, ok := dashboardLogins[cookie.Value]
+	return ok && time.Now().Before(expire)
+}
@@ -0,0 +1,319 @@
+"use strict";
+
+// The dashboard polls the admin api, which it is logged in to by a cookie.
+
+const interval = 2000;
+const samples = 150; // 5 minutes
+
+let readOnly = true;
+let timer = null;
+let selected = null; // the id of the service shown in the traffic graph, null means all
+const traffic = new Map(); // service id -> {bytesIn, bytesOut, time, rates}
+const total = [];
+
+const $ = (id) => document.getElementById(id);
+
+function formatBytes(n) {
+    const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n /= 1024;
+        i++;
+    }
+    return (i === 0 ? n.toFixed(0) : n.toFixed(1)) + " " + units[i];
+}
+
+function formatDuration(seconds) {
+    const d = Math.floor(seconds / 86400);
+    const h = Math.floor(seconds % 86400 / 3600);
+    const m = Math.floor(seconds % 3600 / 60);
+    const s = seconds % 60;
+    if (d > 0) return d + "d " + h + "h";
+    if (h > 0) return h + "h " + m + "m";
+    if (m > 0) return m + "m " + s + "s";
+    return s + "s";
+}
+
+// cell creates a table cell, the text is never parsed as html
+function cell(text, className) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    if (className) td.className = className;
+    return td;
+}
+
+function button(text, onClick) {
+    const td = document.createElement("td");
+    td.className = "write";
+    const b = document.createElement("button");
+    b.textContent = text;
+    b.addEventListener("click", (e) => {
+        e.stopPropagation();
+        onClick();
+    });
+    td.appendChild(b);
+    return td;
+}
+
+function fillTable(id, rows, columns, render) {
+    const tbody = $(id).querySelector("tbody");
+    tbody.replaceChildren();
+    if (rows.length === 0) {
+        const tr = document.createElement("tr");
+        const td = cell("none", "empty");
+        td.colSpan = columns;
+        tr.appendChild(td);
+        tbody.appendChild(tr);
+        return;
+    }
+    for (const row of rows) {
+        tbody.appendChild(render(row));
+    }
+}
+
+async function api(method, path) {
+    const response = await fetch(path, {method: method, credentials: "same-origin"});
+    if (response.status === 401) {
+        showLogin();
+        throw new Error("unauthorized");
+    }
+    const body = await response.json();
+    if (!response.ok) {
+        throw new Error(body.Error || response.statusText);
+    }
+    return body;
+}
+
+function updateTraffic(services, now) {
+    let totalIn = 0;
+    let totalOut = 0;
+    const seen = new Set();
+    for (const service of services) {
+        seen.add(service.ID);
+        let t = traffic.get(service.ID);
+        if (!t) {
+            t = {bytesIn: service.BytesIn, bytesOut: service.BytesOut, time: now, rates: []};
+            traffic.set(service.ID, t);
+        }
+        const seconds = (now - t.time) / 1000;
+        const rate = {
+            in: seconds > 0 ? Math.max(0, service.BytesIn - t.bytesIn) / seconds : 0,
+            out: seconds > 0 ? Math.max(0, service.BytesOut - t.bytesOut) / seconds : 0,
+        };
+        t.bytesIn = service.BytesIn;
+        t.bytesOut = service.BytesOut;
+        t.time = now;
+        t.rates.push(rate);
+        if (t.rates.length > samples) t.rates.shift();
+        service.rate = rate;
+        totalIn += rate.in;
+        totalOut += rate.out;
+    }
+    for (const id of traffic.keys()) {
+        if (!seen.has(id)) traffic.delete(id);
+    }
+    if (selected !== null && !traffic.has(selected)) selected = null;
+    total.push({in: totalIn, out: totalOut});
+    if (total.length > samples) total.shift();
+    $("rate-in").textContent = formatBytes(totalIn) + "/s";
+    $("rate-out").textContent = formatBytes(totalOut) + "/s";
+}
+
+function drawTraffic() {
+    const canvas = $("traffic");
+    const ratio = window.devicePixelRatio || 1;
+    canvas.width = canvas.clientWidth * ratio;
+    canvas.height = 200 * ratio;
+    const ctx = canvas.getContext("2d");
+    ctx.scale(ratio, ratio);
+    const width = canvas.clientWidth;
+    const height = 200;
+    const pad = 24;
+    const rates = selected === null ? total : traffic.get(selected).rates;
+    let max = 1024;
+    for (const r of rates) max = Math.max(max, r.in, r.out);
+
+    ctx.clearRect(0, 0, width, height);
+    ctx.strokeStyle = "#d0d7de";
+    ctx.fillStyle = "#57606a";
+    ctx.font = "11px sans-serif";
+    for (let i = 0; i <= 4; i++) {
+        const y = pad + (height - 2 * pad) * i / 4;
+        ctx.beginPath();
+        ctx.moveTo(0, y);
+        ctx.lineTo(width, y);
+        ctx.stroke();
+        ctx.fillText(formatBytes(max * (4 - i) / 4) + "/s", 4, y - 2);
+    }
+    for (const [key, color] of [["in", "#0969da"], ["out", "#1a7f37"]]) {
+        ctx.strokeStyle = color;
+        ctx.lineWidth = 2;
+        ctx.beginPath();
+        rates.forEach((r, i) => {
+            const x = width - (rates.length - 1 - i) * width / (samples - 1);
+            const y = height - pad - r[key] / max * (height - 2 * pad);
+            if (i === 0) ctx.moveTo(x, y);
+            else ctx.lineTo(x, y);
+        });
+        ctx.stroke();
+    }
+}
+
+function render(clients, services, connections, pairings) {
+    $("count-clients").textContent = clients.length;
+    $("count-services").textContent = services.length;
+    $("count-connections").textContent = connections.length;
+
+    fillTable("clients", clients, 5, (c) => {
+        const tr = document.createElement("tr");
+        tr.append(
+            cell(c.Client),
+            cell(c.ClientAddr),
+            cell(formatDuration(c.Uptime)),
+            cell(c.Heartbeat + ", " + c.HeartbeatAge + "s ago (timeout " + c.HeartbeatTimeout + "s)", c.Heartbeat),
+            cell(c.Services),
+        );
+        return tr;
+    });
+
+    fillTable("services", services, readOnly ? 9 : 10, (s) => {
+        const tr = document.createElement("tr");
+        if (s.ID === selected) tr.className = "selected";
+        tr.append(
+            cell(s.ID),
+            cell(s.Name),
+            cell(s.Client),
+            cell(s.ExternalType + ":" + s.ExternalPort),
+            cell(s.TunnelType + ":" + s.TunnelPort + (s.TunnelEncrypt ? " encrypted" : "") + (s.TunnelMux ? " mux" : "")),
+            cell(formatDuration(s.Uptime)),
+            cell(s.Connections),
+            cell(formatBytes(s.rate.in) + "/s, " + formatBytes(s.BytesIn)),
+            cell(formatBytes(s.rate.out) + "/s, " + formatBytes(s.BytesOut)),
+        );
+        if (!readOnly) {
+            tr.append(button("Stop", () => remove("/api/services/" + s.ID, "Stop service " + s.Name + " of " + s.Client + "?")));
+        }
+        tr.addEventListener("click", () => {
+            selected = selected === s.ID ? null : s.ID;
+            $("traffic-of").textContent = selected === null ? "all services" : s.Name + " of " + s.Client;
+            for (const row of tr.parentNode.children) {
+                row.classList.toggle("selected", row === tr && selected !== null);
+            }
+            drawTraffic();
+        });
+        return tr;
+    });
+
+    fillTable("connections", connections, readOnly ? 8 : 9, (c) => {
+        const tr = document.createElement("tr");
+        tr.append(
+            cell(c.ID),
+            cell(c.Service),
+            cell(c.Client),
+            cell(c.RequestAddr),
+            cell(c.TunnelAddr),
+            cell(formatDuration(c.Uptime)),
+            cell(formatBytes(c.BytesIn)),
+            cell(formatBytes(c.BytesOut)),
+        );
+        if (!readOnly) {
+            tr.append(button("Close", () => remove("/api/connections/" + c.ID, "Close connection " + c.ID + "?")));
+        }
+        return tr;
+    });
+
+    fillTable("p2p", pairings, 7, (p) => {
+        const tr = document.createElement("tr");
+        tr.append(
+            cell(new Date(p.Time).toLocaleString()),
+            cell(p.Service),
+            cell(p.Client),
+            cell(p.ProxyAddr),
+            cell(p.ProxyNAT + " / " + p.TunnelNAT),
+            cell((p.ProxyFSM || "-") + " / " + (p.TunnelFSM || "-")),
+            cell(p.Result + (p.Error ? ": " + p.Error : ""), p.Result),
+        );
+        return tr;
+    });
+
+    for (const th of document.querySelectorAll("th.write")) {
+        th.classList.toggle("hidden", readOnly);
+    }
+}
+
+async function refresh() {
+    try {
+        const [clients, services, connections, pairings] = await Promise.all([
+            api("GET", "/api/clients"),
+            api("GET", "/api/services"),
+            api("GET", "/api/connections"),
+            api("GET", "/api/p2p"),
+        ]);
+        updateTraffic(services, Date.now());
+        render(clients, services, connections, pairings);
+        drawTraffic();
+        $("status").textContent = "updated " + new Date().toLocaleTimeString() + (readOnly ? ", read-only" : "");
+    } catch (e) {
+        $("status").textContent = "update failed: " + e.message;
+    }
+}
+
+async function remove(path, question) {
+    if (!confirm(question)) return;
+    try {
+        await api("DELETE", path);
+    } catch (e) {
+        alert(e.message);
+    }
+    refresh();
+}
+
+function showLogin() {
+    clearInterval(timer);
+    timer = null;
+    $("main").classList.add("hidden");
+    $("logout").classList.add("hidden");
+    $("login").classList.remove("hidden");
+    $("status").textContent = "";
+    $("password").focus();
+}
+
+function showMain(session) {
+    readOnly = session.ReadOnly;
+    $("login").classList.add("hidden");
+    $("main").classList.remove("hidden");
+    $("logout").classList.remove("hidden");
+    refresh();
+    if (timer === null) timer = setInterval(refresh, interval);
+}
+
+$("login-form").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const response = await fetch("/dashboard/login", {
+        method: "POST",
+        body: new URLSearchParams({password: $("password").value}),
+        credentials: "same-origin",
+    });
+    const body = await response.json();
+    $("password").value = "";
+    if (!response.ok) {
+        $("login-error").textContent = body.Error || response.statusText;
+        return;
+    }
+    $("login-error").textContent = "";
+    showMain(body);
+});
+
+$("logout").addEventListener("click", async () => {
+    await fetch("/dashboard/logout", {method: "POST", credentials: "same-origin"});
+    showLogin();
+});
+
+window.addEventListener("resize", () => {
+    if (timer !== null) drawTraffic();
+});
+
+fetch("/dashboard/session", {credentials: "same-origin"}).then(async (response) => {
+    if (response.ok) showMain(await response.json());
+    else showLogin();
+}, showLogin);
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// p2pPairing is a proxy and a client paired by a p2p service for UDP hole
+// punching, the client reports the result once its FSM has run
+type p2pPairing struct {
+	ID         uint64
+	ServiceID  uint64
+	Service    string
+	Client     string
+	ProxyAddr  string
+	TunnelAddr string // the address of the client
+	ProxyNAT   int
+	TunnelNAT  int
+	ProxyFSM   string
+	TunnelFSM  string
+	Time       time.Time
+	Result     string // pending, success, failure or unsupported
+	Error      string
+}
+
+// maxPairings is the number of the latest pairings kept for the admin api
+const maxPairings = 200
+
+var (
+	pairingsLock sync.Mutex
+	pairings     []*p2pPairing // oldest first
+)
+
+func addPairing(pairing *p2pPairing) {
+	pairingsLock.Lock()
+	defer pairingsLock.Unlock()
+	pairings = append(pairings, pairing)
+	if len(pairings) > maxPairings {
+		pairings = append([]*p2pPairing(nil), pairings[len(pairings)-maxPairings:]...)
+	}
+}
+
+// finishPairing records the result reported by the client of a pending
+// pairing, it returns false if there is no such pairing
+func finishPairing(client string, service string, id uint64, result string, reason string) bool {
+	pairingsLock.Lock()
+	defer pairingsLock.Unlock()
+	for _, pairing := range pairings {
+		if pairing.ID == id && pairing.Client == client && pairing.Service == service && pairing.Result == "pending" {
+			pairing.Result = result
+			pairing.Error = reason
+			return true
+		}
+	}
+	return false
+}
+
+// recentPairings returns copies of the latest pairings, newest first
+func recentPairings() []p2pPairing {
+	pairingsLock.Lock()
+	defer pairingsLock.Unlock()
+	list := make([]p2pPairing, 0, len(pairings))
+	for i := len(pairings) - 1; i >= 0; i-- {
+		list = append(list, *pairings[i])
+	}
+	return list
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"pTunnel/conn"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errPortConflict = errors.New("port conflict")
+
+// the number of random ports tried before giving up
+const portAllocateAttempts = 32
+
+// portLease remembers the port a service of a client was given, so that the
+// client gets the same port back when it reconnects within the lease period
+type portLease struct {
+	client  string // the identity of the client, MaxPortsPerClient counts its ports
+	owner   string // the owner of the lease, see Session.Owner
+	port    int
+	active  bool      // the service is still using the port
+	expires time.Time // only meaningful if the lease is not active
+}
+
+// PortTable applies the port policy of the server to the external and tunnel
+// listeners of the services and keeps their leases, it is keyed by the owner
+// of the lease, the service name and the kind of the port
+type PortTable struct {
+	allowed      portRanges // nil means every port
+	reserved     portRanges
+	maxPerClient int // 0 means no limit
+	leaseTimeout time.Duration
+	lock         sync.Mutex
+	leases       map[string]*portLease
+}
+
+func NewPortTable(allowed portRanges, reserved portRanges, maxPerClient int, leaseTimeout time.Duration) *PortTable {
+	return &PortTable{
+		allowed:      allowed,
+		reserved:     reserved,
+		maxPerClient: maxPerClient,
+		leaseTimeout: leaseTimeout,
+		leases:       make(map[string]*portLease),
+	}
+}
+
+func leaseKey(owner string, name string, kind string) string {
+	return owner + "\x00" + name + "\x00" + kind
+}
+
+// listen binds the port of the given kind ("External" or "Tunnel") of a
+// service with bind. A port of 0 is taken from the lease of the service if
+// there is one, or chosen within the allowed ports otherwise.
+func (table *PortTable) listen(client string, owner string, name string, kind string, port int, bind func(port int) (conn.Listener, error)) (conn.Listener, int, error) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.expire()
+
+	key := leaseKey(owner, name, kind)
+	if lease, ok := table.leases[key]; ok && lease.active {
+		return nil, 0, fmt.Errorf("%w: service %s of %s is already running", errPortConflict, name, client)
+	}
+	if table.maxPerClient > 0 && table.activePorts(client) >= table.maxPerClient {
+		return nil, 0, fmt.Errorf("%w: %s already uses %d ports", errForbidden, client, table.maxPerClient)
+	}
+
+	var listener conn.Listener
+	var err error
+	if port != 0 {
+		if err = table.check(key, port); err != nil {
+			return nil, 0, err
+		}
+		listener, err = bind(port)
+	} else {
+		listener, port, err = table.allocate(key, bind)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	table.leases[key] = &portLease{client: client, owner: owner, port: port, active: true}
+	return listener, port, nil
+}
+
+// release starts the lease period of the port of a service that has stopped,
+// or forgets the port if keep is false
+func (table *PortTable) release(owner string, name string, kind string, keep bool) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	key := leaseKey(owner, name, kind)
+	lease, ok := table.leases[key]
+	if !ok || !lease.active {
+		return
+	}
+	if !keep || table.leaseTimeout <= 0 {
+		delete(table.leases, key)
+		return
+	}
+	lease.active = false
+	lease.expires = time.Now().Add(table.leaseTimeout)
+}
+
+// check tells whether the service with key may bind port
+func (table *PortTable) check(key string, port int) error {
+	if table.allowed != nil && !table.allowed.contains(port) {
+		return fmt.Errorf("%w: port %d is not allowed by the server", errForbidden, port)
+	}
+	if table.reserved.contains(port) {
+		return fmt.Errorf("%w: port %d is reserved by the server", errForbidden, port)
+	}
+	for k, lease := range table.leases {
+		if k != key && lease.port == port {
+			return fmt.Errorf("%w: port %d is leased to another service", errPortConflict, port)
+		}
+	}
+	return nil
+}
+
+// allocate binds the leased port of key if it is still free and allowed, or a
+// random port
+func (table *PortTable) allocate(key string, bind func(port int) (conn.Listener, error)) (conn.Listener, int, error) {
+	// the policy may have changed since the port was leased
+	if lease, ok := table.leases[key]; ok && table.check(key, lease.port) == nil {
+		if listener, err := bind(lease.port); err == nil {
+			return listener, lease.port, nil
+		}
+	}
+	if table.allowed == nil && table.reserved == nil {
+		// let the system choose, the leases are only checked afterwards
+		for i := 0; i < portAllocateAttempts; i++ {
+			listener, err := bind(0)
+			if err != nil {
+				return nil, 0, err
+			}
+			port, err := listenerPort(listener)
+			if err == nil && table.check(key, port) == nil {
+				return listener, port, nil
+			}
+			_ = listener.Close()
+		}
+		return nil, 0, fmt.Errorf("%w: no free port", errPortConflict)
+	}
+	candidates := table.allowed
+	if candidates == nil {
+		candidates = portRanges{{1024, 65535}}
+	}
+	size := 0
+	for _, r := range candidates {
+		size += r.high - r.low + 1
+	}
+	for i := 0; i < portAllocateAttempts && size > 0; i++ {
+		port := candidates.nth(rand.Intn(size))
+		if port == 0 || table.check(key, port) != nil {
+			continue
+		}
+		if listener, err := bind(port); err == nil {
+			return listener, port, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: no free port within the allowed ports", errPortConflict)
+}
+
+// activePorts counts the ports used by the running services of client
+func (table *PortTable) activePorts(client string) int {
+	n := 0
+	for _, lease := range table.leases {
+		if lease.client == client && lease.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (table *PortTable) expire() {
+	now := time.Now()
+	for key, lease := range table.leases {
+		if !lease.active && now.After(lease.expires) {
+			delete(table.leases, key)
+		}
+	}
+}
+
+// nth returns the nth port of the ranges
+func (ranges portRanges) nth(n int) int {
+	for _, r := range ranges {
+		if n <= r.high-r.low {
+			return r.low + n
+		}
+		n -= r.high - r.low + 1
+	}
+	return 0
+}
+
+// listenerPort returns the port a listener is bound to
+func listenerPort(listener conn.Listener) (int, error) {
+	address := strings.Split(listener.Address().String(), ":")
+	return strconv.Atoi(address[len(address)-1])
+}
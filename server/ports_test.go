@@ -0,0 +1,182 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"pTunnel/conn"
+	"testing"
+	"time"
+)
+
+// fakeListener is the listener returned by fakeBind, nothing is bound
+type fakeListener struct {
+	port int
+}
+
+func (listener *fakeListener) Close() error                 { return nil }
+func (listener *fakeListener) Accept() (conn.Socket, error) { return nil, errors.New("fake listener") }
+func (listener *fakeListener) Network() string              { return "tcp" }
+func (listener *fakeListener) Address() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero, Port: listener.port}
+}
+
+// fakeBind binds every port except the busy ones, port 0 gets the next
+// system port
+func fakeBind(busy ...int) func(port int) (conn.Listener, error) {
+	system := 40000
+	isBusy := func(port int) bool {
+		for _, p := range busy {
+			if p == port {
+				return true
+			}
+		}
+		return false
+	}
+	return func(port int) (conn.Listener, error) {
+		if port == 0 {
+			for system++; isBusy(system); system++ {
+			}
+			port = system
+		}
+		if isBusy(port) {
+			return nil, errors.New("address already in use")
+		}
+		return &fakeListener{port: port}, nil
+	}
+}
+
+func mustPortRanges(t *testing.T, str string) portRanges {
+	t.Helper()
+	ranges, err := parsePortRanges(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ranges
+}
+
+func TestPortTablePolicy(t *testing.T) {
+	allowed := mustPortRanges(t, "10000-10009,20000")
+	reserved := mustPortRanges(t, "10005")
+	tests := []struct {
+		name string
+		port int
+		err  error
+	}{
+		{"allowed", 10001, nil},
+		{"allowed single port", 20000, nil},
+		{"not allowed", 30000, errForbidden},
+		{"reserved", 10005, errForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewPortTable(allowed, reserved, 0, time.Minute)
+			_, port, err := table.listen("alice", "alice", "web", "External", tt.port, fakeBind())
+			if !errors.Is(err, tt.err) || (err == nil && port != tt.port) {
+				t.Fatalf("got port %d and %v, want %v", port, err, tt.err)
+			}
+		})
+	}
+
+	t.Run("random port", func(t *testing.T) {
+		table := NewPortTable(mustPortRanges(t, "10000-10001"), mustPortRanges(t, "10000"), 0, time.Minute)
+		for i := 0; i < 10; i++ {
+			_, port, err := table.listen("alice", "alice", "web", "External", 0, fakeBind())
+			if err != nil || port != 10001 {
+				t.Fatalf("got port %d and %v, want 10001", port, err)
+			}
+			table.release("alice", "web", "External", false)
+		}
+	})
+}
+
+func TestPortTableMaxPortsPerClient(t *testing.T) {
+	table := NewPortTable(nil, nil, 2, time.Minute)
+	if _, _, err := table.listen("alice", "alice", "web", "External", 0, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.listen("alice", "alice", "web", "Tunnel", 0, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.listen("alice", "alice", "ssh", "External", 0, fakeBind()); !errors.Is(err, errForbidden) {
+		t.Fatalf("got %v, want errForbidden", err)
+	}
+	// the limit is per client, and anonymous sessions of one client share it
+	if _, _, err := table.listen("bob", "bob#1", "ssh", "External", 0, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.listen("bob", "bob#2", "ssh", "External", 0, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.listen("bob", "bob#3", "ssh", "External", 0, fakeBind()); !errors.Is(err, errForbidden) {
+		t.Fatalf("got %v, want errForbidden", err)
+	}
+	// a released port does not count
+	table.release("alice", "web", "Tunnel", true)
+	if _, _, err := table.listen("alice", "alice", "ssh", "External", 0, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPortTableLease(t *testing.T) {
+	table := NewPortTable(nil, nil, 0, time.Minute)
+	_, port, err := table.listen("alice", "alice", "web", "External", 0, fakeBind())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// active lease
+	if _, _, err = table.listen("alice", "alice", "web", "External", 0, fakeBind()); !errors.Is(err, errPortConflict) {
+		t.Fatalf("got %v, want errPortConflict", err)
+	}
+	if _, _, err = table.listen("bob", "bob", "web", "External", port, fakeBind()); !errors.Is(err, errPortConflict) {
+		t.Fatalf("got %v, want errPortConflict", err)
+	}
+
+	// reuse within the lease period, another service may not take the port
+	table.release("alice", "web", "External", true)
+	if _, _, err = table.listen("bob", "bob", "web", "External", port, fakeBind()); !errors.Is(err, errPortConflict) {
+		t.Fatalf("got %v, want errPortConflict", err)
+	}
+	_, leased, err := table.listen("alice", "alice", "web", "External", 0, fakeBind())
+	if err != nil || leased != port {
+		t.Fatalf("got port %d and %v, want the leased port %d", leased, err, port)
+	}
+
+	// a leased port which is busy is given up for a new one
+	table.release("alice", "web", "External", true)
+	_, other, err := table.listen("alice", "alice", "web", "External", 0, fakeBind(port))
+	if err != nil || other == port {
+		t.Fatalf("got port %d and %v, want a port other than %d", other, err, port)
+	}
+
+	// expiry
+	table.release("alice", "web", "External", true)
+	table.leases[leaseKey("alice", "web", "External")].expires = time.Now().Add(-time.Second)
+	if _, _, err = table.listen("bob", "bob", "web", "External", other, fakeBind()); err != nil {
+		t.Fatalf("the port of an expired lease is not free: %v", err)
+	}
+	if _, ok := table.leases[leaseKey("alice", "web", "External")]; ok {
+		t.Fatal("an expired lease is kept")
+	}
+
+	// no lease is kept for a session without a lasting identity
+	table.release("bob", "web", "External", false)
+	if len(table.leases) != 0 {
+		t.Fatalf("%d leases are kept, want 0", len(table.leases))
+	}
+}
+
+func TestPortTableLeasePolicy(t *testing.T) {
+	table := NewPortTable(mustPortRanges(t, "10000-10001"), nil, 0, time.Minute)
+	if _, _, err := table.listen("alice", "alice", "web", "External", 10000, fakeBind()); err != nil {
+		t.Fatal(err)
+	}
+	table.release("alice", "web", "External", true)
+
+	// the server has reserved the leased port since
+	table.reserved = mustPortRanges(t, "10000")
+	_, port, err := table.listen("alice", "alice", "web", "External", 0, fakeBind())
+	if err != nil || port != 10001 {
+		t.Fatalf("got port %d and %v, want 10001", port, err)
+	}
+}
@@ -1,77 +1,119 @@
 package server
 
 import (
+	"crypto/hmac"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"pTunnel/conn"
 	tunnel2 "pTunnel/tunnel"
 	"pTunnel/utils/consts"
 	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
 	"pTunnel/utils/security"
 	"pTunnel/utils/serialize"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Service struct {
-	ControlSocket    conn.Socket
-	SecretKey        []byte
+	ID               uint64
+	StartTime        time.Time
+	Session          *Session
+	SecretKey        []byte // derived from the key of the session for this service
+	User             *User  // nil if UsersFile is not set
+	Name             string // the service name in the client config
+	Identity         string // the user, the certificate or the address of the client, the owner of the port leases
 	ExternalPort     int
 	ExternalType     string
 	ExternalListener conn.Listener
 	TunnelEncrypt    bool
+	TunnelMux        bool
+	PoolSize         int
+	PoolIdleTimeout  int
 	TunnelType       string
 	TunnelPort       int
 	TunnelListener   conn.Listener
+	CustomDomains    []string // only for http external type
+	KCPConfig        *conn.KCPConfig
+	KCPCrypt         string
+	TunnelKCPConfig  *conn.KCPConfig // KCPConfig with KCPCrypt, only for kcp tunnel
 
 	SshPort int    // only for ssh tunnel
 	SshUser string // only for ssh tunnel
 
-	ControlMsgChan chan int
-	WorkerChan     chan *map[string]interface{}
-	RequestChan    chan *map[string]interface{}
-}
+	WorkerChan  chan *map[string]interface{}
+	RequestChan chan *map[string]interface{}
+	Done        chan struct{}
+	stopOnce    sync.Once
 
-func (service *Service) run() {
-	log.Info("Start a new go routine to handle the connection from %s to %s", service.ControlSocket.RemoteAddr(), service.ControlSocket.LocalAddr())
-	defer func(ControlSocket conn.Socket) {
-		_ = ControlSocket.Close()
-	}(service.ControlSocket)
+	connsLock   sync.Mutex
+	connections map[uint64]*Connection
+}
 
-	// Extract metadata
-	if service.extractMetadata() != nil {
-		return
-	}
+// Connection is a request of a service forwarded through a tunnel
+type Connection struct {
+	ID        uint64
+	ConnID    string // the id of the tunnel in the safety check
+	Request   conn.Socket
+	Tunnel    conn.Socket
+	StartTime time.Time
+	Stats     *tunnel2.Stats
+}
 
-	// Create a new external listener
-	if service.createExternalListener() != nil {
-		return
-	}
+// newService creates the service named name of session from the metadata sent by the client
+func newService(session *Session, name string, dict map[string]interface{}) (*Service, error) {
+	secretKey, err := security.DeriveKey(session.SecretKey, "pTunnel service key "+name, 32)
+	if err != nil {
+		return nil, err
+	}
+	service := &Service{
+		ID:          nextID.Add(1),
+		StartTime:   time.Now(),
+		Session:     session,
+		SecretKey:   secretKey,
+		User:        session.User,
+		Name:        name,
+		Identity:    session.Identity,
+		WorkerChan:  make(chan *map[string]interface{}, 100),
+		RequestChan: make(chan *map[string]interface{}, 100),
+		Done:        make(chan struct{}),
+		connections: make(map[uint64]*Connection),
+	}
+	if err = service.extractMetadata(dict); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
 
-	// Create a new tunnel listener
-	if service.createTunnelListener() != nil {
-		return
+// listen creates the external and the tunnel listener of the service
+func (service *Service) listen() error {
+	if err := service.createExternalListener(); err != nil {
+		return err
 	}
-
-	// Send the metadata to the client
-	if service.sendMetadataToClient() != nil {
-		return
+	if err := service.createTunnelListener(); err != nil {
+		_ = service.ExternalListener.Close()
+		service.releasePorts()
+		return err
 	}
+	return nil
+}
 
-	service.ControlMsgChan = make(chan int, 100)
-	service.WorkerChan = make(chan *map[string]interface{}, 100)
-	service.RequestChan = make(chan *map[string]interface{}, 100)
-
-	// Start a new goroutine to listen to the control message from the client
-	go service.controlMsgReader()
-
-	// Start a new goroutine to send control message to the client
-	go service.controlMsgSender()
+func (service *Service) run() {
+	defer service.Session.serviceStopped(service)
+	log.Info(
+		"Service %s of %s(EP: %d, ET: %s, TP: %d, TT: %s) is running",
+		service.Name, service.Identity,
+		service.ExternalPort, service.ExternalType,
+		service.TunnelPort, service.TunnelType,
+	)
 
 	switch strings.ToLower(service.ExternalType) {
 	case "p2p", "p2p4", "p2p6":
-		go service.p2pTunnelListener()
-		service.p2pRequestProcessor()
+		go service.p2pRequestProcessor()
+		service.p2pTunnelListener()
 	default:
 		// Start a new goroutine to:
 		// 1. accept socket from the tunnel
@@ -84,39 +126,87 @@ func (service *Service) run() {
 		// 3. start a new goroutine to forward data between worker and request
 		go service.requestProcessor()
 
+		// Start a new goroutine to expire idle pooled workers
+		if service.PoolSize > 0 && service.PoolIdleTimeout > 0 {
+			go service.poolSweeper()
+		}
+
 		// 1. Listen and accept new connections from the ExternalListener
 		// 2. add it to RequestChan
-		// 3. add a CreateTunnel signal to ControlMsgChan
+		// 3. send a CreateTunnel message to the client
 		service.serverListener()
 	}
 }
 
-func (service *Service) extractMetadata() (err error) {
-	bytes, err := service.ControlSocket.ReadLine()
+// stop closes the listeners of the service, the waiting requests and workers,
+// and starts the lease period of its ports
+func (service *Service) stop() {
+	service.stopOnce.Do(func() {
+		close(service.Done)
+		_ = service.ExternalListener.Close()
+		_ = service.TunnelListener.Close()
+		service.releasePorts()
+		for _, ch := range []chan *map[string]interface{}{service.RequestChan, service.WorkerChan} {
+			for n := len(ch); n > 0; n-- {
+				item := <-ch
+				_ = (*item)["Socket"].(conn.Socket).Close()
+			}
+		}
+	})
+}
+
+// createTunnel asks the client for a new tunnel of the service
+func (service *Service) createTunnel() {
+	service.Session.send(map[string]interface{}{"Service": service.Name}, consts.CreateTunnel)
+}
+
+func (service *Service) extractMetadata(dict map[string]interface{}) (err error) {
+	externalPort, _ := dict["ExternalPort"].(string)
+	service.ExternalPort, err = strconv.Atoi(externalPort)
 	if err != nil {
-		log.Error("Failed to read metadata from the client. Error: %v", err)
+		log.Error("Failed to convert ExternalPort to int. Error: %v", err)
 		return
 	}
-	bytes, err = security.RSADecryptBase64(bytes, PrivateKey, NBits)
-	if err != nil {
-		log.Error("Failed to decrypt metadata from the client. Error: %v", err)
-		return
+	service.ExternalType, _ = dict["ExternalType"].(string)
+	service.TunnelEncrypt, _ = dict["TunnelEncrypt"].(bool)
+	service.TunnelType, _ = dict["TunnelType"].(string)
+	service.TunnelMux, _ = dict["TunnelMux"].(bool)
+	if strings.HasPrefix(strings.ToLower(service.TunnelType), "p2p") {
+		service.TunnelMux = false
 	}
-	dict := make(map[string]interface{})
-	err = serialize.Deserialize(bytes, &dict)
-	if err != nil {
-		log.Error("Failed to deserialize metadata from the client. Error: %v", err)
-		return
+	if poolSize, ok := dict["PoolSize"].(string); ok {
+		service.PoolSize, err = strconv.Atoi(poolSize)
+		if err != nil {
+			log.Error("Failed to convert PoolSize to int. Error: %v", err)
+			return
+		}
 	}
-	service.SecretKey = []byte(dict["SecretKey"].(string))
-	service.ExternalPort, err = strconv.Atoi(dict["ExternalPort"].(string))
+	if poolIdleTimeout, ok := dict["PoolIdleTimeout"].(string); ok {
+		service.PoolIdleTimeout, err = strconv.Atoi(poolIdleTimeout)
+		if err != nil {
+			log.Error("Failed to convert PoolIdleTimeout to int. Error: %v", err)
+			return
+		}
+	}
+	// the client may ask for its own kcp profile, the server default is used otherwise
+	service.KCPConfig = KCPConfig
+	if kcpProfile, ok := dict["KCPProfile"].(string); ok && kcpProfile != "" {
+		service.KCPConfig, err = conn.ParseKCPConfig(kcpProfile)
+		if err != nil {
+			log.Error("Failed to parse KCPProfile. Error: %v", err)
+			return
+		}
+	}
+	service.KCPCrypt, _ = dict["KCPCrypt"].(string)
+	service.TunnelKCPConfig, err = service.KCPConfig.WithCrypt(service.KCPCrypt, service.SecretKey)
 	if err != nil {
-		log.Error("Failed to convert ExternalPort to int. Error: %v", err)
+		log.Error("Failed to create kcp crypt. Error: %v", err)
 		return
 	}
-	service.ExternalType = dict["ExternalType"].(string)
-	service.TunnelEncrypt = dict["TunnelEncrypt"].(bool)
-	service.TunnelType = dict["TunnelType"].(string)
+	service.KCPCrypt = service.TunnelKCPConfig.Crypt
+	if customDomains, ok := dict["CustomDomains"].(string); ok {
+		service.CustomDomains = parseDomains(customDomains)
+	}
 	TunnelPort, ok := dict["TunnelPort"].(string)
 	if !ok {
 		TunnelPort = "0"
@@ -135,17 +225,35 @@ func (service *Service) extractMetadata() (err error) {
 		service.SshPort = SshPort
 		service.SshUser = SshUser
 	}
+	if err = service.User.authorize(service); err != nil {
+		log.Error("Rejected the service %s of %s. Error: %v", service.Name, service.Identity, err)
+	}
 	return
 }
 
 func (service *Service) createExternalListener() (err error) {
+	bind := func(lType string) {
+		service.ExternalListener, service.ExternalPort, err = Ports.listen(
+			service.Identity, service.Session.Owner, service.Name, "External", service.ExternalPort,
+			func(port int) (conn.Listener, error) {
+				return conn.NewListener(lType, consts.Auto, port, service.KCPConfig)
+			},
+		)
+	}
 	switch strings.ToLower(service.ExternalType) {
-	case "tcp4", "tcp6":
-		service.ExternalListener, err = conn.NewListener(service.ExternalType, consts.Auto, service.ExternalPort)
+	case "tcp4", "tcp6", "ws4", "ws6", "wss4", "wss6", "udp4", "udp6":
+		bind(service.ExternalType)
+	case "http":
+		if router == nil {
+			err = errors.New("VhostHTTPPort is not set")
+			break
+		}
+		service.ExternalPort = VhostHTTPPort
+		service.ExternalListener, err = router.register(service.CustomDomains)
 	case "p2p4":
-		service.ExternalListener, err = conn.NewListener("kcp4", consts.Auto, service.ExternalPort)
+		bind("kcp4")
 	case "p2p6":
-		service.ExternalListener, err = conn.NewListener("kcp6", consts.Auto, service.ExternalPort)
+		bind("kcp6")
 	default:
 		err = errors.New("unsupported ExternalType")
 	}
@@ -157,167 +265,297 @@ func (service *Service) createExternalListener() (err error) {
 
 func (service *Service) createTunnelListener() (err error) {
 	switch strings.ToLower(service.TunnelType) {
-	case "tcp", "tcp4", "tcp6", "kcp", "kcp4", "kcp6", "ssh", "ssh4", "ssh6":
-		service.TunnelListener, err = conn.NewListener(service.TunnelType, "[auto]", service.TunnelPort)
+	case "tcp", "tcp4", "tcp6", "kcp", "kcp4", "kcp6", "ssh", "ssh4", "ssh6", "ws4", "ws6", "wss4", "wss6", "tls4", "tls6", "quic4", "quic6":
+		service.TunnelListener, service.TunnelPort, err = Ports.listen(
+			service.Identity, service.Session.Owner, service.Name, "Tunnel", service.TunnelPort,
+			func(port int) (conn.Listener, error) {
+				return conn.NewListener(service.TunnelType, consts.Auto, port, service.TunnelKCPConfig)
+			},
+		)
 	case "p2p", "p2p4", "p2p6":
 		service.TunnelListener = service.ExternalListener
+		service.TunnelPort = service.ExternalPort
 	default:
 		err = errors.New("unsupported TunnelType")
 	}
 	if err != nil {
 		log.Error("Failed to create tunnel listener. Error: %v", err)
-	} else {
-		address := strings.Split(service.TunnelListener.Address().String(), ":")
-		service.TunnelPort, err = strconv.Atoi(address[len(address)-1])
-		if err != nil {
-			log.Error("Failed to convert TunnelPort to int. Error: %v", err)
-		}
 	}
 	return
 }
 
-func (service *Service) sendMetadataToClient() (err error) {
+// releasePorts starts the lease period of the ports of the service, the
+// ports of an anonymous client are not leased because its next session is
+// another owner
+func (service *Service) releasePorts() {
+	Ports.release(service.Session.Owner, service.Name, "External", !service.Session.anonymous)
+	Ports.release(service.Session.Owner, service.Name, "Tunnel", !service.Session.anonymous)
+}
+
+// reply is the metadata of the registered service sent to the client
+func (service *Service) reply() map[string]interface{} {
 	dict := make(map[string]interface{})
+	dict["Service"] = service.Name
 	dict["Status"] = strconv.Itoa(200)
+	dict["ExternalPort"] = strconv.Itoa(service.ExternalPort)
 	dict["TunnelPort"] = strconv.Itoa(service.TunnelPort)
 	dict["SshPort"] = strconv.Itoa(service.SshPort)
 	dict["SshUser"] = service.SshUser
-	dict["HeartbeatTimeout"] = strconv.Itoa(HeartbeatTimeout)
-	bytes, err := serialize.Serialize(&dict)
+	if service.SshPort != 0 {
+		dict["SshHostKeys"] = strings.Join(SshHostKeys, ",")
+	}
+	dict["KCPProfile"] = service.KCPConfig.String()
+	dict["KCPCrypt"] = service.KCPCrypt
+	return dict
+}
+
+// handshake agrees on a session key with the peer of socket
+func handshake(socket conn.Socket) ([]byte, error) {
+	secretKey, key, err := security.ServerHandshake(socket, PrivateKeys)
 	if err != nil {
-		log.Error("Failed to serialize metadata. Error: %v", err)
-		return
+		return nil, err
+	}
+	if key.Deprecated {
+		log.Warn("%s is still using the deprecated key %s", socket.RemoteAddr(), key.ID)
+	}
+	return secretKey, nil
+}
+
+// portStatus is the status sent to the client when its ports cannot be bound
+func portStatus(err error) int {
+	if errors.Is(err, errForbidden) {
+		return 403
 	}
-	bytes, err = security.AESEncryptBase64(bytes, service.SecretKey)
+	if errors.Is(err, errPortConflict) {
+		return 409
+	}
+	return 500
+}
+
+// sendError writes a reply with status and the reason of the rejection
+func sendError(socket conn.Socket, secretKey []byte, status int, reason error) error {
+	dict := make(map[string]interface{})
+	dict["Status"] = strconv.Itoa(status)
+	dict["Error"] = reason.Error()
+	bytes, err := serialize.Serialize(&dict)
 	if err != nil {
-		log.Error("Failed to encrypt metadata. Error: %v", err)
-		return
+		return err
 	}
-	err = service.ControlSocket.WriteLine(bytes)
+	bytes, err = security.AEADEncryptBase64(bytes, secretKey)
 	if err != nil {
-		log.Error("Failed to send metadata to the client. Error: %v", err)
+		return err
 	}
-	return
+	return socket.WriteLine(bytes)
+}
+
+// checkReplay rejects metadata that has been seen before or is too old
+func checkReplay(dict map[string]interface{}) error {
+	nonce, _ := dict["Nonce"].(string)
+	timestamp, _ := dict["Timestamp"].(string)
+	return ReplayCache.Check(nonce, timestamp)
 }
 
-func (service *Service) controlMsgReader() {
+func (service *Service) tunnelListener() {
 	log.Info(
-		"Control message reader(EP: %d, ET: %s, TP: %d, TT: %s) is running",
+		"Tunnel listener(EP: %d, ET: %s, TP: %d, TT: %s) is running",
 		service.ExternalPort, service.ExternalType,
 		service.TunnelPort, service.TunnelType,
 	)
-	timer := time.AfterFunc(time.Duration(HeartbeatTimeout)*time.Second, func() {
-		log.Error("HeartBeatTimeout ExternalPort: %d, TunnelPort: %d", service.ExternalPort, service.TunnelPort)
-		_ = service.ControlSocket.Close()
-		_ = service.ExternalListener.Close()
-		_ = service.TunnelListener.Close()
-	})
-	defer timer.Stop()
-	defer service.ControlSocket.Close()
-	defer service.ExternalListener.Close()
-	defer service.TunnelListener.Close()
+	var sessions []*conn.MuxSession
+	defer func() {
+		for _, session := range sessions {
+			_ = session.Close()
+		}
+	}()
 	for {
-		bytes, err := service.ControlSocket.ReadLine()
+		accept, err := service.TunnelListener.Accept()
 		if err != nil {
-			log.Error("Failed to read control message from the client. Error: %v", err)
-			return
+			log.Error("Failed to accept connection from the tunnel. Error: %v", err)
+			break
 		}
-		bytes, err = security.AESDecryptBase64(bytes, service.SecretKey)
-		if err != nil {
-			log.Error("Failed to decrypt control message from the client. Error: %v", err)
-			return
+		if !service.TunnelMux {
+			service.WorkerChan <- &map[string]interface{}{
+				"Socket": accept,
+				"Time":   time.Now(),
+			}
+			continue
 		}
-		msg, err := strconv.Atoi(string(bytes))
+		// every stream of a multiplexed tunnel connection is a worker
+		session, err := conn.NewMuxServerSession(accept)
 		if err != nil {
-			log.Error("Failed to parse control message from the client. Error: %v", err)
-			return
+			log.Error("Failed to create mux session on the tunnel. Error: %v", err)
+			_ = accept.Close()
+			continue
 		}
-		switch msg {
-		case consts.Heartbeat:
-			service.ControlMsgChan <- consts.Heartbeat
-			timer.Reset(time.Duration(HeartbeatTimeout) * time.Second)
-		default:
-			log.Warn("Unsupported msg: %d", msg)
+		alive := sessions[:0]
+		for _, s := range sessions {
+			if !s.IsClosed() {
+				alive = append(alive, s)
+			}
 		}
+		sessions = append(alive, session)
+		go service.muxStreamListener(session)
 	}
 }
 
-func (service *Service) controlMsgSender() {
-	log.Info(
-		"Control message sender(EP: %d, ET: %s, TP: %d, TT: %s) is running",
-		service.ExternalPort, service.ExternalType,
-		service.TunnelPort, service.TunnelType,
-	)
+func (service *Service) muxStreamListener(session *conn.MuxSession) {
+	log.Info("Mux session from %s is running", session.Socket.RemoteAddr())
+	defer session.Close()
 	for {
-		msg, ok := <-service.ControlMsgChan
-		if !ok {
-			log.Error("Control message channel is closed")
-			break
-		}
-		bytes := []byte(strconv.Itoa(msg))
-		bytes, err := security.AESEncryptBase64(bytes, service.SecretKey)
+		accept, err := session.Accept()
 		if err != nil {
-			log.Error("Failed to encrypt control message. Error: %v", err)
+			log.Info("Mux session from %s is closed. Error: %v", session.Socket.RemoteAddr(), err)
 			break
 		}
-		err = service.ControlSocket.WriteLine(bytes)
-		if err != nil {
-			log.Error("Failed to send control message. Error: %v", err)
-			break
+		service.WorkerChan <- &map[string]interface{}{
+			"Socket": accept,
+			"Time":   time.Now(),
 		}
 	}
 }
 
-func (service *Service) tunnelListener() {
-	log.Info(
-		"Tunnel listener(EP: %d, ET: %s, TP: %d, TT: %s) is running",
-		service.ExternalPort, service.ExternalType,
-		service.TunnelPort, service.TunnelType,
-	)
+func (service *Service) requestProcessor() {
 	for {
-		accept, err := service.TunnelListener.Accept()
-		if err != nil {
-			log.Error("Failed to accept connection from the tunnel. Error: %v", err)
-			break
+		request, ok := service.receive(service.RequestChan)
+		if !ok {
+			return
 		}
-		service.WorkerChan <- &map[string]interface{}{
-			"Socket": accept,
+		worker, ok := service.receive(service.WorkerChan)
+		for ok && service.isExpiredWorker(worker) {
+			_ = (*worker)["Socket"].(conn.Socket).Close()
+			service.requestTunnel()
+			worker, ok = service.receive(service.WorkerChan)
 		}
+		if !ok {
+			_ = (*request)["Socket"].(conn.Socket).Close()
+			return
+		}
+		go service.tunnel(request, (*worker)["Socket"].(conn.Socket))
 	}
 }
 
-func (service *Service) requestProcessor() {
+// receive takes the next request or worker from ch, it fails once the service is stopped
+func (service *Service) receive(ch chan *map[string]interface{}) (*map[string]interface{}, bool) {
+	select {
+	case item := <-ch:
+		return item, true
+	case <-service.Done:
+		return nil, false
+	}
+}
 
+// isExpiredWorker reports whether a pooled worker has been parked too long
+func (service *Service) isExpiredWorker(worker *map[string]interface{}) bool {
+	if service.PoolSize == 0 || service.PoolIdleTimeout <= 0 {
+		return false
+	}
+	parked, ok := (*worker)["Time"].(time.Time)
+	return ok && time.Since(parked) > time.Duration(service.PoolIdleTimeout)*time.Second
+}
+
+// requestTunnel asks the client for a new tunnel unless a pooled one is waiting
+func (service *Service) requestTunnel() {
+	if service.PoolSize == 0 || len(service.WorkerChan) == 0 {
+		service.createTunnel()
+	}
+}
+
+// poolSweeper closes pooled workers that have been idle for PoolIdleTimeout,
+// the client will replace them with fresh ones
+func (service *Service) poolSweeper() {
+	ticker := time.NewTicker(time.Duration(service.PoolIdleTimeout) * time.Second / 2)
+	defer ticker.Stop()
 	for {
-		request, ok := <-service.RequestChan
-		if !ok {
-			log.Error("Request channel is closed")
-			break
+		select {
+		case <-service.Done:
+			return
+		case <-ticker.C:
 		}
-		worker, ok := <-service.WorkerChan
-		if !ok {
-			log.Error("Worker channel is closed")
-			break
+		for n := len(service.WorkerChan); n > 0; n-- {
+			var worker *map[string]interface{}
+			select {
+			case worker = <-service.WorkerChan:
+			default:
+			}
+			if worker == nil {
+				break
+			}
+			if service.isExpiredWorker(worker) {
+				log.Debug("Pooled worker %s is expired", (*worker)["Socket"].(conn.Socket).RemoteAddr())
+				_ = (*worker)["Socket"].(conn.Socket).Close()
+				continue
+			}
+			service.WorkerChan <- worker
 		}
-		go service.tunnel((*request)["Socket"].(conn.Socket), (*worker)["Socket"].(conn.Socket))
 	}
 }
 
-func (service *Service) tunnel(client conn.Socket, tunnel conn.Socket) {
+func (service *Service) tunnel(request *map[string]interface{}, tunnel conn.Socket) {
+	client := (*request)["Socket"].(conn.Socket)
 	defer tunnel.Close()
-	defer client.Close()
-	if !tunnel2.ServerTunnelSafetyCheck(tunnel, service.SecretKey) {
-		log.Error("Tunnel safety check failed")
+	connID, tunnelKey, err := tunnel2.ServerTunnelSafetyCheck(tunnel, service.SecretKey, ReplayCache)
+	if err != nil {
+		retry, _ := (*request)["Retry"].(int)
+		if service.PoolSize > 0 && retry < 3 {
+			// the pooled worker may have gone away, try another one
+			log.Warn("Tunnel safety check failed, retry with another worker. Error: %v", err)
+			metrics.SafetyCheckFailures.With(service.Identity, service.Name).Inc()
+			(*request)["Retry"] = retry + 1
+			service.RequestChan <- request
+			service.requestTunnel()
+			return
+		}
+		log.Error("Tunnel safety check failed. Error: %v", err)
+		metrics.SafetyCheckFailures.With(service.Identity, service.Name).Inc()
+		_ = client.Close()
 		return
 	}
+	metrics.TunnelsCreated.With(service.Identity, service.Name).Inc()
+	log.Debug("Tunnel %s from %s is established", connID, tunnel.RemoteAddr())
+	defer client.Close()
+	connection := service.addConnection(connID, client, tunnel)
+	defer service.removeConnection(connection)
+	client = tunnel2.NewCountedSocket(client, connection.Stats, tunnel2.ServiceStats(service.Identity, service.Name))
 	if !service.TunnelEncrypt {
 		tunnel2.UnsafeTunnel(client, tunnel)
 		return
 	} else {
-		tunnel2.SafeTunnel(client, tunnel, service.SecretKey)
+		tunnel2.SafeTunnel(client, tunnel, tunnelKey, tunnel2.ServerSide)
 	}
 }
 
+func (service *Service) addConnection(connID string, request conn.Socket, tunnel conn.Socket) *Connection {
+	connection := &Connection{
+		ID:        nextID.Add(1),
+		ConnID:    connID,
+		Request:   request,
+		Tunnel:    tunnel,
+		StartTime: time.Now(),
+		Stats:     tunnel2.NewStats(),
+	}
+	service.connsLock.Lock()
+	service.connections[connection.ID] = connection
+	service.connsLock.Unlock()
+	return connection
+}
+
+func (service *Service) removeConnection(connection *Connection) {
+	service.connsLock.Lock()
+	delete(service.connections, connection.ID)
+	service.connsLock.Unlock()
+}
+
+// activeConnections returns the connections being forwarded by the service
+func (service *Service) activeConnections() []*Connection {
+	service.connsLock.Lock()
+	defer service.connsLock.Unlock()
+	list := make([]*Connection, 0, len(service.connections))
+	for _, connection := range service.connections {
+		list = append(list, connection)
+	}
+	return list
+}
+
 func (service *Service) serverListener() {
 	log.Info(
 		"Server listener(EP: %d, ET: %s, TP: %d, TT: %s) is running",
@@ -330,10 +568,11 @@ func (service *Service) serverListener() {
 			log.Error("Failed to accept connection from the client. Error: %v", err)
 			break
 		}
+		metrics.ConnectionsAccepted.With(service.Identity, service.Name).Inc()
 		service.RequestChan <- &map[string]interface{}{
 			"Socket": accept,
 		}
-		service.ControlMsgChan <- consts.CreateTunnel
+		service.requestTunnel()
 	}
 }
 
@@ -351,12 +590,17 @@ func (service *Service) p2pTunnelListener() {
 		}
 		// check whether the accept is a client / a proxy
 		go func(accept conn.Socket) {
+			secretKey, err := handshake(accept)
+			if err != nil {
+				log.Error("Failed to handshake with the tunnel. Error: %v", err)
+				return
+			}
 			bytes, err := accept.ReadLine()
 			if err != nil {
 				log.Error("Failed to read the first line from the tunnel. Error: %v", err)
 				return
 			}
-			bytes, err = security.RSADecryptBase64(bytes, PrivateKey, NBits)
+			bytes, err = security.AEADDecryptBase64(bytes, secretKey)
 			if err != nil {
 				log.Error("Failed to decrypt the first line from the tunnel. Error: %v", err)
 				return
@@ -367,14 +611,31 @@ func (service *Service) p2pTunnelListener() {
 				log.Error("Failed to deserialize metadata from the client. Error: %v", err)
 				return
 			}
-			if dict["Type"].(string) == "Proxy" {
+			if err = service.checkP2PRegistration(dict, secretKey); err == nil {
+				err = checkReplay(dict)
+			}
+			if err != nil {
+				log.Error("Rejected the metadata from %s. Error: %v", accept.RemoteAddr(), err)
+				status := 403
+				if errors.Is(err, errInvalidRegistration) {
+					status = 400
+				}
+				if err = sendError(accept, secretKey, status, err); err != nil {
+					log.Error("Failed to send error to the tunnel. Error: %v", err)
+				}
+				_ = accept.Close()
+				return
+			}
+			// the reply is encrypted with the key of the handshake
+			dict["SecretKey"] = string(secretKey)
+			if dict["Type"] == "Proxy" {
 				// add it to RequestChan
 				service.RequestChan <- &map[string]interface{}{
 					"Socket":   accept,
 					"Metadata": dict,
 				}
-				// add a CreateTunnel signal to ControlMsgChan to create a new tunnel
-				service.ControlMsgChan <- consts.CreateTunnel
+				// ask the client for a new tunnel
+				service.createTunnel()
 			} else {
 				// add it to WorkerChan
 				service.WorkerChan <- &map[string]interface{}{
@@ -386,17 +647,50 @@ func (service *Service) p2pTunnelListener() {
 	}
 }
 
+var errInvalidRegistration = errors.New("invalid p2p registration")
+
+// checkP2PRegistration checks a registration on the p2p tunnel port. A proxy
+// is an external user of the service and may register freely, it only learns
+// the address of the client and the key of the pairing. A client must prove
+// with its MAC that it owns the service, handshakeKey is the key of the
+// connection of the registration.
+func (service *Service) checkP2PRegistration(dict map[string]interface{}, handshakeKey []byte) error {
+	natType, _ := dict["NATType"].(string)
+	if n, err := strconv.Atoi(natType); err != nil || n < 0 || n >= len(natType2FsmForProxy) {
+		return fmt.Errorf("%w: NATType %q", errInvalidRegistration, natType)
+	}
+	switch dict["Type"] {
+	case "Proxy":
+		return nil
+	case "Client":
+		str, _ := dict["MAC"].(string)
+		mac, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return fmt.Errorf("%w: MAC", errInvalidRegistration)
+		}
+		expected, err := tunnel2.P2PRegistrationMAC(service.SecretKey, handshakeKey, dict)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(mac, expected) {
+			return fmt.Errorf("%w: the MAC of the client is wrong", errForbidden)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: Type %v", errInvalidRegistration, dict["Type"])
+	}
+}
+
 func (service *Service) p2pRequestProcessor() {
 	for {
-		request, ok := <-service.RequestChan
+		request, ok := service.receive(service.RequestChan)
 		if !ok {
-			log.Error("Request channel is closed")
-			break
+			return
 		}
-		worker, ok := <-service.WorkerChan
+		worker, ok := service.receive(service.WorkerChan)
 		if !ok {
-			log.Error("Worker channel is closed")
-			break
+			_ = (*request)["Socket"].(conn.Socket).Close()
+			return
 		}
 		reqSocket := (*request)["Socket"].(conn.Socket)
 		reqMetadata := (*request)["Metadata"].(map[string]interface{})
@@ -431,16 +725,41 @@ var natType2FsmForTunnel = [9][9]string{
 }
 
 func (service *Service) p2pTunnel(proxy conn.Socket, tunnel conn.Socket, proxyMetadata map[string]interface{}, tunnelMetadata map[string]interface{}) {
-	pNatType, err := strconv.Atoi(proxyMetadata["NATType"].(string))
+	// the NAT types have been checked by checkP2PRegistration
+	pNatTypeStr, _ := proxyMetadata["NATType"].(string)
+	pNatType, err := strconv.Atoi(pNatTypeStr)
 	if err != nil {
 		log.Error("Failed to convert client NAT type to integer. Error: %v", err)
 		return
 	}
-	tNatType, err := strconv.Atoi(tunnelMetadata["NATType"].(string))
+	tNatTypeStr, _ := tunnelMetadata["NATType"].(string)
+	tNatType, err := strconv.Atoi(tNatTypeStr)
 	if err != nil {
 		log.Error("Failed to convert tunnel NAT type to integer. Error: %v", err)
 		return
 	}
+	pairing := &p2pPairing{
+		ID:         nextID.Add(1),
+		ServiceID:  service.ID,
+		Service:    service.Name,
+		Client:     service.Identity,
+		ProxyAddr:  proxy.RemoteAddr().String(),
+		TunnelAddr: tunnel.RemoteAddr().String(),
+		ProxyNAT:   pNatType,
+		TunnelNAT:  tNatType,
+		ProxyFSM:   natType2FsmForProxy[pNatType][tNatType],
+		TunnelFSM:  natType2FsmForTunnel[pNatType][tNatType],
+		Time:       time.Now(),
+		Result:     "pending",
+	}
+	if pairing.TunnelFSM == "" {
+		pairing.Result = "unsupported"
+	}
+	addPairing(pairing)
+	// fail records a pairing which has not reached both sides
+	fail := func(err error) {
+		finishPairing(service.Identity, service.Name, pairing.ID, "failure", err.Error())
+	}
 
 	secretKey := security.AesGenKey(32)
 
@@ -461,22 +780,29 @@ func (service *Service) p2pTunnel(proxy conn.Socket, tunnel conn.Socket, proxyMe
 			metadata["RNetwork"] = "udp6"
 		}
 	}
-	metadata["FSMType"] = natType2FsmForTunnel[pNatType][tNatType]
+	metadata["Status"] = strconv.Itoa(200)
+	metadata["FSMType"] = pairing.TunnelFSM
+	metadata["PairID"] = strconv.FormatUint(pairing.ID, 10)
 	metadata["SecretKey"] = string(secretKey)
 	metadata["TunnelEncrypt"] = service.TunnelEncrypt
+	metadata["KCPProfile"] = service.KCPConfig.String()
+	metadata["KCPCrypt"] = service.KCPCrypt
 	bytes, err := serialize.Serialize(&metadata)
 	if err != nil {
 		log.Error("Failed to serialize client metadata. Error: %v", err)
+		fail(err)
 		return
 	}
-	bytes, err = security.AESEncryptBase64(bytes, []byte(tunnelMetadata["SecretKey"].(string)))
+	bytes, err = security.AEADEncryptBase64(bytes, []byte(tunnelMetadata["SecretKey"].(string)))
 	if err != nil {
 		log.Error("Failed to encrypt client metadata. Error: %v", err)
+		fail(err)
 		return
 	}
 	err = tunnel.WriteLine(bytes)
 	if err != nil {
 		log.Error("Failed to send client metadata to the tunnel. Error: %v", err)
+		fail(err)
 		return
 	}
 
@@ -497,22 +823,28 @@ func (service *Service) p2pTunnel(proxy conn.Socket, tunnel conn.Socket, proxyMe
 			metadata["RNetwork"] = "udp6"
 		}
 	}
-	metadata["FSMType"] = natType2FsmForProxy[pNatType][tNatType]
+	metadata["Status"] = strconv.Itoa(200)
+	metadata["FSMType"] = pairing.ProxyFSM
 	metadata["SecretKey"] = string(secretKey)
 	metadata["TunnelEncrypt"] = service.TunnelEncrypt
+	metadata["KCPProfile"] = service.KCPConfig.String()
+	metadata["KCPCrypt"] = service.KCPCrypt
 	bytes, err = serialize.Serialize(&metadata)
 	if err != nil {
 		log.Error("Failed to serialize tunnel metadata. Error: %v", err)
+		fail(err)
 		return
 	}
-	bytes, err = security.AESEncryptBase64(bytes, []byte(proxyMetadata["SecretKey"].(string)))
+	bytes, err = security.AEADEncryptBase64(bytes, []byte(proxyMetadata["SecretKey"].(string)))
 	if err != nil {
 		log.Error("Failed to encrypt tunnel metadata. Error: %v", err)
+		fail(err)
 		return
 	}
 	err = proxy.WriteLine(bytes)
 	if err != nil {
 		log.Error("Failed to send tunnel metadata to the client. Error: %v", err)
+		fail(err)
 		return
 	}
 	time.Sleep(1 * time.Second)
@@ -520,21 +852,42 @@ func (service *Service) p2pTunnel(proxy conn.Socket, tunnel conn.Socket, proxyMe
 
 func Run() {
 	log.InitLog(LogWay, LogFile, LogLevel, LogMaxDays)
-	listener, err := conn.NewListener(ServerType, consts.Auto, ServerPort)
+	listener, err := conn.NewListener(ServerType, consts.Auto, ServerPort, KCPConfig)
 	if err != nil {
 		log.Error("Failed to create listener: %v", err)
 		return
 	}
 	log.Info("Server started at %s", listener.Address().String())
+	for _, key := range PrivateKeys {
+		if key.Deprecated {
+			log.Info("Server key %s is loaded (deprecated)", key.ID)
+		} else {
+			log.Info("Server key %s is loaded", key.ID)
+		}
+	}
+	if VhostHTTPPort != 0 {
+		router, err = newVhostRouter(VhostHTTPPort)
+		if err != nil {
+			log.Error("Failed to create vhost http listener: %v", err)
+			return
+		}
+		go router.serve()
+	}
+	if AdminPort != 0 {
+		go serveAdmin(AdminAddr, AdminPort, AdminToken, DashboardPassword, DashboardReadOnly)
+	}
+	if MetricsAddr != "" {
+		go metrics.Serve(MetricsAddr)
+	}
 	for {
 		accept, err := listener.Accept()
 		if err != nil {
 			log.Error("Failed to accept connection: %v", err)
 			continue
 		}
-		service := &Service{
+		session := &Session{
 			ControlSocket: accept,
 		}
-		go service.run()
+		go session.run()
 	}
 }
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"pTunnel/conn"
+	tunnel2 "pTunnel/tunnel"
+	"pTunnel/utils/consts"
+	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
+	"pTunnel/utils/security"
+	"pTunnel/utils/serialize"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+// sessions are the sessions of the connected clients
+var (
+	sessionsLock sync.Mutex
+	sessions     = make(map[*Session]struct{})
+)
+
+// nextID numbers the services and the connections
+var nextID atomic.Uint64
+
+// Session is an authenticated control connection of a client, the client
+// registers, updates and unregisters any number of services over it
+type Session struct {
+	ControlSocket conn.Socket
+	SecretKey     []byte // the key of the handshake, the keys of the control channel and the services are derived from it
+	Channel       *tunnel2.ControlChannel
+	User          *User  // nil if UsersFile is not set
+	Identity      string // the user, the certificate or the address of the client
+	Owner         string // the owner of the port leases, the Identity of a user or a certificate, unique to the session of an anonymous client
+	StartTime     time.Time
+
+	ControlMsgChan chan *map[string]interface{}
+	Done           chan struct{}
+
+	lock          sync.Mutex
+	services      map[string]*Service
+	lastHeartbeat atomic.Int64 // unix nanoseconds
+	anonymous     bool         // the client is only known by its address, which other clients may share
+}
+
+func (session *Session) run() {
+	log.Info("Start a new go routine to handle the connection from %s to %s", session.ControlSocket.RemoteAddr(), session.ControlSocket.LocalAddr())
+	defer func(ControlSocket conn.Socket) {
+		_ = ControlSocket.Close()
+	}(session.ControlSocket)
+
+	// Authenticate the client
+	if err := session.authenticate(); err != nil {
+		status := 400
+		if errors.Is(err, errUnauthorized) {
+			status = 401
+		} else if errors.Is(err, security.ErrReplay) || errors.Is(err, errForbidden) {
+			status = 403
+		}
+		if session.SecretKey != nil {
+			if err = sendError(session.ControlSocket, session.SecretKey, status, err); err != nil {
+				log.Error("Failed to send error to the client. Error: %v", err)
+			}
+		}
+		return
+	}
+
+	// Tell the client the session is established
+	dict := make(map[string]interface{})
+	dict["Status"] = strconv.Itoa(200)
+	dict["HeartbeatTimeout"] = strconv.Itoa(HeartbeatTimeout)
+	bytes, err := serialize.Serialize(&dict)
+	if err == nil {
+		bytes, err = security.AEADEncryptBase64(bytes, session.SecretKey)
+	}
+	if err == nil {
+		err = session.ControlSocket.WriteLine(bytes)
+	}
+	if err != nil {
+		log.Error("Failed to send the session to the client. Error: %v", err)
+		return
+	}
+
+	// the control messages are sealed by their own keys from now on
+	if session.Channel, err = tunnel2.NewControlChannel(session.ControlSocket, session.SecretKey, tunnel2.ServerSide); err != nil {
+		log.Error("Failed to create the control channel. Error: %v", err)
+		return
+	}
+	session.ControlMsgChan = make(chan *map[string]interface{}, 100)
+	session.Done = make(chan struct{})
+	session.services = make(map[string]*Service)
+	session.StartTime = time.Now()
+	session.lastHeartbeat.Store(session.StartTime.UnixNano())
+	sessionsLock.Lock()
+	sessions[session] = struct{}{}
+	sessionsLock.Unlock()
+	defer func() {
+		sessionsLock.Lock()
+		delete(sessions, session)
+		sessionsLock.Unlock()
+	}()
+
+	// Start a new goroutine to send control message to the client
+	go session.controlMsgSender()
+
+	// Listen to the control message from the client, every service of the
+	// session is stopped once the client is gone
+	session.controlMsgReader()
+	close(session.Done)
+	for _, service := range session.runningServices() {
+		service.stop()
+	}
+}
+
+func (session *Session) authenticate() (err error) {
+	session.SecretKey, err = handshake(session.ControlSocket)
+	if err != nil {
+		log.Error("Failed to handshake with the client. Error: %v", err)
+		return
+	}
+	bytes, err := session.ControlSocket.ReadLine()
+	if err != nil {
+		log.Error("Failed to read metadata from the client. Error: %v", err)
+		return
+	}
+	bytes, err = security.AEADDecryptBase64(bytes, session.SecretKey)
+	if err != nil {
+		log.Error("Failed to decrypt metadata from the client. Error: %v", err)
+		return
+	}
+	dict := make(map[string]interface{})
+	err = serialize.Deserialize(bytes, &dict)
+	if err != nil {
+		log.Error("Failed to deserialize metadata from the client. Error: %v", err)
+		return
+	}
+	if err = checkReplay(dict); err != nil {
+		log.Error("Rejected the metadata from %s. Error: %v", session.ControlSocket.RemoteAddr(), err)
+		return
+	}
+	userName, _ := dict["User"].(string)
+	token, _ := dict["Token"].(string)
+	// a client authenticated by mutual tls is named by its certificate
+	cert, err := conn.PeerCertificate(session.ControlSocket)
+	if err != nil {
+		log.Error("Failed to get the certificate of the client. Error: %v", err)
+		return
+	}
+	if cert != nil {
+		log.Info("Client %s is authenticated by the certificate of %s", session.ControlSocket.RemoteAddr(), cert.Subject.CommonName)
+		session.User, err = authenticateCert(cert.Subject.CommonName, userName)
+	} else {
+		session.User, err = authenticate(userName, token)
+	}
+	if err != nil {
+		log.Error("Rejected the client %s. Error: %v", session.ControlSocket.RemoteAddr(), err)
+		return
+	}
+	switch {
+	case cert != nil:
+		session.Identity = cert.Subject.CommonName
+	case session.User != nil:
+		session.Identity = session.User.Name
+	default:
+		session.Identity, _, _ = net.SplitHostPort(session.ControlSocket.RemoteAddr().String())
+		session.anonymous = true
+	}
+	session.Owner = session.Identity
+	if session.anonymous {
+		session.Owner += "#" + strconv.FormatUint(nextID.Add(1), 10)
+	}
+	return
+}
+
+// register starts the service described by dict and returns the reply
+func (session *Session) register(name string, dict map[string]interface{}) map[string]interface{} {
+	session.lock.Lock()
+	_, ok := session.services[name]
+	session.lock.Unlock()
+	if ok {
+		return errorReply(name, 409, fmt.Errorf("service %s is already registered", name))
+	}
+	session.takeOver(name)
+	service, err := newService(session, name, dict)
+	if err != nil {
+		status := 400
+		if errors.Is(err, errForbidden) {
+			status = 403
+		}
+		return errorReply(name, status, err)
+	}
+	if err = service.listen(); err != nil {
+		return errorReply(name, portStatus(err), err)
+	}
+	session.lock.Lock()
+	session.services[name] = service
+	session.lock.Unlock()
+	go service.run()
+	return service.reply()
+}
+
+// unregister stops the service named name, the client is not told again
+func (session *Session) unregister(name string) error {
+	session.lock.Lock()
+	service, ok := session.services[name]
+	delete(session.services, name)
+	session.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: service %s is not registered", errNotFound, name)
+	}
+	service.stop()
+	return nil
+}
+
+// serviceStopped removes a service that has stopped by itself and tells the client
+func (session *Session) serviceStopped(service *Service) {
+	if session.stopService(service, 500, "the service has stopped on the server") {
+		log.Warn("Service %s of %s has stopped", service.Name, session.Identity)
+	}
+}
+
+// takeOver stops the service named name of the older sessions of the same
+// owner, which frees its ports. A client which reconnects before its old
+// session has timed out gets its services back at once.
+func (session *Session) takeOver(name string) {
+	for _, other := range activeSessions() {
+		if other == session || other.Owner != session.Owner {
+			continue
+		}
+		other.lock.Lock()
+		service := other.services[name]
+		other.lock.Unlock()
+		if service != nil && other.stopService(service, 409, "the service is taken over by a newer session") {
+			log.Warn("Service %s of %s is taken over by %s", name, session.Identity, session.ControlSocket.RemoteAddr())
+		}
+	}
+}
+
+// stopService removes service from the session, stops it and tells the client
+// why, it returns false if the service has been removed already
+func (session *Session) stopService(service *Service, status int, reason string) bool {
+	session.lock.Lock()
+	current, ok := session.services[service.Name]
+	if ok && current == service {
+		delete(session.services, service.Name)
+	}
+	session.lock.Unlock()
+	service.stop()
+	if !ok || current != service {
+		return false
+	}
+	session.send(map[string]interface{}{
+		"Service": service.Name,
+		"Status":  strconv.Itoa(status),
+		"Error":   reason,
+	}, consts.Unregister)
+	return true
+}
+
+// LastHeartbeat returns the time of the last heartbeat of the client
+func (session *Session) LastHeartbeat() time.Time {
+	return time.Unix(0, session.lastHeartbeat.Load())
+}
+
+// activeSessions returns the sessions of the connected clients
+func activeSessions() []*Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	list := make([]*Session, 0, len(sessions))
+	for session := range sessions {
+		list = append(list, session)
+	}
+	return list
+}
+
+func (session *Session) runningServices() []*Service {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	services := make([]*Service, 0, len(session.services))
+	for _, service := range session.services {
+		services = append(services, service)
+	}
+	return services
+}
+
+// send queues a control message for the client unless the session is over
+func (session *Session) send(dict map[string]interface{}, msg int) {
+	dict["Type"] = strconv.Itoa(msg)
+	select {
+	case session.ControlMsgChan <- &dict:
+	case <-session.Done:
+	}
+}
+
+// errorReply is the reply of a rejected Register/Update/Unregister of a service
+func errorReply(name string, status int, reason error) map[string]interface{} {
+	log.Error("Rejected the service %s. Error: %v", name, reason)
+	return map[string]interface{}{
+		"Service": name,
+		"Status":  strconv.Itoa(status),
+		"Error":   reason.Error(),
+	}
+}
+
+func (session *Session) controlMsgReader() {
+	log.Info("Control message reader of %s(%s) is running", session.Identity, session.ControlSocket.RemoteAddr())
+	timer := time.AfterFunc(time.Duration(HeartbeatTimeout)*time.Second, func() {
+		log.Error("HeartBeatTimeout of %s(%s)", session.Identity, session.ControlSocket.RemoteAddr())
+		metrics.HeartbeatTimeouts.Inc()
+		_ = session.ControlSocket.Close()
+	})
+	defer timer.Stop()
+	for {
+		dict, err := session.Channel.ReadMsg()
+		if err != nil {
+			log.Error("Failed to read control message from the client. Error: %v", err)
+			return
+		}
+		msgType, _ := dict["Type"].(string)
+		msg, err := strconv.Atoi(msgType)
+		if err != nil {
+			log.Error("Failed to parse control message from the client. Error: %v", err)
+			return
+		}
+		name, _ := dict["Service"].(string)
+		switch msg {
+		case consts.Heartbeat:
+			session.send(make(map[string]interface{}), consts.Heartbeat)
+			session.lastHeartbeat.Store(time.Now().UnixNano())
+			timer.Reset(time.Duration(HeartbeatTimeout) * time.Second)
+		case consts.P2PResult:
+			pairID, _ := dict["PairID"].(string)
+			result, _ := dict["Result"].(string)
+			id, err := strconv.ParseUint(pairID, 10, 64)
+			if err != nil || (result != "success" && result != "failure") ||
+				!finishPairing(session.Identity, name, id, result, "") {
+				log.Warn("Receive an unknown p2p result of service %s from %s", name, session.Identity)
+			}
+		case consts.Register:
+			session.send(session.register(name, dict), consts.Reply)
+		case consts.Update:
+			// the old service is stopped first, so that the new one can
+			// take over its ports
+			if err = session.unregister(name); err != nil {
+				session.send(errorReply(name, 404, err), consts.Reply)
+				break
+			}
+			session.send(session.register(name, dict), consts.Reply)
+		case consts.Unregister:
+			if err = session.unregister(name); err != nil {
+				session.send(errorReply(name, 404, err), consts.Reply)
+				break
+			}
+			log.Info("Service %s of %s is unregistered", name, session.Identity)
+			session.send(map[string]interface{}{"Service": name, "Status": strconv.Itoa(200)}, consts.Reply)
+		default:
+			log.Warn("Unsupported msg: %d", msg)
+		}
+	}
+}
+
+func (session *Session) controlMsgSender() {
+	log.Info("Control message sender of %s(%s) is running", session.Identity, session.ControlSocket.RemoteAddr())
+	for {
+		var dict *map[string]interface{}
+		select {
+		case dict = <-session.ControlMsgChan:
+		case <-session.Done:
+			return
+		}
+		if err := session.Channel.WriteMsg(*dict); err != nil {
+			log.Error("Failed to send control message. Error: %v", err)
+			_ = session.ControlSocket.Close()
+			return
+		}
+	}
+}
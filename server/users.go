@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vaughan0/go-ini"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+)
+
+// User is a client identity declared in UsersFile, every section of the file
+// is a user:
+//
+//	[alice]
+//	Token = a-long-random-string
+//	ExternalPorts = 6000-6010, 7000
+//	ExternalTypes = tcp4, http
+//	TunnelTypes = tcp4, kcp4
+//	P2PPorts = 20000-20100
+//	Domains = www.example.com, *.example.org
+//
+// A missing key grants nothing, "*" grants everything. Port 0, which lets
+// the server choose a random port, is only granted by "*" or a range from 0.
+// "*.example.org" grants every subdomain of example.org, and registering
+// "*.example.org" itself, to the CustomDomains of http services.
+// With mutual tls the user is named by the CN of the client certificate and
+// the Token can be left out.
+type User struct {
+	Name          string
+	Token         string
+	ExternalPorts portRanges // the ExternalPort and the fixed TunnelPort of non-p2p services
+	ExternalTypes typeSet
+	TunnelTypes   typeSet
+	P2PPorts      portRanges // the port of p2p services
+	Domains       domainSet  // the CustomDomains of http services
+}
+
+// Users is nil if UsersFile is not set, every client is allowed everything then
+var Users map[string]*User
+
+// LoadUsers parses the users file
+func LoadUsers(file string) (map[string]*User, error) {
+	conf, err := ini.LoadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*User)
+	for name, section := range conf {
+		if name == "" {
+			continue
+		}
+		user := &User{Name: name, Token: section["Token"]}
+		if user.ExternalPorts, err = parsePortRanges(section["ExternalPorts"]); err != nil {
+			return nil, fmt.Errorf("invalid ExternalPorts of user %s: %v", name, err)
+		}
+		if user.P2PPorts, err = parsePortRanges(section["P2PPorts"]); err != nil {
+			return nil, fmt.Errorf("invalid P2PPorts of user %s: %v", name, err)
+		}
+		user.ExternalTypes = parseTypeSet(section["ExternalTypes"])
+		user.TunnelTypes = parseTypeSet(section["TunnelTypes"])
+		user.Domains = domainSet(parseTypeSet(section["Domains"]))
+		users[name] = user
+	}
+	return users, nil
+}
+
+// authenticate returns the user matching name and token
+func authenticate(name string, token string) (*User, error) {
+	if Users == nil {
+		return nil, nil
+	}
+	user, ok := Users[name]
+	// compare the token even if the user does not exist, so that the time
+	// taken does not tell whether it does
+	expected := "\x00"
+	if ok {
+		expected = user.Token
+	}
+	// users without a Token can only be authenticated by their certificate
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 || !ok || user.Token == "" {
+		return nil, fmt.Errorf("%w: invalid user or token", errUnauthorized)
+	}
+	return user, nil
+}
+
+// authenticateCert returns the user named by commonName, the CN of the
+// verified certificate of the client. name is the User sent by the client,
+// it may be empty but must match the certificate otherwise.
+func authenticateCert(commonName string, name string) (*User, error) {
+	if name != "" && name != commonName {
+		return nil, fmt.Errorf("%w: user %s does not match the certificate of %s", errUnauthorized, name, commonName)
+	}
+	if Users == nil {
+		return nil, nil
+	}
+	user, ok := Users[commonName]
+	if !ok {
+		return nil, fmt.Errorf("%w: the certificate of %s is not granted anything", errForbidden, commonName)
+	}
+	return user, nil
+}
+
+// authorize checks the service against the grants of the user
+func (user *User) authorize(service *Service) error {
+	if user == nil {
+		return nil
+	}
+	externalType := strings.ToLower(service.ExternalType)
+	tunnelType := strings.ToLower(service.TunnelType)
+	if !user.TunnelTypes.contains(tunnelType) {
+		return fmt.Errorf("%w: user %s is not allowed to use TunnelType %s", errForbidden, user.Name, service.TunnelType)
+	}
+	// the ExternalType of p2p services is the same as the TunnelType
+	if strings.HasPrefix(tunnelType, "p2p") {
+		if !user.P2PPorts.contains(service.ExternalPort) {
+			return fmt.Errorf("%w: user %s is not allowed to use P2P port %d", errForbidden, user.Name, service.ExternalPort)
+		}
+		return nil
+	}
+	if !user.ExternalTypes.contains(externalType) {
+		return fmt.Errorf("%w: user %s is not allowed to use ExternalType %s", errForbidden, user.Name, service.ExternalType)
+	}
+	// http services share VhostHTTPPort and are told apart by their domains
+	if externalType == "http" {
+		for _, domain := range service.CustomDomains {
+			if !user.Domains.contains(domain) {
+				return fmt.Errorf("%w: user %s is not allowed to use domain %s", errForbidden, user.Name, domain)
+			}
+		}
+	} else if !user.ExternalPorts.contains(service.ExternalPort) {
+		return fmt.Errorf("%w: user %s is not allowed to use ExternalPort %d", errForbidden, user.Name, service.ExternalPort)
+	}
+	if service.TunnelPort != 0 && !user.ExternalPorts.contains(service.TunnelPort) {
+		return fmt.Errorf("%w: user %s is not allowed to use TunnelPort %d", errForbidden, user.Name, service.TunnelPort)
+	}
+	return nil
+}
+
+type portRange struct {
+	low  int
+	high int
+}
+
+type portRanges []portRange
+
+// parsePortRanges parses "6000-6010, 7000" or "*"
+func parsePortRanges(str string) (portRanges, error) {
+	var ranges portRanges
+	for _, field := range strings.Split(str, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == "*" {
+			ranges = append(ranges, portRange{0, 65535})
+			continue
+		}
+		low, high, isRange := strings.Cut(field, "-")
+		r := portRange{}
+		var err error
+		if r.low, err = strconv.Atoi(strings.TrimSpace(low)); err != nil {
+			return nil, err
+		}
+		r.high = r.low
+		if isRange {
+			if r.high, err = strconv.Atoi(strings.TrimSpace(high)); err != nil {
+				return nil, err
+			}
+		}
+		if r.low < 0 || r.high > 65535 || r.low > r.high {
+			return nil, errors.New("invalid port range: " + field)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (ranges portRanges) contains(port int) bool {
+	for _, r := range ranges {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+type typeSet map[string]bool
+
+// parseTypeSet parses "tcp4, kcp4" or "*"
+func parseTypeSet(str string) typeSet {
+	set := make(typeSet)
+	for _, field := range strings.Split(str, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field != "" {
+			set[field] = true
+		}
+	}
+	return set
+}
+
+func (set typeSet) contains(t string) bool {
+	return set["*"] || set[t]
+}
+
+type domainSet map[string]bool
+
+// contains tells whether domain is granted, "*.example.com" grants every
+// subdomain of example.com, like the routes of vhostRouter
+func (set domainSet) contains(domain string) bool {
+	if set["*"] || set[domain] {
+		return true
+	}
+	for parts := strings.Split(domain, "."); len(parts) > 1; parts = parts[1:] {
+		if set["*."+strings.Join(parts[1:], ".")] {
+			return true
+		}
+	}
+	return false
+}
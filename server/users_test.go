@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testUsersFile = `
+[alice]
+Token = alice-token
+ExternalPorts = 6000-6010, 7000
+ExternalTypes = tcp4, http
+TunnelTypes = tcp4, p2p4
+P2PPorts = 20000-20100
+Domains = www.example.com
+
+[carol]
+ExternalPorts = *
+ExternalTypes = *
+TunnelTypes = *
+`
+
+// useTestUsers loads testUsersFile into Users for the duration of the test
+func useTestUsers(t *testing.T) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "users.ini")
+	if err := os.WriteFile(file, []byte(testUsersFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := LoadUsers(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := Users
+	Users = users
+	t.Cleanup(func() { Users = saved })
+}
+
+func TestLoadUsersInvalid(t *testing.T) {
+	for _, grant := range []string{"ExternalPorts = 7000-6000", "P2PPorts = http"} {
+		file := filepath.Join(t.TempDir(), "users.ini")
+		if err := os.WriteFile(file, []byte("[alice]\n"+grant+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUsers(file); err == nil {
+			t.Fatalf("%s is accepted", grant)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	useTestUsers(t)
+	tests := []struct {
+		name  string
+		user  string
+		token string
+		err   error
+	}{
+		{"good token", "alice", "alice-token", nil},
+		{"bad token", "alice", "alice-token2", errUnauthorized},
+		{"empty token", "alice", "", errUnauthorized},
+		{"unknown user", "mallory", "alice-token", errUnauthorized},
+		// carol has no Token and can only use her certificate
+		{"user without a token", "carol", "", errUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := authenticate(tt.user, tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if err.Error() != "unauthorized: invalid user or token" {
+					t.Fatalf("the error %q tells too much", err)
+				}
+				return
+			}
+			if user == nil || user.Name != tt.user {
+				t.Fatalf("got user %v, want %s", user, tt.user)
+			}
+		})
+	}
+
+	Users = nil
+	if user, err := authenticate("anyone", ""); user != nil || err != nil {
+		t.Fatalf("without UsersFile got %v and %v, want no user and no error", user, err)
+	}
+}
+
+func TestAuthenticateCert(t *testing.T) {
+	useTestUsers(t)
+	tests := []struct {
+		name       string
+		commonName string
+		user       string
+		err        error
+	}{
+		{"certificate", "carol", "", nil},
+		{"matching user", "carol", "carol", nil},
+		{"other user", "carol", "alice", errUnauthorized},
+		{"unknown certificate", "mallory", "", errForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := authenticateCert(tt.commonName, tt.user)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (user == nil || user.Name != tt.commonName) {
+				t.Fatalf("got user %v, want %s", user, tt.commonName)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	useTestUsers(t)
+	alice := Users["alice"]
+	tests := []struct {
+		name    string
+		service *Service
+		err     string // empty means the service is allowed
+	}{
+		{"allowed port", &Service{ExternalType: "tcp4", ExternalPort: 6005, TunnelType: "tcp4"}, ""},
+		{"allowed single port", &Service{ExternalType: "TCP4", ExternalPort: 7000, TunnelType: "TCP4"}, ""},
+		{"allowed tunnel port", &Service{ExternalType: "tcp4", ExternalPort: 6000, TunnelType: "tcp4", TunnelPort: 6010}, ""},
+		{"external port out of range", &Service{ExternalType: "tcp4", ExternalPort: 6011, TunnelType: "tcp4"},
+			"forbidden: user alice is not allowed to use ExternalPort 6011"},
+		{"random external port", &Service{ExternalType: "tcp4", ExternalPort: 0, TunnelType: "tcp4"},
+			"forbidden: user alice is not allowed to use ExternalPort 0"},
+		{"tunnel port out of range", &Service{ExternalType: "tcp4", ExternalPort: 6000, TunnelType: "tcp4", TunnelPort: 8000},
+			"forbidden: user alice is not allowed to use TunnelPort 8000"},
+		{"external type", &Service{ExternalType: "udp4", ExternalPort: 6000, TunnelType: "tcp4"},
+			"forbidden: user alice is not allowed to use ExternalType udp4"},
+		{"tunnel type", &Service{ExternalType: "tcp4", ExternalPort: 6000, TunnelType: "kcp4"},
+			"forbidden: user alice is not allowed to use TunnelType kcp4"},
+		{"allowed p2p port", &Service{ExternalType: "p2p4", ExternalPort: 20050, TunnelType: "p2p4"}, ""},
+		{"p2p port out of range", &Service{ExternalType: "p2p4", ExternalPort: 6000, TunnelType: "p2p4"},
+			"forbidden: user alice is not allowed to use P2P port 6000"},
+		{"allowed domain", &Service{ExternalType: "http", TunnelType: "tcp4", CustomDomains: []string{"www.example.com"}}, ""},
+		{"domain", &Service{ExternalType: "http", TunnelType: "tcp4", CustomDomains: []string{"api.example.com"}},
+			"forbidden: user alice is not allowed to use domain api.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := alice.authorize(tt.service)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("got %v, want %s", err, tt.err)
+			}
+			if !errors.Is(err, errForbidden) || portStatus(err) != 403 {
+				t.Fatalf("%v is not sent as 403", err)
+			}
+		})
+	}
+
+	// everything is allowed without UsersFile
+	var anonymous *User
+	if err := anonymous.authorize(&Service{ExternalType: "udp4", ExternalPort: 1, TunnelType: "kcp4"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPortStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: port 22 is reserved by the server", errForbidden), 403},
+		{fmt.Errorf("%w: port 6000 is leased to another service", errPortConflict), 409},
+		{errors.New("address already in use"), 500},
+	}
+	for _, tt := range tests {
+		if status := portStatus(tt.err); status != tt.status {
+			t.Errorf("portStatus(%v) = %d, want %d", tt.err, status, tt.status)
+		}
+	}
+}
+
+func TestAuthorizeDomains(t *testing.T) {
+	user := &User{
+		Name:          "alice",
+		ExternalTypes: parseTypeSet("http"),
+		TunnelTypes:   parseTypeSet("tcp4"),
+		Domains:       domainSet(parseTypeSet("www.example.com, *.example.org")),
+	}
+	tests := []struct {
+		name    string
+		domains string
+		err     error
+	}{
+		{"granted", "www.example.com", nil},
+		{"subdomain of a wildcard", "a.b.example.org", nil},
+		{"the wildcard itself", "*.example.org", nil},
+		{"all granted", "www.example.com, app.example.org", nil},
+		{"not granted", "evil.example.com", errForbidden},
+		{"base of a wildcard", "example.org", errForbidden},
+		{"one of them not granted", "www.example.com, www.example.net", errForbidden},
+		{"wider wildcard", "*.com", errForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &Service{ExternalType: "http", TunnelType: "tcp4", CustomDomains: parseDomains(tt.domains)}
+			if err := user.authorize(service); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	service := &Service{ExternalType: "http", TunnelType: "tcp4", CustomDomains: parseDomains("anything.net")}
+	if err := (&User{Name: "bob", ExternalTypes: parseTypeSet("*"), TunnelTypes: parseTypeSet("*")}).authorize(service); !errors.Is(err, errForbidden) {
+		t.Fatalf("a user without Domains is granted a domain: %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"pTunnel/conn"
+	"pTunnel/utils/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vhostReadTimeout = 10 * time.Second
+	maxRequestHead   = 64 * 1024
+)
+
+var errRequestHeadTooLarge = errors.New("request header too large")
+
+const notFoundPage = `<!DOCTYPE html>
+<html>
+<head><title>404 Not Found</title></head>
+<body>
+<h1>404 Not Found</h1>
+<p>The domain %s is not served by this server.</p>
+</body>
+</html>
+`
+
+// vhostRouter accepts http connections on VhostHTTPPort and hands each of
+// them to the service that registered the domain in its Host header
+type vhostRouter struct {
+	Listener conn.Listener
+	lock     sync.RWMutex
+	routes   map[string]*vhostListener
+}
+
+var router *vhostRouter
+
+func newVhostRouter(port int) (*vhostRouter, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := conn.NewTCPListener(addr, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	return &vhostRouter{
+		Listener: listener,
+		routes:   make(map[string]*vhostListener),
+	}, nil
+}
+
+func (router *vhostRouter) serve() {
+	log.Info("Vhost http router started at %s", router.Listener.Address().String())
+	for {
+		accept, err := router.Listener.Accept()
+		if err != nil {
+			log.Error("Failed to accept http connection. Error: %v", err)
+			return
+		}
+		go router.route(accept)
+	}
+}
+
+// route reads the header of the first request to find the host, the
+// service is handed a socket that forwards the untouched requests
+func (router *vhostRouter) route(socket conn.Socket) {
+	timer := time.AfterFunc(vhostReadTimeout, func() {
+		_ = socket.Close()
+	})
+	reader := bufio.NewReaderSize(socket, maxRequestHead)
+	head, request, err := readRequestHead(reader)
+	if !timer.Stop() || err != nil {
+		log.Debug("Failed to read http request from %s. Error: %v", socket.RemoteAddr(), err)
+		_ = socket.Close()
+		return
+	}
+	host := requestHost(request)
+	listener := router.lookup(host)
+	if listener == nil {
+		log.Debug("No service for domain %s", host)
+		writeNotFound(socket, host)
+		_ = socket.Close()
+		return
+	}
+	vhost := newVhostSocket(socket, reader, listener, head, request)
+	if !listener.push(vhost) {
+		writeNotFound(socket, host)
+		_ = vhost.Close()
+	}
+}
+
+// readRequestHead reads the request line and the header of the next request
+// of a connection, it returns them untouched and parsed
+func readRequestHead(reader *bufio.Reader) ([]byte, *http.Request, error) {
+	var head []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = errRequestHeadTooLarge
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		blank := len(bytes.TrimRight(line, "\r\n")) == 0
+		// empty lines before the request line are ignored
+		if blank && len(head) == 0 {
+			continue
+		}
+		head = append(head, line...)
+		if len(head) > maxRequestHead {
+			return nil, nil, errRequestHeadTooLarge
+		}
+		if blank {
+			break
+		}
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return head, request, nil
+}
+
+// requestHost returns the domain of the Host header of request
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// copyRequestBody copies the body of request from reader to w untouched
+func copyRequestBody(w io.Writer, reader *bufio.Reader, request *http.Request) error {
+	if len(request.TransferEncoding) == 0 {
+		if request.ContentLength > 0 {
+			_, err := io.CopyN(w, reader, request.ContentLength)
+			return err
+		}
+		return nil
+	}
+	// http.ReadRequest only accepts chunked
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+		sizeField, _, _ := strings.Cut(string(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid chunk size %q", strings.TrimSpace(sizeField))
+		}
+		if size == 0 {
+			break
+		}
+		// the data and its CRLF
+		if _, err = io.CopyN(w, reader, size+2); err != nil {
+			return err
+		}
+	}
+	// the trailer ends with an empty line
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil
+		}
+	}
+}
+
+// lookup returns the listener of domain, "*.example.com" matches
+// every subdomain of example.com that is not registered itself
+func (router *vhostRouter) lookup(domain string) *vhostListener {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	if listener, ok := router.routes[domain]; ok {
+		return listener
+	}
+	for parts := strings.Split(domain, "."); len(parts) > 1; parts = parts[1:] {
+		if listener, ok := router.routes["*."+strings.Join(parts[1:], ".")]; ok {
+			return listener
+		}
+	}
+	return nil
+}
+
+// register creates a listener receiving the connections of domains
+func (router *vhostRouter) register(domains []string) (*vhostListener, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("CustomDomains is not set")
+	}
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	for _, domain := range domains {
+		if _, ok := router.routes[domain]; ok {
+			return nil, errors.New("domain is already in use: " + domain)
+		}
+	}
+	listener := &vhostListener{
+		router:     router,
+		domains:    domains,
+		acceptChan: make(chan conn.Socket),
+		closeChan:  make(chan struct{}),
+	}
+	for _, domain := range domains {
+		router.routes[domain] = listener
+	}
+	return listener, nil
+}
+
+func (router *vhostRouter) unregister(listener *vhostListener) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	for _, domain := range listener.domains {
+		if router.routes[domain] == listener {
+			delete(router.routes, domain)
+		}
+	}
+}
+
+func writeNotFound(socket conn.Socket, host string) {
+	body := fmt.Sprintf(notFoundPage, html.EscapeString(host))
+	header := fmt.Sprintf(
+		"HTTP/1.1 404 Not Found\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n",
+		len(body),
+	)
+	_, _ = socket.Write([]byte(header + body))
+}
+
+// vhostListener is the ExternalListener of a service with the http ExternalType
+type vhostListener struct {
+	router     *vhostRouter
+	domains    []string
+	acceptChan chan conn.Socket
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+func (listener *vhostListener) push(socket conn.Socket) bool {
+	select {
+	case listener.acceptChan <- socket:
+		return true
+	case <-listener.closeChan:
+		return false
+	}
+}
+
+func (listener *vhostListener) Accept() (conn.Socket, error) {
+	select {
+	case socket := <-listener.acceptChan:
+		return socket, nil
+	case <-listener.closeChan:
+		return nil, errors.New("vhost listener closed")
+	}
+}
+
+func (listener *vhostListener) Close() error {
+	listener.closeOnce.Do(func() {
+		listener.router.unregister(listener)
+		close(listener.closeChan)
+	})
+	return nil
+}
+
+func (listener *vhostListener) Network() string {
+	return "http"
+}
+
+func (listener *vhostListener) Address() net.Addr {
+	return listener.router.Listener.Address()
+}
+
+// vhostSocket forwards the requests of a keep-alive connection to the
+// service as long as their Host is routed to it. The connection is closed
+// at the first request for another service, the client sends it again on a
+// new connection which is routed on its own.
+type vhostSocket struct {
+	conn.Socket
+	reader *bufio.Reader
+	pipe   *io.PipeReader
+}
+
+// newVhostSocket starts forwarding the requests read by the router from
+// reader, head and request are the first one
+func newVhostSocket(socket conn.Socket, reader *bufio.Reader, listener *vhostListener, head []byte, request *http.Request) *vhostSocket {
+	pr, pw := io.Pipe()
+	vhost := &vhostSocket{
+		Socket: socket,
+		reader: bufio.NewReader(pr),
+		pipe:   pr,
+	}
+	go vhost.forward(pw, reader, listener, head, request)
+	return vhost
+}
+
+func (socket *vhostSocket) forward(w *io.PipeWriter, reader *bufio.Reader, listener *vhostListener, head []byte, request *http.Request) {
+	var err error
+	for {
+		if _, err = w.Write(head); err != nil {
+			break
+		}
+		if err = copyRequestBody(w, reader, request); err != nil {
+			break
+		}
+		// the connection is no longer http after an upgrade
+		if request.Method == http.MethodConnect || request.Header.Get("Upgrade") != "" {
+			_, err = io.Copy(w, reader)
+			break
+		}
+		if head, request, err = readRequestHead(reader); err != nil {
+			break
+		}
+		if host := requestHost(request); listener.router.lookup(host) != listener {
+			log.Debug("Closed the http connection from %s, the domain %s belongs to another service", socket.RemoteAddr(), host)
+			err = io.EOF
+			break
+		}
+	}
+	_ = w.CloseWithError(err)
+}
+
+// Close also stops forwarding the requests
+func (socket *vhostSocket) Close() error {
+	_ = socket.pipe.Close()
+	return socket.Socket.Close()
+}
+
+func (socket *vhostSocket) Read(p []byte) (n int, err error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *vhostSocket) ReadLine() (data []byte, err error) {
+	data, err = socket.reader.ReadBytes('\n')
+	return
+}
+
+// parseDomains splits the comma separated CustomDomains of a client
+func parseDomains(customDomains string) []string {
+	var domains []string
+	for _, domain := range strings.Split(customDomains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"pTunnel/conn"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRouter(t *testing.T) *vhostRouter {
+	t.Helper()
+	r, err := newVhostRouter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.serve()
+	t.Cleanup(func() { _ = r.Listener.Close() })
+	return r
+}
+
+func registerTest(t *testing.T, r *vhostRouter, domains ...string) *vhostListener {
+	t.Helper()
+	listener, err := r.register(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+func dialRouter(t *testing.T, r *vhostRouter) net.Conn {
+	t.Helper()
+	port := r.Listener.Address().(*net.TCPAddr).Port
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func acceptTest(t *testing.T, listener *vhostListener) conn.Socket {
+	t.Helper()
+	accepted := make(chan conn.Socket, 1)
+	go func() {
+		socket, err := listener.Accept()
+		if err == nil {
+			accepted <- socket
+		}
+	}()
+	select {
+	case socket := <-accepted:
+		t.Cleanup(func() { _ = socket.Close() })
+		return socket
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection is routed to the service")
+		return nil
+	}
+}
+
+// readAll reads n bytes from socket
+func readAll(t *testing.T, socket io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(socket, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestVhostLookup(t *testing.T) {
+	r := &vhostRouter{routes: make(map[string]*vhostListener)}
+	exact := &vhostListener{}
+	wildcard := &vhostListener{}
+	sub := &vhostListener{}
+	r.routes["www.example.com"] = exact
+	r.routes["*.example.org"] = wildcard
+	r.routes["api.example.org"] = sub
+	tests := []struct {
+		domain string
+		want   *vhostListener
+	}{
+		{"www.example.com", exact},
+		{"example.com", nil},
+		{"a.www.example.com", nil},
+		{"www.example.org", wildcard},
+		{"a.b.example.org", wildcard},
+		{"api.example.org", sub},
+		{"example.org", nil},
+		{"unknown.net", nil},
+	}
+	for _, tt := range tests {
+		if got := r.lookup(tt.domain); got != tt.want {
+			t.Errorf("lookup(%q) returned the wrong listener", tt.domain)
+		}
+	}
+}
+
+func TestVhostRouting(t *testing.T) {
+	r := newTestRouter(t)
+	app := registerTest(t, r, "app.example.com")
+	wildcard := registerTest(t, r, "*.example.org")
+	tests := []struct {
+		name     string
+		host     string
+		listener *vhostListener
+	}{
+		{"exact", "app.example.com", app},
+		{"with port and case", "APP.example.com:8080", app},
+		{"wildcard", "www.example.org", wildcard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := "GET /path HTTP/1.1\r\nHost: " + tt.host + "\r\nX-Test: 1\r\n\r\n"
+			c := dialRouter(t, r)
+			if _, err := c.Write([]byte(request)); err != nil {
+				t.Fatal(err)
+			}
+			socket := acceptTest(t, tt.listener)
+			if got := readAll(t, socket, len(request)); got != request {
+				t.Fatalf("the service got %q, want the untouched request", got)
+			}
+		})
+	}
+
+	t.Run("unknown domain", func(t *testing.T) {
+		c := dialRouter(t, r)
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: unknown.net\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusNotFound {
+			t.Fatalf("got %s, want 404", response.Status)
+		}
+	})
+}
+
+func TestVhostKeepAlive(t *testing.T) {
+	r := newTestRouter(t)
+	app := registerTest(t, r, "app.example.com", "*.app.example.com")
+	registerTest(t, r, "other.example.com")
+
+	requests := []string{
+		"POST /a HTTP/1.1\r\nHost: app.example.com\r\nContent-Length: 5\r\n\r\nhello",
+		"POST /b HTTP/1.1\r\nHost: app.example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nTrailer: x\r\n\r\n",
+		// another domain of the same service stays on the connection
+		"GET /c HTTP/1.1\r\nHost: www.app.example.com\r\n\r\n",
+	}
+	c := dialRouter(t, r)
+	if _, err := c.Write([]byte(requests[0])); err != nil {
+		t.Fatal(err)
+	}
+	socket := acceptTest(t, app)
+	for i, request := range requests {
+		if i > 0 {
+			if _, err := c.Write([]byte(request)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := readAll(t, socket, len(request)); got != request {
+			t.Fatalf("request %d: the service got %q", i, got)
+		}
+	}
+
+	// a request for another service must not reach this one
+	if _, err := c.Write([]byte("GET /d HTTP/1.1\r\nHost: other.example.com\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(socket)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("the service got %q and %v, want EOF", data, err)
+	}
+	// the tunnel closes the socket at EOF, which closes the connection
+	_ = socket.Close()
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatal("the connection is still open")
+	}
+}
+
+func TestReadRequestHeadTooLarge(t *testing.T) {
+	request := "GET / HTTP/1.1\r\nHost: app.example.com\r\nX-Big: " + strings.Repeat("x", maxRequestHead) + "\r\n\r\n"
+	_, _, err := readRequestHead(bufio.NewReaderSize(strings.NewReader(request), maxRequestHead))
+	if err != errRequestHeadTooLarge {
+		t.Fatalf("got %v, want errRequestHeadTooLarge", err)
+	}
+}
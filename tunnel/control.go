@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"errors"
+	"pTunnel/conn"
+	"pTunnel/utils/serialize"
+)
+
+// ControlChannel carries the control messages of a session in the records
+// of SafeTunnel. Every direction has its own key and the record counter is
+// the nonce, so a message can neither be replayed nor reflected to its
+// sender, and the channel is rekeyed after RekeyBytes or RekeyInterval.
+// WriteMsg and ReadMsg may each be called by one goroutine at a time.
+type ControlChannel struct {
+	writer *FrameWriter
+	reader *FrameReader
+}
+
+// NewControlChannel starts the control channel on socket once the session
+// is authenticated, sessionKey is the key of the handshake and side is
+// ClientSide or ServerSide
+func NewControlChannel(socket conn.Socket, sessionKey []byte, side int) (*ControlChannel, error) {
+	sendKey, recvKey, err := frameKeys(sessionKey, "control", side)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewFrameWriter(socket, sendKey, RekeyBytes, RekeyInterval)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewFrameReader(socket, recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlChannel{writer: writer, reader: reader}, nil
+}
+
+func (channel *ControlChannel) WriteMsg(msg map[string]interface{}) error {
+	data, err := serialize.Serialize(&msg)
+	if err != nil {
+		return err
+	}
+	return channel.writer.WriteFrame(frameData, data)
+}
+
+func (channel *ControlChannel) ReadMsg() (map[string]interface{}, error) {
+	frameType, data, err := channel.reader.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frameType != frameData {
+		return nil, errors.New("unknown control frame")
+	}
+	msg := make(map[string]interface{})
+	if err = serialize.Deserialize(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
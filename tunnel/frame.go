@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"pTunnel/utils/security"
+	"time"
+)
+
+// Record layout on the wire:
+//
+//	+----------------+------+---------------------------+
+//	| length(uint32) | type | AEAD(payload) || tag      |
+//	+----------------+------+---------------------------+
+//
+// length is the size of the sealed payload, the 5 bytes header is
+// authenticated as additional data. Every direction has its own key
+// and the nonce is the number of records sent so far in that direction.
+//
+// A frameRekey record, which has no payload, is the last record sealed
+// under the current key of its direction, the records after it are sealed
+// under security.NextKey of that key with the nonce starting from 0 again.
+
+const (
+	frameHeaderSize = 5
+	maxFramePayload = 16 * 1024
+)
+
+const (
+	frameData byte = iota
+	frameRekey
+)
+
+const (
+	// ClientSide is the side that dials the tunnel
+	ClientSide = iota
+	// ServerSide is the side that accepts the tunnel
+	ServerSide
+)
+
+var (
+	errFrameTooLarge   = errors.New("frame too large")
+	errCounterOverflow = errors.New("frame counter overflow")
+)
+
+// frameKeys derives the send and receive keys of side from secretKey, name
+// tells apart the channels which are keyed by the same secret
+func frameKeys(secretKey []byte, name string, side int) (sendKey []byte, recvKey []byte, err error) {
+	c2s, err := security.DeriveKey(secretKey, "pTunnel "+name+" client to server", 32)
+	if err != nil {
+		return
+	}
+	s2c, err := security.DeriveKey(secretKey, "pTunnel "+name+" server to client", 32)
+	if err != nil {
+		return
+	}
+	if side == ClientSide {
+		return c2s, s2c, nil
+	}
+	return s2c, c2s, nil
+}
+
+type frameCipher struct {
+	aead    cipher.AEAD
+	key     []byte
+	counter uint64
+	nonce   []byte
+}
+
+func newFrameCipher(key []byte) (*frameCipher, error) {
+	aead, err := security.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{
+		aead:  aead,
+		key:   key,
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+// next returns the cipher that takes over after a frameRekey record
+func (c *frameCipher) next() (*frameCipher, error) {
+	key, err := security.NextKey(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return newFrameCipher(key)
+}
+
+// nextNonce returns the nonce of the next record
+func (c *frameCipher) nextNonce() ([]byte, error) {
+	if c.counter == ^uint64(0) {
+		return nil, errCounterOverflow
+	}
+	binary.BigEndian.PutUint64(c.nonce[len(c.nonce)-8:], c.counter)
+	c.counter++
+	return c.nonce, nil
+}
+
+// FrameWriter seals records and writes them to the underlying writer, it
+// rekeys after rekeyBytes bytes or rekeyInterval, 0 disables either limit
+type FrameWriter struct {
+	writer io.Writer
+	cipher *frameCipher
+	rekey  *security.RekeyCounter
+	buf    []byte
+}
+
+func NewFrameWriter(writer io.Writer, key []byte, rekeyBytes int64, rekeyInterval time.Duration) (*FrameWriter, error) {
+	c, err := newFrameCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameWriter{
+		writer: writer,
+		cipher: c,
+		rekey:  security.NewRekeyCounter(rekeyBytes, rekeyInterval),
+		buf:    make([]byte, 0, frameHeaderSize+maxFramePayload+c.aead.Overhead()),
+	}, nil
+}
+
+func (w *FrameWriter) WriteFrame(frameType byte, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return errFrameTooLarge
+	}
+	if err := w.writeRecord(frameType, payload); err != nil {
+		return err
+	}
+	if !w.rekey.Add(len(payload)) {
+		return nil
+	}
+	return w.Rekey()
+}
+
+// Rekey tells the reader to switch to the next key and switches to it
+func (w *FrameWriter) Rekey() error {
+	if err := w.writeRecord(frameRekey, nil); err != nil {
+		return err
+	}
+	next, err := w.cipher.next()
+	if err != nil {
+		return err
+	}
+	w.cipher = next
+	w.rekey.Reset()
+	return nil
+}
+
+func (w *FrameWriter) writeRecord(frameType byte, payload []byte) error {
+	nonce, err := w.cipher.nextNonce()
+	if err != nil {
+		return err
+	}
+	header := w.buf[:frameHeaderSize]
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+w.cipher.aead.Overhead()))
+	header[4] = frameType
+	record := w.cipher.aead.Seal(header, nonce, payload, header)
+	_, err = w.writer.Write(record)
+	return err
+}
+
+// FrameReader reads records from the underlying reader and opens them
+type FrameReader struct {
+	reader io.Reader
+	cipher *frameCipher
+	buf    []byte
+}
+
+func NewFrameReader(reader io.Reader, key []byte) (*FrameReader, error) {
+	c, err := newFrameCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameReader{
+		reader: reader,
+		cipher: c,
+		buf:    make([]byte, frameHeaderSize+maxFramePayload+c.aead.Overhead()),
+	}, nil
+}
+
+// ReadFrame returns the type and the payload of the next record, the payload
+// is only valid until the next call. frameRekey records are handled here and
+// never returned.
+func (r *FrameReader) ReadFrame() (byte, []byte, error) {
+	for {
+		frameType, payload, err := r.readRecord()
+		if err != nil || frameType != frameRekey {
+			return frameType, payload, err
+		}
+		if len(payload) != 0 {
+			return 0, nil, errors.New("invalid rekey frame")
+		}
+		if r.cipher, err = r.cipher.next(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+func (r *FrameReader) readRecord() (byte, []byte, error) {
+	header := r.buf[:frameHeaderSize]
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length < r.cipher.aead.Overhead() || length > maxFramePayload+r.cipher.aead.Overhead() {
+		return 0, nil, errFrameTooLarge
+	}
+	sealed := r.buf[frameHeaderSize : frameHeaderSize+length]
+	if _, err := io.ReadFull(r.reader, sealed); err != nil {
+		return 0, nil, err
+	}
+	nonce, err := r.cipher.nextNonce()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := r.cipher.aead.Open(sealed[:0], nonce, sealed, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"pTunnel/utils/security"
+	"testing"
+)
+
+func testKey() []byte {
+	return bytes.Repeat([]byte{7}, 32)
+}
+
+// sealRecords returns the records written for payloads, each on its own
+func sealRecords(t *testing.T, key []byte, payloads ...[]byte) [][]byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewFrameWriter(&buf, key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records [][]byte
+	for _, payload := range payloads {
+		if err = w.WriteFrame(frameData, payload); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return records
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"small", 1000},
+		{"max", maxFramePayload},
+	}
+	key := testKey()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, tt.size)
+			var buf bytes.Buffer
+			w, err := NewFrameWriter(&buf, key, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err = w.WriteFrame(frameData, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := NewFrameReader(&buf, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				frameType, got, err := r.ReadFrame()
+				if err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+				if frameType != frameData || !bytes.Equal(got, payload) {
+					t.Fatalf("record %d: got type %d and %d bytes", i, frameType, len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestFrameTampered(t *testing.T) {
+	key := testKey()
+	record := sealRecords(t, key, []byte("hello pTunnel"))[0]
+	tests := []struct {
+		name  string
+		index int
+	}{
+		{"length", 3},
+		{"type", 4},
+		{"body", frameHeaderSize},
+		{"tag", len(record) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := append([]byte(nil), record...)
+			tampered[tt.index] ^= 1
+			r, err := NewFrameReader(bytes.NewReader(tampered), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = r.ReadFrame(); err == nil {
+				t.Fatal("tampered record is accepted")
+			}
+		})
+	}
+}
+
+func TestFrameOrder(t *testing.T) {
+	key := testKey()
+	records := sealRecords(t, key, []byte("first"), []byte("second"))
+	tests := []struct {
+		name     string
+		records  [][]byte
+		rejected int // the index of the first rejected record
+	}{
+		{"reordered", [][]byte{records[1], records[0]}, 0},
+		{"replayed", [][]byte{records[0], records[0]}, 1},
+		{"dropped", [][]byte{records[1]}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewFrameReader(bytes.NewReader(bytes.Join(tt.records, nil)), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.records {
+				_, _, err = r.ReadFrame()
+				if i < tt.rejected && err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+				if i == tt.rejected && err == nil {
+					t.Fatalf("record %d out of order is accepted", i)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameRekey(t *testing.T) {
+	key := testKey()
+	var buf bytes.Buffer
+	w, err := NewFrameWriter(&buf, key, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextKey, err := security.NextKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{'x'}, 60)
+
+	// 60 bytes are below RekeyBytes
+	if err = w.WriteFrame(frameData, payload); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.cipher.key, key) {
+		t.Fatal("rekeyed before RekeyBytes")
+	}
+	// 120 bytes are not
+	if err = w.WriteFrame(frameData, payload); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.cipher.key, nextKey) || w.cipher.counter != 0 {
+		t.Fatal("not rekeyed after RekeyBytes")
+	}
+	if err = w.WriteFrame(frameData, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewFrameReader(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		frameType, got, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if frameType != frameData || !bytes.Equal(got, payload) {
+			t.Fatalf("record %d: got type %d and %d bytes", i, frameType, len(got))
+		}
+	}
+	if !bytes.Equal(r.cipher.key, nextKey) {
+		t.Fatal("reader has not followed the rekey")
+	}
+}
+
+func TestFrameMaxLength(t *testing.T) {
+	key := testKey()
+	w, err := NewFrameWriter(&bytes.Buffer{}, key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteFrame(frameData, make([]byte, maxFramePayload+1)); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("WriteFrame of a too large payload: %v", err)
+	}
+
+	overhead := w.cipher.aead.Overhead()
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{"too large", maxFramePayload + overhead + 1},
+		{"shorter than the tag", overhead - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make([]byte, frameHeaderSize)
+			binary.BigEndian.PutUint32(header, uint32(tt.length))
+			record := append(header, make([]byte, tt.length)...)
+			r, err := NewFrameReader(bytes.NewReader(record), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = r.ReadFrame(); !errors.Is(err, errFrameTooLarge) {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"pTunnel/conn"
+	"pTunnel/utils/metrics"
+)
+
+// Stats counts the bytes forwarded by a tunnel
+type Stats struct {
+	In  *metrics.Counter // the bytes read from the request
+	Out *metrics.Counter // the bytes written to the request
+}
+
+// NewStats returns stats with counters of their own
+func NewStats() *Stats {
+	return &Stats{In: new(metrics.Counter), Out: new(metrics.Counter)}
+}
+
+// ServiceStats returns the stats of the tunnel byte metrics of a service
+func ServiceStats(client string, service string) *Stats {
+	return &Stats{
+		In:  metrics.TunnelBytesIn.With(client, service),
+		Out: metrics.TunnelBytesOut.With(client, service),
+	}
+}
+
+// countedSocket is a request socket which counts its bytes into stats
+type countedSocket struct {
+	conn.Socket
+	stats []*Stats
+}
+
+// NewCountedSocket wraps the request socket of a tunnel so that the bytes
+// forwarded by UnsafeTunnel and SafeTunnel are counted into every stats
+func NewCountedSocket(socket conn.Socket, stats ...*Stats) conn.Socket {
+	return &countedSocket{Socket: socket, stats: stats}
+}
+
+func (socket *countedSocket) Read(p []byte) (int, error) {
+	n, err := socket.Socket.Read(p)
+	for _, stats := range socket.stats {
+		stats.In.Add(int64(n))
+	}
+	return n, err
+}
+
+func (socket *countedSocket) Write(p []byte) (int, error) {
+	n, err := socket.Socket.Write(p)
+	for _, stats := range socket.stats {
+		stats.Out.Add(int64(n))
+	}
+	return n, err
+}
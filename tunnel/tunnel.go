@@ -1,73 +1,270 @@
 package tunnel
 
 import (
-	"bufio"
-	"crypto/md5"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"pTunnel/conn"
 	"pTunnel/utils/log"
 	"pTunnel/utils/security"
 	"pTunnel/utils/serialize"
+	"strconv"
 	"sync"
+	"time"
 )
 
-func constructSafetyMsg(secretKey []byte) ([]byte, error) {
-	dict := make(map[string]interface{})
-	dict["SecretKey"] = string(secretKey)
-	dict["Salt"] = string(md5.New().Sum(nil))
-	bytes, err := serialize.Serialize(&dict)
+// The limits after which SafeTunnel switches to the next key of a
+// direction, 0 disables either limit
+var (
+	RekeyBytes    int64 = 1 << 30
+	RekeyInterval       = time.Hour
+)
+
+// The tunnel safety check authenticates both ends of a new tunnel with the
+// secret key of the service and derives the key of the tunnel:
+//
+//	client -> server: Hello{ConnID, Nonce: Nc}
+//	server -> client: Challenge{Nonce: Ns, MAC: HMAC("server", ConnID, Nc, Ns)}
+//	client -> server: Response{Timestamp, MAC: HMAC("client", ConnID, Nc, Ns, Timestamp)}
+//
+// Each MAC covers the fresh nonce of the peer, so it is only valid on this
+// tunnel, and the server also rejects the ConnIDs it has seen and stale
+// timestamps. The client speaks first because kcp and quic only accept a
+// connection once it has data, the timestamp is only sent in the response
+// because a pooled tunnel is checked when it is paired with a request. The
+// tunnel key is derived from all of them, so no two tunnels share a key.
+
+const (
+	checkNonceSize = 32
+	checkMACLabel  = "pTunnel tunnel check"
+	checkKeyLabel  = "pTunnel tunnel key"
+)
+
+var errTunnelCheck = errors.New("tunnel safety check failed")
+
+// checkTranscript holds the values the MACs and the tunnel key are bound to,
+// the timestamp is empty in the MAC of the server
+type checkTranscript struct {
+	connID      string
+	clientNonce []byte
+	serverNonce []byte
+	timestamp   string
+}
+
+func (t *checkTranscript) bytes() []byte {
+	var buf bytes.Buffer
+	for _, field := range [][]byte{[]byte(t.connID), t.clientNonce, t.serverNonce, []byte(t.timestamp)} {
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+func (t *checkTranscript) mac(secretKey []byte, side string) ([]byte, error) {
+	key, err := security.DeriveKey(secretKey, checkMACLabel, 32)
 	if err != nil {
 		return nil, err
 	}
-	bytes, err = security.AESEncryptBase64(bytes, secretKey)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(side))
+	h.Write(t.bytes())
+	return h.Sum(nil), nil
+}
+
+// tunnelKey is the key SafeTunnel uses for this tunnel only
+func (t *checkTranscript) tunnelKey(secretKey []byte) ([]byte, error) {
+	return security.DeriveKey(secretKey, checkKeyLabel+string(t.bytes()), 32)
+}
+
+func writeCheckMsg(tunnel conn.Socket, msg map[string]interface{}) error {
+	data, err := serialize.Serialize(&msg)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return bytes, nil
+	return tunnel.WriteLine(security.Base64Encoding(data))
 }
 
-func verifySafetyMsg(msg []byte, secretKey []byte) bool {
-	bytes, err := security.AESDecryptBase64(msg, secretKey)
+func readCheckMsg(tunnel conn.Socket) (map[string]interface{}, error) {
+	line, err := tunnel.ReadLine()
 	if err != nil {
-		return false
+		return nil, err
 	}
-	dict := make(map[string]interface{})
-	err = serialize.Deserialize(bytes, &dict)
-	return err == nil && dict["SecretKey"].(string) == string(secretKey)
+	data, err := security.Base64Decoding(trimLine(line))
+	if err != nil {
+		return nil, err
+	}
+	msg := make(map[string]interface{})
+	if err = serialize.Deserialize(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// checkField returns the base64 decoded field of a check message
+func checkField(msg map[string]interface{}, field string) ([]byte, error) {
+	str, ok := msg[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is missing", errTunnelCheck, field)
+	}
+	return base64.StdEncoding.DecodeString(str)
+}
+
+func randomNonce() ([]byte, error) {
+	nonce := make([]byte, checkNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
 }
 
-func ClientTunnelSafetyCheck(tunnel conn.Socket, secretKey []byte) bool {
-	bytes, err := constructSafetyMsg(secretKey)
+// ClientTunnelSafetyCheck runs the safety check on a new tunnel as the side
+// that dials it, it returns the ConnID and the key of the tunnel
+func ClientTunnelSafetyCheck(tunnel conn.Socket, secretKey []byte) (string, []byte, error) {
+	var err error
+	t := &checkTranscript{connID: security.GenNonce()}
+	if t.clientNonce, err = randomNonce(); err != nil {
+		return "", nil, err
+	}
+	err = writeCheckMsg(tunnel, map[string]interface{}{
+		"ConnID": t.connID,
+		"Nonce":  base64.StdEncoding.EncodeToString(t.clientNonce),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	challenge, err := readCheckMsg(tunnel)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.serverNonce, err = checkField(challenge, "Nonce"); err != nil {
+		return "", nil, err
+	}
+	if len(t.serverNonce) != checkNonceSize {
+		return "", nil, fmt.Errorf("%w: invalid server nonce", errTunnelCheck)
+	}
+	serverMAC, err := checkField(challenge, "MAC")
+	if err != nil {
+		return "", nil, err
+	}
+	mac, err := t.mac(secretKey, "server")
 	if err != nil {
-		return false
+		return "", nil, err
+	}
+	if !hmac.Equal(mac, serverMAC) {
+		return "", nil, fmt.Errorf("%w: invalid server MAC of tunnel %s", errTunnelCheck, t.connID)
+	}
+
+	t.timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	if mac, err = t.mac(secretKey, "client"); err != nil {
+		return "", nil, err
 	}
-	fmt.Println("write safety msg")
-	err = tunnel.WriteLine(bytes)
+	err = writeCheckMsg(tunnel, map[string]interface{}{
+		"Timestamp": t.timestamp,
+		"MAC":       base64.StdEncoding.EncodeToString(mac),
+	})
 	if err != nil {
-		return false
+		return "", nil, err
 	}
-	fmt.Println("read safety msg")
-	bytes, err = tunnel.ReadLine()
+	key, err := t.tunnelKey(secretKey)
 	if err != nil {
-		return false
+		return "", nil, err
 	}
-	return verifySafetyMsg(bytes, secretKey)
+	return t.connID, key, nil
 }
 
-func ServerTunnelSafetyCheck(tunnel conn.Socket, secretKey []byte) bool {
-	bytes, err := tunnel.ReadLine()
+// ServerTunnelSafetyCheck runs the safety check on a new tunnel as the side
+// that accepts it, it returns the ConnID and the key of the tunnel. replay
+// rejects the ConnIDs seen before and stale responses, it may be nil if
+// secretKey is only used by this tunnel.
+func ServerTunnelSafetyCheck(tunnel conn.Socket, secretKey []byte, replay *security.ReplayCache) (string, []byte, error) {
+	hello, err := readCheckMsg(tunnel)
 	if err != nil {
-		return false
+		return "", nil, err
+	}
+	t := &checkTranscript{}
+	t.connID, _ = hello["ConnID"].(string)
+	if t.clientNonce, err = checkField(hello, "Nonce"); err != nil {
+		return "", nil, err
+	}
+	if t.connID == "" || len(t.clientNonce) != checkNonceSize {
+		return "", nil, fmt.Errorf("%w: invalid client hello", errTunnelCheck)
 	}
-	if !verifySafetyMsg(bytes, secretKey) {
-		return false
+	if t.serverNonce, err = randomNonce(); err != nil {
+		return "", nil, err
 	}
-	bytes, err = constructSafetyMsg(secretKey)
+	mac, err := t.mac(secretKey, "server")
 	if err != nil {
-		return false
+		return "", nil, err
+	}
+	err = writeCheckMsg(tunnel, map[string]interface{}{
+		"Nonce": base64.StdEncoding.EncodeToString(t.serverNonce),
+		"MAC":   base64.StdEncoding.EncodeToString(mac),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	response, err := readCheckMsg(tunnel)
+	if err != nil {
+		return "", nil, err
+	}
+	t.timestamp, _ = response["Timestamp"].(string)
+	clientMAC, err := checkField(response, "MAC")
+	if err != nil {
+		return "", nil, err
+	}
+	if mac, err = t.mac(secretKey, "client"); err != nil {
+		return "", nil, err
 	}
-	err = tunnel.WriteLine(bytes)
-	return err == nil
+	if !hmac.Equal(mac, clientMAC) {
+		return "", nil, fmt.Errorf("%w: invalid client MAC of tunnel %s", errTunnelCheck, t.connID)
+	}
+	// the ConnID is only recorded once the MAC proves it comes from the client
+	if replay != nil {
+		if err = replay.Check(t.connID, t.timestamp); err != nil {
+			return "", nil, fmt.Errorf("%w: tunnel %s: %v", errTunnelCheck, t.connID, err)
+		}
+	}
+	key, err := t.tunnelKey(secretKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return t.connID, key, nil
+}
+
+// p2pRegistrationFields are the fields of a p2p registration covered by its MAC
+var p2pRegistrationFields = []string{"Type", "NATType", "Addr", "Port", "Network", "Timestamp", "Nonce"}
+
+// P2PRegistrationMAC proves that a p2p registration comes from the client of
+// the service, secretKey is the key of the service and handshakeKey the key of
+// the connection the registration is sent over, so the MAC is only valid on it
+func P2PRegistrationMAC(secretKey []byte, handshakeKey []byte, dict map[string]interface{}) ([]byte, error) {
+	key, err := security.DeriveKey(secretKey, "pTunnel p2p registration", 32)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	_ = binary.Write(h, binary.BigEndian, uint32(len(handshakeKey)))
+	h.Write(handshakeKey)
+	for _, field := range p2pRegistrationFields {
+		value, _ := dict[field].(string)
+		_ = binary.Write(h, binary.BigEndian, uint32(len(value)))
+		h.Write([]byte(value))
+	}
+	return h.Sum(nil), nil
+}
+
+func trimLine(line []byte) []byte {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
 }
 
 func UnsafeTunnel(request conn.Socket, worker conn.Socket) {
@@ -97,27 +294,41 @@ func UnsafeTunnel(request conn.Socket, worker conn.Socket) {
 	wait.Wait()
 }
 
-func SafeTunnel(request conn.Socket, worker conn.Socket, secretKey []byte) {
+// SafeTunnel forwards data between request and worker, the data on
+// the worker side is sealed into AEAD records, tunnelKey is the key
+// returned by the safety check of this tunnel, side is ClientSide or
+// ServerSide and selects the keys of each direction
+func SafeTunnel(request conn.Socket, worker conn.Socket, tunnelKey []byte, side int) {
 	var wait sync.WaitGroup
 
-	encryptPipe := func(src conn.Socket, dst conn.Socket, key []byte) {
+	sendKey, recvKey, err := frameKeys(tunnelKey, "tunnel", side)
+	if err != nil {
+		log.Error("Derive tunnel keys failed. Error: %v", err)
+		return
+	}
+	writer, err := NewFrameWriter(worker, sendKey, RekeyBytes, RekeyInterval)
+	if err != nil {
+		log.Error("Create frame writer failed. Error: %v", err)
+		return
+	}
+	reader, err := NewFrameReader(worker, recvKey)
+	if err != nil {
+		log.Error("Create frame reader failed. Error: %v", err)
+		return
+	}
+
+	encryptPipe := func(src conn.Socket, dst *FrameWriter) {
 		defer request.Close()
 		defer worker.Close()
 		defer wait.Done()
-		reader := bufio.NewReader(src)
-		buf := make([]byte, 10*1024)
+		buf := make([]byte, maxFramePayload)
 		for {
-			n, err := reader.Read(buf)
-			if err != nil {
-				log.Debug("Tunnel pipe error: %v", err)
-				return
-			}
-			bytes, err := security.AESEncryptBase64(buf[:n], key)
+			n, err := src.Read(buf)
 			if err != nil {
 				log.Debug("Tunnel pipe error: %v", err)
 				return
 			}
-			err = dst.WriteLine(bytes)
+			err = dst.WriteFrame(frameData, buf[:n])
 			if err != nil {
 				log.Debug("Tunnel pipe error: %v", err)
 				return
@@ -125,19 +336,18 @@ func SafeTunnel(request conn.Socket, worker conn.Socket, secretKey []byte) {
 		}
 	}
 
-	decryptPipe := func(src conn.Socket, dst conn.Socket, key []byte) {
+	decryptPipe := func(src *FrameReader, dst conn.Socket) {
 		defer request.Close()
 		defer worker.Close()
 		defer wait.Done()
 		for {
-			bytes, err := src.ReadLine()
+			frameType, bytes, err := src.ReadFrame()
 			if err != nil {
 				log.Debug("Tunnel pipe error: %v", err)
 				return
 			}
-			bytes, err = security.AESDecryptBase64(bytes, key)
-			if err != nil {
-				log.Debug("Tunnel pipe error: %v", err)
+			if frameType != frameData {
+				log.Debug("Tunnel pipe error: unknown frame type %d", frameType)
 				return
 			}
 			_, err = dst.Write(bytes)
@@ -149,7 +359,7 @@ func SafeTunnel(request conn.Socket, worker conn.Socket, secretKey []byte) {
 	}
 
 	wait.Add(2)
-	go encryptPipe(request, worker, secretKey)
-	go decryptPipe(worker, request, secretKey)
+	go encryptPipe(request, writer)
+	go decryptPipe(reader, request)
 	wait.Wait()
 }
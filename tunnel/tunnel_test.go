@@ -0,0 +1,254 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"pTunnel/conn"
+	"pTunnel/utils/security"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pipeSocket is a conn.Socket over one end of net.Pipe
+type pipeSocket struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPipe() (*pipeSocket, *pipeSocket) {
+	a, b := net.Pipe()
+	return &pipeSocket{Conn: a, reader: bufio.NewReader(a)}, &pipeSocket{Conn: b, reader: bufio.NewReader(b)}
+}
+
+func (socket *pipeSocket) Read(p []byte) (int, error) {
+	return socket.reader.Read(p)
+}
+
+func (socket *pipeSocket) ReadLine() ([]byte, error) {
+	return socket.reader.ReadBytes('\n')
+}
+
+func (socket *pipeSocket) WriteLine(data []byte) error {
+	_, err := socket.Write(append(data, '\n'))
+	return err
+}
+
+func (socket *pipeSocket) Address() (net.Addr, net.Addr) {
+	return socket.LocalAddr(), socket.RemoteAddr()
+}
+
+type checkResult struct {
+	connID string
+	key    []byte
+	err    error
+}
+
+// runCheck runs the server side of the safety check on one end of a pipe and
+// client on the other, each side closes its end when it fails
+func runCheck(secretKey []byte, replay *security.ReplayCache, client func(conn.Socket) checkResult) (checkResult, checkResult) {
+	clientSocket, serverSocket := newPipe()
+	defer clientSocket.Close()
+	defer serverSocket.Close()
+	done := make(chan checkResult)
+	go func() {
+		var result checkResult
+		result.connID, result.key, result.err = ServerTunnelSafetyCheck(serverSocket, secretKey, replay)
+		if result.err != nil {
+			_ = serverSocket.Close()
+		}
+		done <- result
+	}()
+	clientResult := client(clientSocket)
+	if clientResult.err != nil {
+		_ = clientSocket.Close()
+	}
+	return clientResult, <-done
+}
+
+func checkClient(secretKey []byte) func(conn.Socket) checkResult {
+	return func(socket conn.Socket) checkResult {
+		var result checkResult
+		result.connID, result.key, result.err = ClientTunnelSafetyCheck(socket, secretKey)
+		return result
+	}
+}
+
+// scriptedClient runs the client side of the safety check by hand, edit may
+// change the transcript the response is computed over
+func scriptedClient(secretKey []byte, connID string, timestamp string, edit func(*checkTranscript)) func(conn.Socket) checkResult {
+	return func(socket conn.Socket) checkResult {
+		t := &checkTranscript{connID: connID, clientNonce: bytes.Repeat([]byte{1}, checkNonceSize)}
+		err := writeCheckMsg(socket, map[string]interface{}{
+			"ConnID": t.connID,
+			"Nonce":  base64.StdEncoding.EncodeToString(t.clientNonce),
+		})
+		if err != nil {
+			return checkResult{err: err}
+		}
+		challenge, err := readCheckMsg(socket)
+		if err != nil {
+			return checkResult{err: err}
+		}
+		if t.serverNonce, err = checkField(challenge, "Nonce"); err != nil {
+			return checkResult{err: err}
+		}
+		t.timestamp = timestamp
+		if edit != nil {
+			edit(t)
+		}
+		mac, err := t.mac(secretKey, "client")
+		if err != nil {
+			return checkResult{err: err}
+		}
+		err = writeCheckMsg(socket, map[string]interface{}{
+			"Timestamp": timestamp,
+			"MAC":       base64.StdEncoding.EncodeToString(mac),
+		})
+		return checkResult{connID: connID, err: err}
+	}
+}
+
+func now() string {
+	return strconv.FormatInt(time.Now().Unix(), 10)
+}
+
+func TestTunnelSafetyCheck(t *testing.T) {
+	secretKey := testKey()
+	replay := security.NewReplayCache(time.Minute)
+	client, server := runCheck(secretKey, replay, checkClient(secretKey))
+	if client.err != nil || server.err != nil {
+		t.Fatalf("client: %v, server: %v", client.err, server.err)
+	}
+	if client.connID != server.connID || !bytes.Equal(client.key, server.key) {
+		t.Fatal("the sides disagree on the tunnel")
+	}
+
+	client2, server2 := runCheck(secretKey, replay, checkClient(secretKey))
+	if client2.err != nil || server2.err != nil {
+		t.Fatalf("client: %v, server: %v", client2.err, server2.err)
+	}
+	if bytes.Equal(client.key, client2.key) {
+		t.Fatal("two tunnels share a key")
+	}
+}
+
+func TestTunnelSafetyCheckRejected(t *testing.T) {
+	secretKey := testKey()
+	stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	tests := []struct {
+		name   string
+		client func(conn.Socket) checkResult
+		// prepare runs a check on the same replay cache before the test
+		prepare func(conn.Socket) checkResult
+	}{
+		{
+			// the real client already stops at the MAC of the server
+			name:   "wrong key",
+			client: scriptedClient(bytes.Repeat([]byte{8}, 32), "wrong", now(), nil),
+		},
+		{
+			name:   "stale timestamp",
+			client: scriptedClient(secretKey, "stale", stale, nil),
+		},
+		{
+			name:    "reused ConnID",
+			prepare: scriptedClient(secretKey, "reused", now(), nil),
+			client:  scriptedClient(secretKey, "reused", now(), nil),
+		},
+		{
+			name: "mismatched ConnID",
+			client: scriptedClient(secretKey, "hello", now(), func(t *checkTranscript) {
+				t.connID = "other"
+			}),
+		},
+		{
+			name: "replayed Response",
+			// the response of an earlier check does not cover the new server nonce
+			client: scriptedClient(secretKey, "replayed", now(), func(t *checkTranscript) {
+				t.serverNonce = bytes.Repeat([]byte{2}, checkNonceSize)
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := security.NewReplayCache(time.Minute)
+			if tt.prepare != nil {
+				if _, server := runCheck(secretKey, replay, tt.prepare); server.err != nil {
+					t.Fatal(server.err)
+				}
+			}
+			_, server := runCheck(secretKey, replay, tt.client)
+			if !errors.Is(server.err, errTunnelCheck) {
+				t.Fatalf("server: %v, want errTunnelCheck", server.err)
+			}
+		})
+	}
+}
+
+// TestTunnelSafetyCheckWrongServerKey checks that the client rejects a server
+// without the secret key
+func TestTunnelSafetyCheckWrongServerKey(t *testing.T) {
+	clientSocket, serverSocket := newPipe()
+	defer clientSocket.Close()
+	defer serverSocket.Close()
+	go func() {
+		_, _, _ = ServerTunnelSafetyCheck(serverSocket, bytes.Repeat([]byte{8}, 32), nil)
+		_ = serverSocket.Close()
+	}()
+	if _, _, err := ClientTunnelSafetyCheck(clientSocket, testKey()); !errors.Is(err, errTunnelCheck) {
+		t.Fatalf("client: %v, want errTunnelCheck", err)
+	}
+}
+
+func TestSafeTunnel(t *testing.T) {
+	secretKey := testKey()
+	clientWorker, serverWorker := newPipe()
+	var client, server checkResult
+	done := make(chan struct{})
+	go func() {
+		server.connID, server.key, server.err = ServerTunnelSafetyCheck(serverWorker, secretKey, nil)
+		close(done)
+	}()
+	client.connID, client.key, client.err = ClientTunnelSafetyCheck(clientWorker, secretKey)
+	<-done
+	if client.err != nil || server.err != nil {
+		t.Fatalf("client: %v, server: %v", client.err, server.err)
+	}
+
+	// user <-> clientRequest, SafeTunnel, clientWorker <-> serverWorker, SafeTunnel, serverRequest <-> service
+	user, clientRequest := newPipe()
+	service, serverRequest := newPipe()
+	go SafeTunnel(clientRequest, clientWorker, client.key, ClientSide)
+	go SafeTunnel(serverRequest, serverWorker, server.key, ServerSide)
+	defer user.Close()
+	defer service.Close()
+
+	for _, tt := range []struct {
+		name     string
+		src, dst *pipeSocket
+		size     int
+	}{
+		{"to the service", user, service, 100},
+		{"to the user", service, user, 100},
+		{"more than a record", user, service, 3 * maxFramePayload},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{'x'}, tt.size)
+			go func() {
+				_, _ = tt.src.Write(data)
+			}()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(tt.dst, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("the data is changed")
+			}
+		})
+	}
+}
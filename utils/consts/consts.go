@@ -3,6 +3,12 @@ package consts
 const (
 	Heartbeat = iota
 	CreateTunnel
+	Rekey      // no longer sent, the control channel is rekeyed by its records like SafeTunnel
+	Register   // the client starts a service on its session
+	Update     // the client replaces the config of a registered service
+	Unregister // the client stops a service, or the server tells that a service has stopped
+	Reply      // the status of a Register/Update/Unregister, sent by the server
+	P2PResult  // the result of a UDP hole punching paired by the server, sent by the client
 )
 
 const (
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"pTunnel/utils/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value atomic.Int64
+}
+
+func (counter *Counter) Add(n int64) {
+	counter.value.Add(n)
+}
+
+func (counter *Counter) Inc() {
+	counter.value.Add(1)
+}
+
+func (counter *Counter) Value() int64 {
+	return counter.value.Load()
+}
+
+// CounterVec is a family of counters told apart by the values of its labels
+type CounterVec struct {
+	name     string
+	help     string
+	labels   []string
+	lock     sync.Mutex
+	children map[string]*child
+}
+
+type child struct {
+	values  []string
+	counter Counter
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []*CounterVec
+)
+
+// NewCounterVec registers a counter family exported as name
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	vec := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		children: make(map[string]*child),
+	}
+	registryLock.Lock()
+	registry = append(registry, vec)
+	registryLock.Unlock()
+	return vec
+}
+
+// NewCounter registers a counter without labels exported as name
+func NewCounter(name string, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// With returns the counter of the label values, which are in the order of the labels
+func (vec *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(vec.labels) {
+		panic("metrics: " + vec.name + " needs " + strconv.Itoa(len(vec.labels)) + " label values")
+	}
+	key := strings.Join(values, "\x00")
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+	c, ok := vec.children[key]
+	if !ok {
+		c = &child{values: append([]string(nil), values...)}
+		vec.children[key] = c
+	}
+	return &c.counter
+}
+
+func (vec *CounterVec) write(w *bufio.Writer) {
+	vec.lock.Lock()
+	keys := make([]string, 0, len(vec.children))
+	for key := range vec.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, vec.children[key])
+	}
+	vec.lock.Unlock()
+
+	_, _ = w.WriteString("# HELP " + vec.name + " " + escape(vec.help, false) + "\n")
+	_, _ = w.WriteString("# TYPE " + vec.name + " counter\n")
+	for _, c := range children {
+		_, _ = w.WriteString(vec.name)
+		if len(vec.labels) > 0 {
+			_ = w.WriteByte('{')
+			for i, label := range vec.labels {
+				if i > 0 {
+					_ = w.WriteByte(',')
+				}
+				_, _ = w.WriteString(label + "=\"" + escape(c.values[i], true) + "\"")
+			}
+			_ = w.WriteByte('}')
+		}
+		_, _ = w.WriteString(" " + strconv.FormatInt(c.counter.Value(), 10) + "\n")
+	}
+}
+
+// escape escapes a help text or a label value of the text format
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// WriteText writes every registered metric in the Prometheus text format
+func WriteText(writer io.Writer) error {
+	registryLock.Lock()
+	vecs := append([]*CounterVec(nil), registry...)
+	registryLock.Unlock()
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+	w := bufio.NewWriter(writer)
+	for _, vec := range vecs {
+		vec.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler serves the metrics to Prometheus
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteText(w); err != nil {
+			log.Debug("Failed to write metrics. Error: %v", err)
+		}
+	})
+}
+
+// Serve serves the metrics at http://addr/metrics, it returns once the listener fails
+func Serve(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error("Failed to create metrics listener: %v", err)
+		return
+	}
+	log.Info("Metrics started at %s", listener.Addr().String())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err = server.Serve(listener); err != nil {
+		log.Error("Metrics stopped. Error: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+// The metrics of pTunnel, every binary exports all of them. The client label
+// is the identity of the client on the server and the User of the client on
+// the client, it is empty on the proxy. The request of a tunnel is the
+// external user on the server and the proxy, and the internal service on the
+// client.
+var (
+	ConnectionsAccepted = NewCounterVec(
+		"ptunnel_connections_accepted_total",
+		"Connections accepted from the external users.",
+		"client", "service",
+	)
+	TunnelsCreated = NewCounterVec(
+		"ptunnel_tunnels_created_total",
+		"Tunnels which have passed the safety check.",
+		"client", "service",
+	)
+	TunnelBytesIn = NewCounterVec(
+		"ptunnel_tunnel_bytes_in_total",
+		"Bytes read from the requests and forwarded through the tunnels.",
+		"client", "service",
+	)
+	TunnelBytesOut = NewCounterVec(
+		"ptunnel_tunnel_bytes_out_total",
+		"Bytes received through the tunnels and written to the requests.",
+		"client", "service",
+	)
+	SafetyCheckFailures = NewCounterVec(
+		"ptunnel_safety_check_failures_total",
+		"Tunnels which have failed the safety check.",
+		"client", "service",
+	)
+	HeartbeatTimeouts = NewCounter(
+		"ptunnel_heartbeat_timeouts_total",
+		"Control connections closed for missing heartbeats.",
+	)
+	P2PFSMRuns = NewCounterVec(
+		"ptunnel_p2p_fsm_runs_total",
+		"UDP hole punching attempts by FSM type and result(success/failure).",
+		"fsm", "result",
+	)
+	NATTypesDetected = NewCounterVec(
+		"ptunnel_nat_types_detected_total",
+		"NAT types detected with STUN.",
+		"mapping", "filtering",
+	)
+)
+
+// P2PResult is the result label of P2PFSMRuns
+func P2PResult(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
@@ -15,6 +15,7 @@ type SocketWrapper struct {
 	kcpSocket   *conn.KCPSocket
 	kcpListener *conn.KCPListener
 	udpSocket   *net.UDPConn
+	kcpConfig   *conn.KCPConfig
 	cache       []byte
 }
 
@@ -54,14 +55,15 @@ func (fsm *FSM) GetKCPSocket() *conn.KCPSocket {
 	return fsm.socket.kcpSocket
 }
 
-type FsmFn func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM
+type FsmFn func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM
 
 var fsmType2Func = map[string]FsmFn{
-	"Fn10": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn10": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.DialUDP("udp", laddr, raddr)
 		if err != nil {
@@ -107,7 +109,7 @@ var fsmType2Func = map[string]FsmFn{
 			return SEND_SYN2
 		})
 		v.AddState(CREATE_KCP_LISTENER, "CREATE_KCP_LISTENER", func(socket *SocketWrapper) int {
-			listener, err := conn.NewKCPListener(socket.laddr)
+			listener, err := conn.NewKCPListener(socket.laddr, socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP listener. Error: %v\n", err)
 				return ERR_STOP
@@ -132,11 +134,12 @@ var fsmType2Func = map[string]FsmFn{
 		})
 		return v
 	},
-	"Fn11": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn11": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.DialUDP("udp", laddr, raddr)
 		if err != nil {
@@ -178,7 +181,7 @@ var fsmType2Func = map[string]FsmFn{
 			return CREATE_KCP_SOCKET
 		})
 		v.AddState(CREATE_KCP_SOCKET, "CREATE_KCP_SOCKET", func(socket *SocketWrapper) int {
-			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp")
+			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp", socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP socket. Error: %v\n", err)
 				return KILL_KCP_SOCKET
@@ -212,11 +215,12 @@ var fsmType2Func = map[string]FsmFn{
 		})
 		return v
 	},
-	"Fn20": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn20": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.DialUDP("udp", laddr, raddr)
 		if err != nil {
@@ -257,7 +261,7 @@ var fsmType2Func = map[string]FsmFn{
 			return CREATE_KCP_LISTENER
 		})
 		v.AddState(CREATE_KCP_LISTENER, "CREATE_KCP_LISTENER", func(socket *SocketWrapper) int {
-			listener, err := conn.NewKCPListener(socket.laddr)
+			listener, err := conn.NewKCPListener(socket.laddr, socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP listener. Error: %v\n", err)
 				return KILL_KCP_LISTENER
@@ -291,11 +295,12 @@ var fsmType2Func = map[string]FsmFn{
 		})
 		return v
 	},
-	"Fn21": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn21": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.DialUDP("udp", laddr, raddr)
 		if err != nil {
@@ -338,7 +343,7 @@ var fsmType2Func = map[string]FsmFn{
 			return CREATE_KCP_SOCKET
 		})
 		v.AddState(CREATE_KCP_SOCKET, "CREATE_KCP_SOCKET", func(socket *SocketWrapper) int {
-			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp")
+			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp", socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP socket. Error: %v\n", err)
 				return KILL_KCP_SOCKET
@@ -374,11 +379,12 @@ var fsmType2Func = map[string]FsmFn{
 		return v
 	},
 	// TODO: Implement a more robust version of Fn30
-	"Fn30": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn30": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.ListenUDP("udp", laddr)
 		if err != nil {
@@ -437,7 +443,7 @@ var fsmType2Func = map[string]FsmFn{
 			return CREATE_KCP_LISTENER
 		})
 		v.AddState(CREATE_KCP_LISTENER, "CREATE_KCP_LISTENER", func(socket *SocketWrapper) int {
-			listener, err := conn.NewKCPListener(socket.laddr)
+			listener, err := conn.NewKCPListener(socket.laddr, socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP listener. Error: %v\n", err)
 				return KILL_KCP_LISTENER
@@ -471,11 +477,12 @@ var fsmType2Func = map[string]FsmFn{
 		})
 		return v
 	},
-	"Fn31": func(laddr *net.UDPAddr, raddr *net.UDPAddr) *FSM {
+	"Fn31": func(laddr *net.UDPAddr, raddr *net.UDPAddr, kcpConfig *conn.KCPConfig) *FSM {
 		v := NewFSM(&SocketWrapper{
-			laddr: laddr,
-			raddr: raddr,
-			cache: make([]byte, 1024),
+			laddr:     laddr,
+			raddr:     raddr,
+			kcpConfig: kcpConfig,
+			cache:     make([]byte, 1024),
 		})
 		udpSocket, err := net.DialUDP("udp", laddr, raddr)
 		if err != nil {
@@ -518,7 +525,7 @@ var fsmType2Func = map[string]FsmFn{
 			return CREATE_KCP_SOCKET
 		})
 		v.AddState(CREATE_KCP_SOCKET, "CREATE_KCP_SOCKET", func(socket *SocketWrapper) int {
-			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp")
+			kcpSocket, err := conn.NewKCPSocket(socket.laddr, socket.raddr, "udp", socket.kcpConfig)
 			if err != nil {
 				fmt.Printf("Failed to create KCP socket. Error: %v\n", err)
 				return KILL_KCP_SOCKET
@@ -10,6 +10,8 @@ import (
 	"errors"
 	"net"
 	"pTunnel/utils/log"
+	"pTunnel/utils/metrics"
+	"strconv"
 	"time"
 
 	"github.com/pion/stun"
@@ -58,9 +60,23 @@ func CheckNATType(stunServer string, timeout int) (int, int, error) {
 	if err != nil {
 		return mappingType, UNKNOWN, err
 	}
+	metrics.NATTypesDetected.With(natTypeName(mappingNames, mappingType), natTypeName(filteringNames, filteringType)).Inc()
 	return mappingType, filteringType, nil
 }
 
+var (
+	mappingNames   = map[int]string{EIM: "EIM", ADM: "ADM", APDM: "APDM", DIRECT: "DIRECT"}
+	filteringNames = map[int]string{EIF: "EIF", ADF: "ADF", APDF: "APDF"}
+)
+
+// natTypeName names a mapping or filtering type for the metrics
+func natTypeName(names map[int]string, natType int) string {
+	if name, ok := names[natType]; ok {
+		return name
+	}
+	return strconv.Itoa(natType)
+}
+
 // RFC5780: 4.3.  Determining NAT Mapping Behavior
 func mappingTests(stunServer string, timeout int) (int, error) {
 	mapTestConn, err := connect(stunServer)
@@ -0,0 +1,78 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DeriveKey derives a key of the given length from secret with HKDF-SHA256,
+// info separates keys derived for different purposes
+func DeriveKey(secret []byte, info string, length int) ([]byte, error) {
+	key := make([]byte, length)
+	reader := hkdf.New(sha256.New, secret, nil, []byte(info))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewAEAD creates an AES-GCM cipher, the key must be 16, 24 or 32 bytes long
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AEADEncrypt seals data with AES-GCM under a random nonce, the nonce is
+// prepended to the sealed data
+func AEADEncrypt(data []byte, key []byte) ([]byte, error) {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// AEADDecrypt opens data sealed by AEADEncrypt, an error is returned if it
+// has been tampered with or truncated
+func AEADDecrypt(data []byte, key []byte) ([]byte, error) {
+	aead, err := NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("aead message is too short")
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// AEADEncryptBase64 : AEAD encrypt -> Base64 encode
+func AEADEncryptBase64(data []byte, key []byte) ([]byte, error) {
+	encrypted, err := AEADEncrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return Base64Encoding(encrypted), nil
+}
+
+// AEADDecryptBase64 : Base64 decode -> AEAD decrypt
+func AEADDecryptBase64(data []byte, key []byte) ([]byte, error) {
+	data, err := Base64Decoding(data)
+	if err != nil {
+		return nil, err
+	}
+	return AEADDecrypt(data, key)
+}
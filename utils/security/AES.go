@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
+
 	"github.com/thanhpk/randstr"
 )
 
@@ -13,10 +15,21 @@ func PKCS7Padding(data []byte, blockSize int) []byte {
 	return append(data, padText...)
 }
 
-func PKCS7UnPadding(data []byte) []byte {
+func PKCS7UnPadding(data []byte, blockSize int) ([]byte, error) {
 	length := len(data)
+	if length == 0 || length%blockSize != 0 {
+		return nil, errors.New("invalid padded data length")
+	}
 	unPadding := int(data[length-1])
-	return data[:(length - unPadding)]
+	if unPadding == 0 || unPadding > blockSize {
+		return nil, errors.New("invalid padding")
+	}
+	for _, b := range data[length-unPadding:] {
+		if int(b) != unPadding {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return data[:(length - unPadding)], nil
 }
 
 func AESEncrypt(data []byte, key []byte) ([]byte, error) {
@@ -38,11 +51,13 @@ func AESDecrypt(data []byte, key []byte) ([]byte, error) {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
 	blockMode := cipher.NewCBCDecrypter(block, key[:blockSize])
 	decrypted := make([]byte, len(data))
 	blockMode.CryptBlocks(decrypted, data)
-	decrypted = PKCS7UnPadding(decrypted)
-	return decrypted, err
+	return PKCS7UnPadding(decrypted, blockSize)
 }
 
 // AESEncryptBase64 : AES encrypt -> Base64 encode
@@ -0,0 +1,171 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"pTunnel/utils/common"
+	"time"
+)
+
+// The private CA of the server issues the certificates used by mutual tls,
+// its files in the CA directory are:
+//
+//	CA.pem                 the CA certificate, TLSClientCAFile of the server and TLSCAFile of the clients
+//	CAKey.pem              the CA private key, encrypted if a passphrase is given
+//	<name>.pem, <name>.key the certificates issued and their private keys
+
+// GenCA saves a new self-signed CA certificate valid for days days in saveDir
+func GenCA(name string, days int, passphrase string, saveDir string) (*x509.Certificate, error) {
+	if err := common.Mkdir(saveDir, true); err != nil {
+		return nil, err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate(name, days)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+	if err = savePrivateKey(priv, passphrase, saveDir+"/CAKey.pem"); err != nil {
+		return nil, err
+	}
+	if err = saveCertificate(der, saveDir+"/CA.pem"); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// IssueCert issues a certificate with the CA in caDir and saves it with its
+// private key as name.pem and name.key in caDir. A client certificate is
+// issued with name as its CN if hosts is empty, a server certificate for
+// hosts, which are IP addresses or DNS names, otherwise.
+func IssueCert(caDir string, passphrase string, name string, hosts []string, days int) (*x509.Certificate, error) {
+	caCert, caKey, err := loadCA(caDir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate(name, days)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if len(hosts) == 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, priv.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = savePrivateKey(priv, "", caDir+"/"+name+".key"); err != nil {
+		return nil, err
+	}
+	if err = saveCertificate(der, caDir+"/"+name+".pem"); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// CertFingerprint returns the hex sha256 of the certificate in DER form,
+// the format of TLSPinnedCert
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func certTemplate(name string, days int) (*x509.Certificate, error) {
+	if days <= 0 {
+		return nil, errors.New("the certificate must be valid for at least one day")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, days),
+	}, nil
+}
+
+func loadCA(caDir string, passphrase string) (*x509.Certificate, crypto.Signer, error) {
+	data, err := os.ReadFile(caDir + "/CA.pem")
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("CA certificate error")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cert.IsCA {
+		return nil, nil, errors.New("CA.pem is not a CA certificate")
+	}
+	data, err = os.ReadFile(caDir + "/CAKey.pem")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ParsePrivateKey(data, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func savePrivateKey(priv crypto.Signer, passphrase string, file string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		if block, err = encryptPrivateKey(der, passphrase); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(file, pem.EncodeToMemory(block), 0600)
+}
+
+func saveCertificate(der []byte, file string) error {
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,238 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"pTunnel/utils/serialize"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The handshake runs before anything else is sent on a control connection
+// or a p2p registration:
+//
+//	client -> server: ClientHello{KeyID, PublicKey, Random}
+//	server -> client: ServerHello{PublicKey, Random, Signature}
+//
+// Both public keys are ephemeral X25519 keys. The server signs the hash of
+// the transcript with the long-term key named by KeyID, so the client
+// knows who it is talking to, and the session key is derived from the X25519
+// shared secret with HKDF. Stealing the long-term key later does not reveal
+// the session keys of recorded connections.
+
+const handshakeLabel = "pTunnel handshake v1"
+
+const handshakeRandomSize = 32
+
+// LineReadWriter is the part of conn.Socket used by the handshake
+type LineReadWriter interface {
+	ReadLine() ([]byte, error)
+	WriteLine(data []byte) error
+}
+
+// ClientHandshake runs the handshake on socket and returns the session key,
+// pub is the public key of the server. pub may only be nil if the server has
+// been authenticated by the transport already, e.g. a verified tls
+// certificate, the server signature is not checked then.
+func ClientHandshake(socket LineReadWriter, pub crypto.PublicKey) ([]byte, error) {
+	var id string
+	var err error
+	if pub != nil {
+		if id, err = keyID(pub); err != nil {
+			return nil, err
+		}
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, handshakeRandomSize)
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	clientHello, err := encodeHello(map[string]interface{}{
+		"KeyID":     id,
+		"PublicKey": base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+		"Random":    base64.StdEncoding.EncodeToString(random),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = socket.WriteLine(clientHello); err != nil {
+		return nil, err
+	}
+
+	line, err := socket.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	serverHello, err := decodeHello(line, "PublicKey", "Random", "Signature")
+	if err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(serverHello["PublicKey"])
+	if err != nil {
+		return nil, err
+	}
+	transcript := transcriptHash(clientHello, serverHello["PublicKey"], serverHello["Random"])
+	if pub != nil && !verify(pub, transcript, serverHello["Signature"]) {
+		return nil, errors.New("invalid server signature")
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	return sessionKey(shared, transcript)
+}
+
+// ServerHandshake answers the handshake of a client on socket with the key
+// asked for by the client, it returns the session key and the key used. A
+// client without the public key asks for no key, the first active key is
+// used then.
+func ServerHandshake(socket LineReadWriter, keys []*ServerKey) ([]byte, *ServerKey, error) {
+	clientHello, err := socket.ReadLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	clientHello = trimLine(clientHello)
+	hello, err := decodeHello(clientHello, "PublicKey", "Random")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hello["Random"]) != handshakeRandomSize {
+		return nil, nil, errors.New("invalid client random")
+	}
+	id, err := decodeKeyID(clientHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key *ServerKey
+	for _, k := range keys {
+		if k.ID == id || (id == "" && !k.Deprecated) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, nil, errors.New("unknown key id: " + id)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(hello["PublicKey"])
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	random := make([]byte, handshakeRandomSize)
+	if _, err = rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	transcript := transcriptHash(clientHello, private.PublicKey().Bytes(), random)
+	signature, err := sign(key.Signer, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverHello, err := encodeHello(map[string]interface{}{
+		"PublicKey": base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+		"Random":    base64.StdEncoding.EncodeToString(random),
+		"Signature": base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = socket.WriteLine(serverHello); err != nil {
+		return nil, nil, err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := sessionKey(shared, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, key, nil
+}
+
+// transcriptHash binds the signature to both hellos, the client hello is
+// hashed as sent so that both ends hash exactly the same bytes
+func transcriptHash(clientHello []byte, serverPublic []byte, serverRandom []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel))
+	h.Write(clientHello)
+	h.Write(serverPublic)
+	h.Write(serverRandom)
+	return h.Sum(nil)
+}
+
+// sessionKey returns a 32 bytes key made of printable characters, the
+// session key is also embedded in json messages, which only keep valid utf-8
+func sessionKey(shared []byte, transcript []byte) ([]byte, error) {
+	key := make([]byte, 24)
+	reader := hkdf.New(sha256.New, shared, transcript, []byte(handshakeLabel+" session key"))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return []byte(base64.RawURLEncoding.EncodeToString(key)), nil
+}
+
+func encodeHello(hello map[string]interface{}) ([]byte, error) {
+	bytes, err := serialize.Serialize(&hello)
+	if err != nil {
+		return nil, err
+	}
+	return Base64Encoding(bytes), nil
+}
+
+// decodeHello returns the base64 decoded fields of a hello message
+func decodeHello(line []byte, fields ...string) (map[string][]byte, error) {
+	bytes, err := Base64Decoding(trimLine(line))
+	if err != nil {
+		return nil, err
+	}
+	dict := make(map[string]interface{})
+	if err = serialize.Deserialize(bytes, &dict); err != nil {
+		return nil, err
+	}
+	hello := make(map[string][]byte)
+	for _, field := range fields {
+		str, ok := dict[field].(string)
+		if !ok {
+			return nil, errors.New("handshake field is missing: " + field)
+		}
+		if hello[field], err = base64.StdEncoding.DecodeString(str); err != nil {
+			return nil, err
+		}
+	}
+	return hello, nil
+}
+
+// decodeKeyID returns the KeyID of a client hello
+func decodeKeyID(clientHello []byte) (string, error) {
+	bytes, err := Base64Decoding(clientHello)
+	if err != nil {
+		return "", err
+	}
+	dict := make(map[string]interface{})
+	if err = serialize.Deserialize(bytes, &dict); err != nil {
+		return "", err
+	}
+	id, ok := dict["KeyID"].(string)
+	if !ok {
+		return "", errors.New("handshake field is missing: KeyID")
+	}
+	return id, nil
+}
+
+func trimLine(line []byte) []byte {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
@@ -0,0 +1,26 @@
+package security
+
+import "crypto"
+
+// ServerKey is one of the private keys of the server, several keys can be
+// active at the same time so that they can be rotated without updating every
+// client at once
+type ServerKey struct {
+	ID         string
+	Signer     crypto.Signer
+	Deprecated bool // still accepted, but the clients using it should move on
+}
+
+// NewServerKey returns the ServerKey of the private key
+func NewServerKey(signer crypto.Signer) (*ServerKey, error) {
+	id, err := keyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &ServerKey{ID: id, Signer: signer}, nil
+}
+
+// KeyID returns the key ID of the public key
+func KeyID(pub crypto.PublicKey) (string, error) {
+	return keyID(pub)
+}
@@ -0,0 +1,235 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"pTunnel/utils/common"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the PEM type of a private key encrypted with a passphrase, the body is the
+// PKCS#8 encoded key sealed with AES-256-GCM under a key derived by scrypt
+const encryptedKeyType = "PTUNNEL ENCRYPTED PRIVATE KEY"
+
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// GenKey saves a new key pair of keyType (rsa, ed25519 or ecdsa) in saveDir
+// and returns its key ID, bits is only used by rsa. The private key is
+// encrypted if passphrase is not empty.
+func GenKey(keyType string, bits int, passphrase string, saveDir string) (string, error) {
+	var priv crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = errors.New("unsupported key type: " + keyType)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = common.Mkdir(saveDir, true); err != nil {
+		return "", err
+	}
+
+	if err = savePrivateKey(priv, passphrase, saveDir+"/PrivateKey.pem"); err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return "", err
+	}
+	block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	if err = os.WriteFile(saveDir+"/PublicKey.pem", pem.EncodeToMemory(block), 0644); err != nil {
+		return "", err
+	}
+	return keyID(priv.Public())
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key,
+// or a key encrypted by GenKey, passphrase is only used by the latter
+func ParsePrivateKey(data []byte, passphrase string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key error")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case encryptedKeyType:
+		if passphrase == "" {
+			return nil, errors.New("the private key is encrypted, but no passphrase is given")
+		}
+		var der []byte
+		if der, err = decryptPrivateKey(block, passphrase); err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, errors.New("unsupported private key type: " + block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey, *ecdsa.PrivateKey:
+		return key.(crypto.Signer), nil
+	}
+	return nil, fmt.Errorf("unsupported private key: %T", key)
+}
+
+// ParsePublicKey parses a PEM encoded PKIX public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key error")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported public key: %T", pub)
+}
+
+// sign signs digest, a sha256 hash, with the scheme of the key type,
+// rsa keys use PSS, ed25519 keys sign the digest itself as the message
+func sign(signer crypto.Signer, digest []byte) ([]byte, error) {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return signer.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case ed25519.PrivateKey:
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	default:
+		return signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+}
+
+// verify checks a signature made by sign
+func verify(pub crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(pub, crypto.SHA256, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, digest, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest, signature)
+	}
+	return false
+}
+
+func encryptPrivateKey(der []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := AEADEncrypt(der, key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":  fmt.Sprintf("scrypt,N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+			"Salt": hex.EncodeToString(salt),
+		},
+		Bytes: sealed,
+	}, nil
+}
+
+func decryptPrivateKey(block *pem.Block, passphrase string) ([]byte, error) {
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["KDF"], "scrypt,N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, errors.New("invalid KDF of the private key: " + block.Headers["KDF"])
+	}
+	// the parameters come from the file, larger ones than encryptPrivateKey
+	// writes could make scrypt take gigabytes of memory or minutes of time
+	if n > scryptN || r > scryptR || p > scryptP {
+		return nil, fmt.Errorf("the KDF parameters of the private key exceed N=%d,r=%d,p=%d: %s", scryptN, scryptR, scryptP, block.Headers["KDF"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	der, err := AEADDecrypt(block.Bytes, key)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted private key")
+	}
+	return der, nil
+}
+
+// keyID is the first 16 hex characters of the sha256 of the PKIX encoded public key
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// keyBits returns the size of the key in bits
+func keyBits(pub crypto.PublicKey) int {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen()
+	case ed25519.PublicKey:
+		return 256
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().BitSize
+	}
+	return 0
+}
+
+// KeyType returns the name of the key type and its size, e.g. "rsa-2048"
+func KeyType(pub crypto.PublicKey) string {
+	name := "unknown"
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		name = "rsa"
+	case ed25519.PublicKey:
+		name = "ed25519"
+	case *ecdsa.PublicKey:
+		name = "ecdsa"
+	}
+	return name + "-" + strconv.Itoa(keyBits(pub))
+}
@@ -0,0 +1,48 @@
+package security
+
+import "time"
+
+// Rekeying is driven by the sender of each direction: once the key is due,
+// the sender tells the peer with a rekey message sealed under the old key
+// and both ends replace the key of that direction with NextKey of it. The
+// messages of a direction are in order, so no round trip is needed, and the
+// old key cannot be computed from the new one.
+
+const rekeyLabel = "pTunnel rekey"
+
+// NextKey derives the key that replaces key after a rekey
+func NextKey(key []byte) ([]byte, error) {
+	return DeriveKey(key, rekeyLabel, 32)
+}
+
+// RekeyCounter tells when the key of a direction is due, after bytes bytes
+// or interval since the last rekey, 0 disables either limit
+type RekeyCounter struct {
+	bytes    int64
+	interval time.Duration
+	sent     int64
+	since    time.Time
+}
+
+func NewRekeyCounter(bytes int64, interval time.Duration) *RekeyCounter {
+	return &RekeyCounter{
+		bytes:    bytes,
+		interval: interval,
+		since:    time.Now(),
+	}
+}
+
+// Add records n bytes sent under the current key and reports whether the key is due
+func (counter *RekeyCounter) Add(n int) bool {
+	counter.sent += int64(n)
+	if counter.bytes > 0 && counter.sent >= counter.bytes {
+		return true
+	}
+	return counter.interval > 0 && time.Since(counter.since) >= counter.interval
+}
+
+// Reset starts counting for a new key
+func (counter *RekeyCounter) Reset() {
+	counter.sent = 0
+	counter.since = time.Now()
+}
@@ -0,0 +1,95 @@
+package security
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrReplay is returned by ReplayCache.Check for a replayed or stale message
+var ErrReplay = errors.New("replayed metadata")
+
+// ReplayCache remembers the nonces seen within the window. A message is
+// accepted only if its timestamp is within the window of the local clock
+// and its nonce has not been seen, so a nonce only needs to be kept for
+// as long as its timestamp is valid. The nonces are also kept in a heap
+// ordered by expiry, so expiring them does not walk the whole cache.
+type ReplayCache struct {
+	window  time.Duration
+	lock    sync.Mutex
+	seen    map[string]time.Time
+	expires expiryHeap
+	now     func() time.Time
+}
+
+type expiry struct {
+	nonce  string
+	expire time.Time
+}
+
+// expiryHeap implements heap.Interface with the earliest expiry first
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+func NewReplayCache(window time.Duration) *ReplayCache {
+	return &ReplayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Check records nonce and returns an error wrapping ErrReplay if the message
+// is outside the window or nonce has been seen before, timestamp is the unix
+// time in seconds
+func (cache *ReplayCache) Check(nonce string, timestamp string) error {
+	if nonce == "" {
+		return fmt.Errorf("%w: the nonce is missing", ErrReplay)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrReplay, timestamp)
+	}
+	now := cache.now()
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-cache.window)) || sent.After(now.Add(cache.window)) {
+		return fmt.Errorf("%w: the timestamp %s is out of the window of %s", ErrReplay, sent.Format(time.RFC3339), cache.window)
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for len(cache.expires) > 0 && now.After(cache.expires[0].expire) {
+		delete(cache.seen, heap.Pop(&cache.expires).(expiry).nonce)
+	}
+	if _, ok := cache.seen[nonce]; ok {
+		return fmt.Errorf("%w: the nonce has been used", ErrReplay)
+	}
+	// the timestamp may be ahead of the local clock, keep the nonce until
+	// the timestamp itself leaves the window
+	expire := sent.Add(cache.window)
+	cache.seen[nonce] = expire
+	heap.Push(&cache.expires, expiry{nonce: nonce, expire: expire})
+	return nil
+}
+
+// GenNonce returns a random nonce for ReplayCache
+func GenNonce() string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
@@ -0,0 +1,227 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pipeSocket is a LineReadWriter over one end of net.Pipe
+type pipeSocket struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPipe() (*pipeSocket, *pipeSocket) {
+	a, b := net.Pipe()
+	return &pipeSocket{Conn: a, reader: bufio.NewReader(a)}, &pipeSocket{Conn: b, reader: bufio.NewReader(b)}
+}
+
+func (socket *pipeSocket) ReadLine() ([]byte, error) {
+	return socket.reader.ReadBytes('\n')
+}
+
+func (socket *pipeSocket) WriteLine(data []byte) error {
+	_, err := socket.Write(append(data, '\n'))
+	return err
+}
+
+type handshakeResult struct {
+	clientKey []byte
+	clientErr error
+	serverKey []byte
+	used      *ServerKey
+	serverErr error
+}
+
+// runHandshake runs both sides of the handshake, each side closes its end
+// when it fails so that the other side does not wait forever
+func runHandshake(pub crypto.PublicKey, keys []*ServerKey) handshakeResult {
+	client, server := newPipe()
+	defer client.Close()
+	defer server.Close()
+	var result handshakeResult
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result.serverKey, result.used, result.serverErr = ServerHandshake(server, keys)
+		if result.serverErr != nil {
+			_ = server.Close()
+		}
+	}()
+	result.clientKey, result.clientErr = ClientHandshake(client, pub)
+	if result.clientErr != nil {
+		_ = client.Close()
+	}
+	<-done
+	return result
+}
+
+func newTestServerKey(t *testing.T, keyType string) *ServerKey {
+	t.Helper()
+	var signer crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewServerKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHandshakeKeyID(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519", "ecdsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			other := newTestServerKey(t, "ed25519")
+			key := newTestServerKey(t, keyType)
+			result := runHandshake(key.Signer.Public(), []*ServerKey{other, key})
+			if result.clientErr != nil || result.serverErr != nil {
+				t.Fatalf("client: %v, server: %v", result.clientErr, result.serverErr)
+			}
+			if result.used != key {
+				t.Fatal("the server has not used the key asked for")
+			}
+			if !bytes.Equal(result.clientKey, result.serverKey) {
+				t.Fatal("the session keys differ")
+			}
+		})
+	}
+}
+
+func TestHandshakeEmptyKeyID(t *testing.T) {
+	deprecated := newTestServerKey(t, "ed25519")
+	deprecated.Deprecated = true
+	active := newTestServerKey(t, "ed25519")
+	result := runHandshake(nil, []*ServerKey{deprecated, active})
+	if result.clientErr != nil || result.serverErr != nil {
+		t.Fatalf("client: %v, server: %v", result.clientErr, result.serverErr)
+	}
+	if result.used != active {
+		t.Fatal("the server has not used the first active key")
+	}
+	if !bytes.Equal(result.clientKey, result.serverKey) {
+		t.Fatal("the session keys differ")
+	}
+}
+
+func TestHandshakeUnknownKeyID(t *testing.T) {
+	key := newTestServerKey(t, "ed25519")
+	unknown := newTestServerKey(t, "ed25519")
+	result := runHandshake(unknown.Signer.Public(), []*ServerKey{key})
+	if result.serverErr == nil || !strings.Contains(result.serverErr.Error(), "unknown key id") {
+		t.Fatalf("server: %v", result.serverErr)
+	}
+	if result.clientErr == nil {
+		t.Fatal("the client has finished the handshake")
+	}
+}
+
+func TestHandshakeWrongSignature(t *testing.T) {
+	key := newTestServerKey(t, "ed25519")
+	// a server which claims the key ID of key without having the key
+	impostor := newTestServerKey(t, "ed25519")
+	impostor.ID = key.ID
+	result := runHandshake(key.Signer.Public(), []*ServerKey{impostor})
+	if result.clientErr == nil || !strings.Contains(result.clientErr.Error(), "invalid server signature") {
+		t.Fatalf("client: %v", result.clientErr)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyType    string
+		passphrase string
+	}{
+		{"rsa", "rsa", ""},
+		{"ed25519", "ed25519", ""},
+		{"ecdsa", "ecdsa", ""},
+		{"encrypted ed25519", "ed25519", "correct horse"},
+		{"encrypted ecdsa", "ecdsa", "battery staple"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			id, err := GenKey(tt.keyType, 2048, tt.passphrase, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "PrivateKey.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.passphrase != "" {
+				if _, err = ParsePrivateKey(data, ""); err == nil {
+					t.Fatal("an encrypted key is parsed without the passphrase")
+				}
+				if _, err = ParsePrivateKey(data, tt.passphrase+"x"); err == nil {
+					t.Fatal("an encrypted key is parsed with a wrong passphrase")
+				}
+			}
+			signer, err := ParsePrivateKey(data, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := KeyID(signer.Public()); got != id {
+				t.Fatalf("key ID %s, want %s", got, id)
+			}
+			// the passphrase of a plain key is not needed and ignored
+			if tt.passphrase == "" {
+				if _, err = ParsePrivateKey(data, "unused"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeyKDF(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := GenKey("ed25519", 0, "passphrase", dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "PrivateKey.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		kdf  string
+	}{
+		{"large N", "scrypt,N=1073741824,r=8,p=1"},
+		{"large r", "scrypt,N=32768,r=1024,p=1"},
+		{"large p", "scrypt,N=32768,r=8,p=64"},
+		{"not scrypt", "pbkdf2,N=32768,r=8,p=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, _ := pem.Decode(data)
+			block.Headers["KDF"] = tt.kdf
+			_, err := ParsePrivateKey(pem.EncodeToMemory(block), "passphrase")
+			if err == nil || !strings.Contains(err.Error(), "KDF") {
+				t.Fatalf("got %v, want the KDF rejected", err)
+			}
+		})
+	}
+}
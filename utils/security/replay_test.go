@@ -0,0 +1,84 @@
+package security
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestReplayCache(now *time.Time) *ReplayCache {
+	cache := NewReplayCache(30 * time.Second)
+	cache.now = func() time.Time { return *now }
+	return cache
+}
+
+func unix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func TestReplayCacheCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		nonce     string
+		timestamp string
+		ok        bool
+	}{
+		{"fresh", "a", unix(now), true},
+		{"duplicate nonce", "a", unix(now), false},
+		{"within the window in the past", "b", unix(now.Add(-29 * time.Second)), true},
+		{"within the window in the future", "c", unix(now.Add(29 * time.Second)), true},
+		{"before the window", "d", unix(now.Add(-31 * time.Second)), false},
+		{"after the window", "e", unix(now.Add(31 * time.Second)), false},
+		{"empty nonce", "", unix(now), false},
+		{"non-numeric timestamp", "f", "yesterday", false},
+		{"empty timestamp", "g", "", false},
+	}
+	cache := newTestReplayCache(&now)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cache.Check(tt.nonce, tt.timestamp)
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok && !errors.Is(err, ErrReplay) {
+				t.Fatalf("got %v, want ErrReplay", err)
+			}
+		})
+	}
+}
+
+func TestReplayCacheExpire(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newTestReplayCache(&now)
+	// the nonce of a message from the future is kept longer
+	if err := cache.Check("late", unix(now.Add(20*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Check("early", unix(now)); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(31 * time.Second)
+	if err := cache.Check("other", unix(now)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.seen["early"]; ok {
+		t.Fatal("an expired nonce is kept")
+	}
+	if _, ok := cache.seen["late"]; !ok {
+		t.Fatal("a nonce is expired before its timestamp has left the window")
+	}
+	if err := cache.Check("late", unix(now.Add(-11*time.Second))); !errors.Is(err, ErrReplay) {
+		t.Fatalf("got %v, want ErrReplay", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := cache.Check("new", unix(now)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.seen) != 1 || len(cache.expires) != 1 {
+		t.Fatalf("%d nonces and %d expiries are kept, want 1", len(cache.seen), len(cache.expires))
+	}
+}